@@ -0,0 +1,170 @@
+package dxda
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// How often the adaptive controller re-evaluates the number of workers
+var adaptiveInterval = 10 * time.Second
+
+const (
+	// Adding a worker should increase the throughput by at least this
+	// fraction, otherwise we assume the link is saturated.
+	adaptiveMinGain = 0.05
+
+	// Number of intervals to wait after backing off, before probing for
+	// more bandwidth again.
+	adaptiveHoldIntervals = 6
+)
+
+// Measurements collected over one controller interval
+type adaptiveSample struct {
+	throughput float64 // bytes per second
+	errors     int64   // failed requests, including throttled ones
+	throttled  int64   // requests rejected with 429 or 503
+	heapBytes  int64   // memory in use by the process
+}
+
+// An additive-increase/multiplicative-decrease controller for the number
+// of active workers, in the spirit of TCP congestion control. Workers are
+// added one at a time while that improves throughput. Errors or throttling
+// from the server halve the number of workers, and memory pressure or a
+// throughput plateau remove one.
+type adaptiveController struct {
+	minLimit     int
+	maxLimit     int
+	memoryBudget int64
+
+	lastThroughput float64
+	increased      bool // the previous decision added a worker
+	hold           int  // intervals left before probing again
+}
+
+// Decide on the number of workers for the next interval. Returns the new
+// limit, and the reason for changing it (empty if there is no change).
+func (c *adaptiveController) next(limit int, s adaptiveSample) (int, string) {
+	increased := c.increased
+	lastThroughput := c.lastThroughput
+	c.increased = false
+	c.lastThroughput = s.throughput
+
+	switch {
+	case s.errors > 0:
+		c.hold = adaptiveHoldIntervals
+		newLimit := limit / 2
+		if newLimit < c.minLimit {
+			newLimit = c.minLimit
+		}
+		return newLimit, fmt.Sprintf("%d failed requests, %d throttled", s.errors, s.throttled)
+
+	case s.heapBytes > c.memoryBudget:
+		c.hold = adaptiveHoldIntervals
+		if limit <= c.minLimit {
+			return limit, ""
+		}
+		return limit - 1, fmt.Sprintf("memory use %s is over the budget of %s",
+			diskSpaceString(s.heapBytes), diskSpaceString(c.memoryBudget))
+
+	case increased && s.throughput < lastThroughput*(1+adaptiveMinGain):
+		// the last worker we added did not help
+		c.hold = adaptiveHoldIntervals
+		if limit <= c.minLimit {
+			return limit, ""
+		}
+		return limit - 1, "throughput did not improve with an additional worker"
+
+	case c.hold > 0:
+		c.hold--
+		return limit, ""
+
+	case limit < c.maxLimit:
+		c.increased = true
+		return limit + 1, "probing for additional bandwidth"
+	}
+	return limit, ""
+}
+
+// Memory used by each download thread: its buffers, and the part it may
+// keep in the output sink
+func (st *State) memoryPerThread() int64 {
+	cost := 3 * st.maxChunkSize
+	if st.sink != nil {
+		cost += st.sink.memoryPerPart()
+	}
+	return cost
+}
+
+// The largest number of workers the adaptive mode may use. The same memory
+// constraints as in calcNumThreads apply.
+func (st *State) maxAdaptiveThreads() int {
+	limit := int((memorySizeBytes() - GiB) / st.memoryPerThread())
+	limit = MinInt(limit, maxNumThreads)
+	if limit < st.opts.NumThreads {
+		limit = st.opts.NumThreads
+	}
+	if limit < minNumThreads {
+		limit = minNumThreads
+	}
+	return limit
+}
+
+// Periodically adjust the number of active workers based on the measured
+// throughput, error rate and memory use, until the stop channel is closed.
+func (st *State) adaptiveConcurrency(gate *workerGate, stop <-chan struct{}) {
+	ctrl := adaptiveController{
+		minLimit:     minNumThreads,
+		maxLimit:     st.maxAdaptiveThreads(),
+		memoryBudget: memorySizeBytes() - GiB,
+	}
+	slog.Info("adaptive threads: starting",
+		"workers", gate.getLimit(), "min_workers", ctrl.minLimit, "max_workers", ctrl.maxLimit)
+
+	lastTime := time.Now()
+	lastBytes := st.stats.bytesReceived.Load()
+	lastErrors := st.stats.errors.Load()
+	lastThrottled := st.stats.throttled.Load()
+
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		bytes := st.stats.bytesReceived.Load()
+		errors := st.stats.errors.Load()
+		throttled := st.stats.throttled.Load()
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+
+		sample := adaptiveSample{
+			throughput: float64(bytes-lastBytes) / now.Sub(lastTime).Seconds(),
+			errors:     errors - lastErrors,
+			throttled:  throttled - lastThrottled,
+			heapBytes:  int64(memStats.HeapInuse),
+		}
+		lastTime, lastBytes, lastErrors, lastThrottled = now, bytes, errors, throttled
+
+		// nothing to learn from a paused download
+		if gate.isPaused() {
+			continue
+		}
+
+		limit := gate.getLimit()
+		newLimit, reason := ctrl.next(limit, sample)
+		if newLimit != limit {
+			gate.setLimit(newLimit)
+			slog.Info("adaptive threads: changing workers",
+				"from", limit, "to", newLimit, "reason", reason, "mb_per_sec", sample.throughput/MiB)
+		} else {
+			slog.Debug("adaptive threads: keeping workers",
+				"workers", limit, "mb_per_sec", sample.throughput/MiB)
+		}
+	}
+}
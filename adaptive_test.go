@@ -0,0 +1,119 @@
+package dxda
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Simulated link: each worker can pull [perWorker] bytes per second, and
+// the link tops out at [ceiling]. Beyond [maxConcurrent] workers the server
+// starts throttling requests.
+func simulateLink(numWorkers int, perWorker, ceiling float64, maxConcurrent int) adaptiveSample {
+	throughput := float64(numWorkers) * perWorker
+	if throughput > ceiling {
+		throughput = ceiling
+	}
+	var throttled int64
+	if numWorkers > maxConcurrent {
+		throttled = int64(numWorkers - maxConcurrent)
+	}
+	return adaptiveSample{throughput: throughput, errors: throttled, throttled: throttled}
+}
+
+func TestAdaptiveControllerSimulation(t *testing.T) {
+	ctrl := adaptiveController{minLimit: 2, maxLimit: 32, memoryBudget: GiB}
+
+	// 10 MB/s per worker, 80 MB/s link. The optimum is 8 workers.
+	limit := 2
+	var history []int
+	for i := 0; i < 200; i++ {
+		sample := simulateLink(limit, 10*MiB, 80*MiB, 20)
+		limit, _ = ctrl.next(limit, sample)
+		history = append(history, limit)
+	}
+	for _, l := range history[100:] {
+		if l < 7 || l > 9 {
+			t.Fatalf("Expected the controller to settle around 8 workers, got %v", history[100:])
+		}
+	}
+
+	// a server that throttles above 4 concurrent requests
+	ctrl = adaptiveController{minLimit: 2, maxLimit: 32, memoryBudget: GiB}
+	limit = 2
+	for i := 0; i < 200; i++ {
+		sample := simulateLink(limit, 10*MiB, 1000*MiB, 4)
+		limit, _ = ctrl.next(limit, sample)
+		if limit > 5 {
+			t.Fatalf("Expected throttling to keep the limit at most one above 4, got %d", limit)
+		}
+	}
+
+	// memory pressure
+	ctrl = adaptiveController{minLimit: 2, maxLimit: 32, memoryBudget: GiB}
+	newLimit, reason := ctrl.next(10, adaptiveSample{throughput: 10 * MiB, heapBytes: 2 * GiB})
+	if newLimit != 9 || reason == "" {
+		t.Errorf("Expected memory pressure to remove a worker, got %d (%s)", newLimit, reason)
+	}
+}
+
+func TestAdaptiveDownload(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(6, 2*MiB, 512*KiB)
+	ts := newTestServer(files, 6*MiB, 5)
+	defer ts.Close()
+
+	saved := adaptiveInterval
+	adaptiveInterval = 200 * time.Millisecond
+	defer func() { adaptiveInterval = saved }()
+
+	st := NewDxDa(ts.dxEnv(t), "test.manifest.json.bz2", Opts{NumThreads: 2, AdaptiveThreads: true})
+	defer st.Close()
+	st.maxChunkSize = 256 * KiB
+
+	st.CreateManifestDB(testManifest(files, "/data"), "test.manifest.json.bz2")
+
+	var limits sync.Map
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				if st.gate != nil {
+					limits.Store(st.gate.getLimit(), true)
+				}
+			}
+		}
+	}()
+	err := st.DownloadManifestDB("test.manifest.json.bz2")
+	close(stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		data, err := os.ReadFile("data/" + f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("Downloaded file %s does not match", f.name)
+		}
+	}
+
+	numLimits := 0
+	limits.Range(func(limit, _ any) bool {
+		numLimits++
+		if limit.(int) < minNumThreads || limit.(int) > st.maxAdaptiveThreads() {
+			t.Errorf("Worker limit %d is out of range", limit)
+		}
+		return true
+	})
+	if numLimits < 2 {
+		t.Errorf("Expected the controller to change the number of workers")
+	}
+}
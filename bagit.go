@@ -0,0 +1,488 @@
+package dxda
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BagIt packaging (RFC 8493). The files are downloaded into the data/
+// payload directory, and once the download is complete, the tag files
+// are written next to it:
+//
+//	bagit.txt               version and encoding
+//	bag-info.txt            DNAnexus projects and files, download times
+//	manifest-sha256.txt     checksum of every payload file
+//	tagmanifest-sha256.txt  checksums of the three files above
+const (
+	bagPayloadDir   = "data"
+	bagDeclaration  = "bagit.txt"
+	bagInfo         = "bag-info.txt"
+	bagManifest     = "manifest-sha256.txt"
+	bagTagManifest  = "tagmanifest-sha256.txt"
+	bagItVersion    = "1.0"
+	bagDateFormat   = "2006-01-02"
+	bagChecksumAlgo = FileChecksumSHA256
+)
+
+// Hash functions for the manifests of bags written by other tools
+var bagHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// IsBag is true if the download is laid out as a BagIt bag. This is
+// chosen when the manifest database is created.
+func (st *State) IsBag() bool {
+	return st.tableExists("bag_info")
+}
+
+func (st *State) createBagTable() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err := st.db.Exec(`
+	CREATE TABLE bag_info (
+		created_at integer
+	);
+	`)
+	check(err)
+	_, err = st.db.Exec("INSERT INTO bag_info VALUES (?)", time.Now().UnixNano())
+	check(err)
+}
+
+// Move the files of the manifest into the payload directory of the bag
+func bagPayloadManifest(m Manifest) Manifest {
+	payload := Manifest{Files: make([]DXFile, 0, len(m.Files))}
+	for _, f := range m.Files {
+		switch f.(type) {
+		case DXFileRegular:
+			reg := f.(DXFileRegular)
+			reg.Folder = path.Join("/"+bagPayloadDir, reg.Folder)
+			payload.Files = append(payload.Files, reg)
+		case DXFileSymlink:
+			slnk := f.(DXFileSymlink)
+			slnk.Folder = path.Join("/"+bagPayloadDir, slnk.Folder)
+			payload.Files = append(payload.Files, slnk)
+		}
+	}
+	return payload
+}
+
+// Paths in bag manifests have carriage returns, line feeds and percent
+// signs percent-encoded.
+func encodeBagPath(p string) string {
+	p = strings.ReplaceAll(p, "%", "%25")
+	p = strings.ReplaceAll(p, "\n", "%0A")
+	return strings.ReplaceAll(p, "\r", "%0D")
+}
+
+func decodeBagPath(p string) string {
+	p = strings.ReplaceAll(p, "%0A", "\n")
+	p = strings.ReplaceAll(p, "%0a", "\n")
+	p = strings.ReplaceAll(p, "%0D", "\r")
+	p = strings.ReplaceAll(p, "%0d", "\r")
+	return strings.ReplaceAll(p, "%25", "%")
+}
+
+// Whether a path is one of the tag files of the bag, at its top level
+func isBagTagFile(p string) bool {
+	if p == bagDeclaration || p == bagInfo {
+		return true
+	}
+	return !strings.Contains(p, string(filepath.Separator)) && strings.HasSuffix(p, ".txt") &&
+		(strings.HasPrefix(p, "manifest-") || strings.HasPrefix(p, "tagmanifest-"))
+}
+
+// The first and last times a part was downloaded
+func (st *State) downloadTimes() (time.Time, time.Time) {
+	first := st.queryDBIntegerResult(`
+		SELECT MIN(t) FROM (
+			SELECT MIN(download_done_time) AS t FROM manifest_regular_stats WHERE download_done_time > 0
+			UNION ALL
+			SELECT MIN(download_done_time) AS t FROM manifest_symlink_stats WHERE download_done_time > 0)`)
+	last := st.queryDBIntegerResult(`
+		SELECT MAX(t) FROM (
+			SELECT MAX(download_done_time) AS t FROM manifest_regular_stats
+			UNION ALL
+			SELECT MAX(download_done_time) AS t FROM manifest_symlink_stats)`)
+	return time.Unix(0, first), time.Unix(0, last)
+}
+
+// WriteBag writes the tag files of the bag, once all the files are
+// downloaded. The payload checksums are computed from the files, verifying
+// their parts against the manifest.
+func (st *State) WriteBag() error {
+	files, err := st.completeFiles()
+	if err != nil {
+		return err
+	}
+	if numFiles := st.numManifestFiles(); int64(len(files)) != numFiles {
+		return fmt.Errorf("only %d of %d files are downloaded, the bag can only be written once the download is complete",
+			len(files), numFiles)
+	}
+	if err := st.createFileChecksumsTable(); err != nil {
+		return err
+	}
+	done, failed := st.computeFileDigests(files, []string{bagChecksumAlgo})
+	if len(failed) > 0 {
+		return fmt.Errorf("%d files failed verification, run the inspect command to reset them: %s",
+			len(failed), strings.Join(failed, ", "))
+	}
+
+	var manifest, fileIds strings.Builder
+	var numBytes int64
+	projects := make(map[string]bool)
+	for _, r := range done {
+		p := filepath.ToSlash(filepath.Join(".", r.f.folder, r.f.name))
+		fmt.Fprintf(&manifest, "%s  %s\n", r.digests[bagChecksumAlgo], encodeBagPath(p))
+		fmt.Fprintf(&fileIds, "DNAnexus-File: %s %s\n", r.f.fileId, encodeBagPath(p))
+		numBytes += r.f.size
+		projects[r.f.project] = true
+	}
+	var projectIds []string
+	for p := range projects {
+		projectIds = append(projectIds, p)
+	}
+	sort.Strings(projectIds)
+
+	first, last := st.downloadTimes()
+	var info strings.Builder
+	fmt.Fprintf(&info, "Bag-Software-Agent: dx-download-agent %s\n", Version)
+	fmt.Fprintf(&info, "Bagging-Date: %s\n", time.Now().Format(bagDateFormat))
+	fmt.Fprintf(&info, "Payload-Oxum: %d.%d\n", numBytes, len(done))
+	for _, p := range projectIds {
+		fmt.Fprintf(&info, "DNAnexus-Project: %s\n", p)
+	}
+	fmt.Fprintf(&info, "DNAnexus-Download-Started: %s\n", first.Format(time.RFC3339))
+	fmt.Fprintf(&info, "DNAnexus-Download-Completed: %s\n", last.Format(time.RFC3339))
+	info.WriteString(fileIds.String())
+
+	tagFiles := []struct{ name, content string }{
+		{bagDeclaration, fmt.Sprintf("BagIt-Version: %s\nTag-File-Character-Encoding: UTF-8\n", bagItVersion)},
+		{bagInfo, info.String()},
+		{bagManifest, manifest.String()},
+	}
+	var tagManifest strings.Builder
+	for _, tf := range tagFiles {
+		if err := os.WriteFile(tf.name, []byte(tf.content), 0644); err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte(tf.content))
+		fmt.Fprintf(&tagManifest, "%s  %s\n", hex.EncodeToString(sum[:]), tf.name)
+	}
+	return os.WriteFile(bagTagManifest, []byte(tagManifest.String()), 0644)
+}
+
+// BagValidation is the outcome of validating a bag. The bag is valid if
+// there are no problems.
+type BagValidation struct {
+	NumFiles int64
+	NumBytes int64
+	Problems []string
+}
+
+func (v *BagValidation) OK() bool {
+	return len(v.Problems) == 0
+}
+
+func (v *BagValidation) problem(format string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+// Read a manifest, or tag manifest, of a bag. Returns the expected
+// checksum of each path.
+func readBagManifest(fname string) (map[string]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*KiB), 64*KiB)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: bad line %q", fname, line)
+		}
+		p := decodeBagPath(strings.TrimLeft(line[i:], " \t"))
+		sums[path.Clean(p)] = strings.ToLower(line[:i])
+	}
+	return sums, scanner.Err()
+}
+
+// Read the labels and values of a tag file such as bag-info.txt. Values
+// may continue on lines starting with whitespace.
+func readBagTags(fname string) (map[string][]string, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string][]string)
+	var label string
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && label != "" {
+			values := tags[label]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: bad line %q", fname, line)
+		}
+		label = strings.TrimSpace(line[:i])
+		tags[label] = append(tags[label], strings.TrimSpace(line[i+1:]))
+	}
+	return tags, nil
+}
+
+// Compute the checksums of a file with several algorithms at once
+func bagFileDigests(fname string, algs []string) (map[string]string, int64, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	hashers := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, alg := range algs {
+		hashers[alg] = bagHashes[alg]()
+		writers = append(writers, hashers[alg])
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), f)
+	if err != nil {
+		return nil, 0, err
+	}
+	digests := make(map[string]string)
+	for alg, h := range hashers {
+		digests[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, n, nil
+}
+
+// The algorithm of a manifest file name such as manifest-sha256.txt
+func bagManifestAlgorithm(name, prefix string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".txt")
+}
+
+// ValidateBag checks that a bag is complete, and that the checksums of
+// its files match its manifests, as described in RFC 8493. Problems with
+// the bag are reported in the validation; an error is only returned if
+// the bag could not be read at all.
+func ValidateBag(dir string, numThreads int) (*BagValidation, error) {
+	v := &BagValidation{}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	decl, err := readBagTags(filepath.Join(dir, bagDeclaration))
+	if err != nil {
+		v.problem("%s is missing or malformed: %s", bagDeclaration, err.Error())
+	} else if len(decl["BagIt-Version"]) == 0 || len(decl["Tag-File-Character-Encoding"]) == 0 {
+		v.problem("%s does not declare BagIt-Version and Tag-File-Character-Encoding", bagDeclaration)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, bagPayloadDir)); err != nil || !fi.IsDir() {
+		v.problem("the payload directory %s is missing", bagPayloadDir)
+		return v, nil
+	}
+
+	// the manifests, by algorithm
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	payloadSums := make(map[string]map[string]string)
+	tagSums := make(map[string]map[string]string)
+	for _, e := range entries {
+		name := e.Name()
+		var sums map[string]map[string]string
+		var alg string
+		switch {
+		case strings.HasPrefix(name, "manifest-") && strings.HasSuffix(name, ".txt"):
+			sums, alg = payloadSums, bagManifestAlgorithm(name, "manifest-")
+		case strings.HasPrefix(name, "tagmanifest-") && strings.HasSuffix(name, ".txt"):
+			sums, alg = tagSums, bagManifestAlgorithm(name, "tagmanifest-")
+		default:
+			continue
+		}
+		if bagHashes[alg] == nil {
+			v.problem("%s uses the unsupported algorithm %s", name, alg)
+			continue
+		}
+		m, err := readBagManifest(filepath.Join(dir, name))
+		if err != nil {
+			v.problem("%s could not be read: %s", name, err.Error())
+			continue
+		}
+		sums[alg] = m
+	}
+	if len(payloadSums) == 0 {
+		v.problem("the bag has no payload manifest")
+		return v, nil
+	}
+
+	// every file in the payload must be listed in every manifest
+	payloadFiles := make(map[string]bool)
+	var payloadBytes int64
+	err = filepath.WalkDir(filepath.Join(dir, bagPayloadDir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		payloadFiles[filepath.ToSlash(rel)] = true
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		payloadBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// expected checksums of each file, by algorithm
+	expected := make(map[string]map[string]string)
+	addExpected := func(all map[string]map[string]string, payload bool) {
+		for alg, m := range all {
+			for p, sum := range m {
+				if payload && !strings.HasPrefix(p, bagPayloadDir+"/") {
+					v.problem("manifest-%s.txt lists %s, outside of the payload directory", alg, p)
+					continue
+				}
+				if strings.HasPrefix(p, "../") || path.IsAbs(p) {
+					v.problem("%s is outside of the bag", p)
+					continue
+				}
+				if expected[p] == nil {
+					expected[p] = make(map[string]string)
+				}
+				expected[p][alg] = sum
+			}
+		}
+	}
+	addExpected(payloadSums, true)
+	addExpected(tagSums, false)
+	for p := range payloadFiles {
+		for alg, m := range payloadSums {
+			if _, ok := m[p]; !ok {
+				v.problem("%s is not listed in manifest-%s.txt", p, alg)
+			}
+		}
+	}
+
+	// verify the checksums in parallel
+	type result struct {
+		path string
+		size int64
+		err  error
+		bad  []string
+	}
+	var paths []string
+	for p := range expected {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	jobs := make(chan string, len(paths))
+	results := make(chan result, len(paths))
+	for _, p := range paths {
+		jobs <- p
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for w := 0; w < max(numThreads, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				var algs []string
+				for alg := range expected[p] {
+					algs = append(algs, alg)
+				}
+				sort.Strings(algs)
+				digests, size, err := bagFileDigests(filepath.Join(dir, filepath.FromSlash(p)), algs)
+				r := result{path: p, size: size, err: err}
+				for _, alg := range algs {
+					if err == nil && digests[alg] != expected[p][alg] {
+						r.bad = append(r.bad, alg)
+					}
+				}
+				results <- r
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var all []result
+	for r := range results {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].path < all[j].path })
+	for _, r := range all {
+		switch {
+		case os.IsNotExist(r.err):
+			v.problem("%s is listed in a manifest, but does not exist", r.path)
+		case r.err != nil:
+			v.problem("%s could not be read: %s", r.path, r.err.Error())
+		case len(r.bad) > 0:
+			v.problem("%s does not match its %s checksum", r.path, strings.Join(r.bad, " and "))
+		}
+		if payloadFiles[r.path] && r.err == nil {
+			v.NumFiles++
+			v.NumBytes += r.size
+		}
+	}
+
+	// the payload size and file count, if declared
+	info, err := readBagTags(filepath.Join(dir, bagInfo))
+	if err == nil && len(info["Payload-Oxum"]) > 0 {
+		oxum := strings.SplitN(info["Payload-Oxum"][0], ".", 2)
+		numBytes, errBytes := strconv.ParseInt(oxum[0], 10, 64)
+		var numFiles int64
+		errFiles := fmt.Errorf("missing file count")
+		if len(oxum) == 2 {
+			numFiles, errFiles = strconv.ParseInt(oxum[1], 10, 64)
+		}
+		if errBytes != nil || errFiles != nil {
+			v.problem("bad Payload-Oxum %q", info["Payload-Oxum"][0])
+		} else if numBytes != payloadBytes || numFiles != int64(len(payloadFiles)) {
+			v.problem("Payload-Oxum is %d.%d, the payload has %d.%d",
+				numBytes, numFiles, payloadBytes, len(payloadFiles))
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,76 @@
+package dxda
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBagIt(t *testing.T) {
+	files := makeTestFiles(3, 300*KiB, 128*KiB)
+	st := downloadTestFiles(t, Opts{NumThreads: 2, BagIt: true}, files)
+	if !st.IsBag() {
+		t.Fatal("Expected the download to be laid out as a bag")
+	}
+
+	for _, f := range files {
+		data, err := os.ReadFile("data/exome/" + f.name)
+		if err != nil || string(data) != string(f.data) {
+			t.Errorf("Expected %s in the payload directory", f.name)
+		}
+	}
+	info, err := os.ReadFile(bagInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		fmt.Sprintf("Payload-Oxum: %d.3\n", 3*300*KiB),
+		"DNAnexus-Project: project-",
+		fmt.Sprintf("DNAnexus-File: %s data/exome/%s\n", files[1].id, files[1].name),
+		"DNAnexus-Download-Completed: ",
+	} {
+		if !strings.Contains(string(info), expected) {
+			t.Errorf("Expected %q in bag-info.txt, got\n%s", expected, info)
+		}
+	}
+
+	v, err := ValidateBag(".", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.OK() || v.NumFiles != 3 || v.NumBytes != 3*300*KiB {
+		t.Fatalf("Expected a valid bag, got %+v", v)
+	}
+	orphans, err := st.FindOrphans()
+	if err != nil || len(orphans) != 0 {
+		t.Errorf("Expected the tag files not to be orphans, got %+v", orphans)
+	}
+
+	// a modified file, and a file missing from the manifest
+	corrupted := append([]byte{}, files[0].data...)
+	corrupted[0] ^= 0xff
+	if err := os.WriteFile("data/exome/"+files[0].name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("data/extra.txt", []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err = ValidateBag(".", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"data/extra.txt is not listed in manifest-sha256.txt",
+		"data/exome/" + files[0].name + " does not match its sha256 checksum",
+		fmt.Sprintf("Payload-Oxum is %d.3, the payload has %d.4", 3*300*KiB, 3*300*KiB+5),
+	}
+	if len(v.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %q", len(expected), v.Problems)
+	}
+	for i := range expected {
+		if v.Problems[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], v.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package dxda
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A content cache shared by the downloads on the same storage, see
+// Opts.CacheDir. Each file is stored once under objects/, named by a
+// digest of its file ID and part checksums, and the cache.db database
+// records the size and last use of each entry. Several downloads may use
+// the cache at the same time.
+const (
+	cacheDBName     = "cache.db"
+	cacheObjectsDir = "objects"
+)
+
+type contentCache struct {
+	dir      string
+	mode     string // how files are linked to and from the cache
+	maxSize  int64  // in bytes, zero if unlimited
+	db       *sql.DB
+	mutex    sync.Mutex
+	fellBack atomic.Bool // warned that files are copied instead
+}
+
+// ValidateCacheMode checks how files are linked to and from the cache
+func ValidateCacheMode(mode string) error {
+	switch mode {
+	case "", DedupeHardlink, DedupeReflink, DedupeCopy:
+		return nil
+	}
+	return fmt.Errorf("unsupported cache mode %q, expected one of %s",
+		mode, strings.Join([]string{DedupeHardlink, DedupeReflink, DedupeCopy}, ", "))
+}
+
+// ValidateCacheMetadata checks that the modes and times of the downloaded
+// files can be set. Hard links to the cache share them with every other
+// download of the same files.
+func ValidateCacheMetadata(opts Opts) error {
+	if opts.CacheMode == DedupeHardlink && (opts.PreserveTimes || opts.FileMode != 0) {
+		return fmt.Errorf("the %s cache mode cannot be used with preserved times or a file mode, "+
+			"since the cached files are shared between downloads", DedupeHardlink)
+	}
+	return nil
+}
+
+func openContentCache(dir string, mode string, maxSize int64) (*contentCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, cacheObjectsDir), 0777); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, cacheDBName)+"?_busy_timeout=60000&mode=rwc")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS cache_entries (
+		key       text PRIMARY KEY,
+		file_id   text,
+		size      integer,
+		last_used integer
+	);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if mode == "" {
+		mode = DedupeReflink
+	}
+	return &contentCache{dir: dir, mode: mode, maxSize: maxSize, db: db}, nil
+}
+
+// Returns nil if the options do not name a cache directory
+func newContentCache(st *State) (*contentCache, error) {
+	if st.opts.CacheDir == "" {
+		return nil, nil
+	}
+	if err := ValidateCacheMetadata(st.opts); err != nil {
+		return nil, err
+	}
+	return openContentCache(st.opts.CacheDir, st.opts.CacheMode, st.opts.CacheMaxSize)
+}
+
+// Evict the least recently used entries to fit the size limit, once the
+// download is done rather than after each file, then close the database.
+func (cc *contentCache) close() {
+	if cc == nil {
+		return
+	}
+	if cc.maxSize > 0 {
+		if _, err := cc.gc(cc.maxSize); err != nil {
+			slog.Warn("could not evict files from the cache", "cache", cc.dir, "error", err)
+		}
+	}
+	cc.db.Close()
+}
+
+// The cache key of a file, from its file ID and the checksums of its
+// parts, or of the whole file for symbolic links
+func cacheKey(f completedFile) string {
+	checksumType, sums := provenanceChecksums(f)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %d %s %s", f.fileId, f.size, checksumType, strings.Join(sums, ","))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (cc *contentCache) objectPath(key string) string {
+	return filepath.Join(cc.dir, cacheObjectsDir, key[:2], key)
+}
+
+// Whether the cache has an entry, marking it as used
+func (cc *contentCache) lookup(key string) (bool, error) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	res, err := cc.db.Exec("UPDATE cache_entries SET last_used = ? WHERE key = ?", time.Now().UnixNano(), key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (cc *contentCache) forget(key string) error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	os.Remove(cc.objectPath(key))
+	_, err := cc.db.Exec("DELETE FROM cache_entries WHERE key = ?", key)
+	return err
+}
+
+// Add a downloaded file to the cache, unless it is already there
+func (cc *contentCache) insert(f completedFile) {
+	if cc == nil {
+		return
+	}
+	key := cacheKey(f)
+	found, err := cc.lookup(key)
+	if err == nil && !found {
+		obj := cc.objectPath(key)
+		tmp := fmt.Sprintf("%s.%d-%d.tmp", obj, os.Getpid(), time.Now().UnixNano())
+		if err = os.MkdirAll(filepath.Dir(obj), 0777); err == nil {
+			err = linkOrCopy(cc.mode, f.path(), obj, tmp, &cc.fellBack)
+		}
+		if err == nil {
+			cc.mutex.Lock()
+			_, err = cc.db.Exec("INSERT OR REPLACE INTO cache_entries VALUES (?, ?, ?, ?)",
+				key, f.fileId, f.size, time.Now().UnixNano())
+			cc.mutex.Unlock()
+		}
+	}
+	if err != nil {
+		slog.Warn("could not add file to the cache", "file_id", f.fileId, "path", f.path(), "cache", cc.dir, "error", err)
+	}
+}
+
+// CacheGC is the outcome of a cache garbage collection
+type CacheGC struct {
+	NumEntries   int64 // left in the cache
+	NumBytes     int64
+	NumRemoved   int64
+	BytesRemoved int64
+}
+
+// Remove the entries whose file is missing, then the least recently used
+// entries, until the cache fits in maxSize bytes. Zero keeps all the
+// entries that have a file.
+func (cc *contentCache) gc(maxSize int64) (*CacheGC, error) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	type entry struct {
+		key  string
+		size int64
+	}
+	var entries []entry
+	rows, err := cc.db.Query("SELECT key, size FROM cache_entries ORDER BY last_used DESC")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.key, &e.size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the most recently used entries that fit
+	var result CacheGC
+	for _, e := range entries {
+		_, err := os.Stat(cc.objectPath(e.key))
+		keep := err == nil && (maxSize == 0 || result.NumBytes+e.size <= maxSize)
+		if keep {
+			result.NumEntries++
+			result.NumBytes += e.size
+			continue
+		}
+		if err := os.Remove(cc.objectPath(e.key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if _, err := cc.db.Exec("DELETE FROM cache_entries WHERE key = ?", e.key); err != nil {
+			return nil, err
+		}
+		result.NumRemoved++
+		result.BytesRemoved += e.size
+	}
+	return &result, nil
+}
+
+// GarbageCollectCache evicts the least recently used entries of a cache
+// directory, until it fits in maxSize bytes.
+func GarbageCollectCache(dir string, maxSize int64) (*CacheGC, error) {
+	if _, err := os.Stat(filepath.Join(dir, cacheDBName)); err != nil {
+		return nil, fmt.Errorf("%s is not a download cache: %w", dir, err)
+	}
+	cc, err := openContentCache(dir, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.close()
+	return cc.gc(maxSize)
+}
+
+// Restore the queued files found in the cache, before they are
+// downloaded. Each cached file is verified against the part checksums of
+// the manifest first; files that fail are removed from the cache.
+func (st *State) restoreFromCache() error {
+	cc := st.cache
+	if cc == nil {
+		return nil
+	}
+	numFiles, numBytes := 0, int64(0)
+	var afterSeq int64
+	for {
+		queued, err := st.nextQueuedFiles(afterSeq)
+		if err != nil {
+			return err
+		}
+		if len(queued) == 0 {
+			break
+		}
+		for _, q := range queued {
+			afterSeq = q.seq
+			key := inspectKey{q.kind, q.fileId, q.folder, q.name}
+			st.mutex.Lock()
+			f, err := st.manifestFileLocked(key)
+			st.mutex.Unlock()
+			if err != nil {
+				return err
+			}
+
+			ckey := cacheKey(f)
+			found, err := cc.lookup(ckey)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			obj := cc.objectPath(ckey)
+			if _, err := fileDigestsAt(obj, f, nil); err != nil {
+				slog.Warn("removing corrupted file from the cache", "file_id", f.fileId, "cache", cc.dir, "error", err)
+				if err := cc.forget(ckey); err != nil {
+					return err
+				}
+				continue
+			}
+			tmp := filepath.Join(filepath.Dir(f.path()), "."+f.name+".cache")
+			if err := linkOrCopy(cc.mode, obj, f.path(), tmp, &cc.fellBack); err != nil {
+				// downloaded instead
+				slog.Warn("could not restore file from the cache", "file_id", f.fileId, "path", f.path(), "error", err)
+				continue
+			}
+			done, err := st.markFileComplete(key)
+			if err != nil {
+				return err
+			}
+			slog.Debug("file restored from the cache", "file_id", f.fileId, "path", f.path(), "cache", cc.dir)
+			numFiles++
+			numBytes += f.size
+			if done != nil {
+				st.fileCompleted(*done)
+			}
+		}
+	}
+	if numFiles > 0 {
+		PrintLogAndOut("Restored %d files (%s) from the cache in %s\n", numFiles, diskSpaceString(numBytes), cc.dir)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package dxda
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentCache(t *testing.T) {
+	root := chdirTemp(t)
+	cacheDir := filepath.Join(root, "cache")
+	files := makeTestFiles(2, 300*KiB, 128*KiB)
+
+	// download into a new directory, from a server that may not know the files
+	download := func(dir string, ts *testServer, folder string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(root, dir), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chdir(filepath.Join(root, dir)); err != nil {
+			t.Fatal(err)
+		}
+		opts := Opts{NumThreads: 2, CacheDir: cacheDir, CacheMode: DedupeCopy}
+		if err := ts.download(t, opts, testManifest(files, folder)); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			data, err := os.ReadFile(filepath.Join("."+folder, f.name))
+			if err != nil || string(data) != string(f.data) {
+				t.Fatalf("Expected %s to be downloaded in %s", f.name, dir)
+			}
+		}
+	}
+
+	ts := newTestServer(files, 0, 0)
+	defer ts.Close()
+	download("first", ts, "/exome")
+	cached, err := filepath.Glob(filepath.Join(cacheDir, cacheObjectsDir, "*", "*"))
+	if err != nil || len(cached) != len(files) {
+		t.Fatalf("Expected %d files in the cache, got %v", len(files), cached)
+	}
+
+	// another team downloads the same files, without reaching the server
+	empty := newTestServer(nil, 0, 0)
+	defer empty.Close()
+	download("second", empty, "/shared")
+
+	// a corrupted file in the cache is removed, and downloaded again
+	f := completedFile{fileId: files[0].id, size: int64(len(files[0].data))}
+	for _, p := range files[0].manifestEntry("/").Parts {
+		f.parts = append(f.parts, DBPartRegular{MD5: p.MD5})
+	}
+	key := cacheKey(f)
+	obj := filepath.Join(cacheDir, cacheObjectsDir, key[:2], key)
+	if err := os.WriteFile(obj, make([]byte, len(files[0].data)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	download("third", ts, "/exome")
+	data, err := os.ReadFile(obj)
+	if err != nil || string(data) != string(files[0].data) {
+		t.Error("Expected the corrupted file to be replaced in the cache")
+	}
+
+	// the least recently used file is evicted first, the first file was
+	// downloaded last
+	gc, err := GarbageCollectCache(cacheDir, 300*KiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.NumRemoved != 1 || gc.NumEntries != 1 || gc.NumBytes != 300*KiB {
+		t.Fatalf("Expected one file to be evicted, got %+v", gc)
+	}
+	if _, err := os.Stat(obj); err != nil {
+		t.Errorf("Expected the most recently used file to stay in the cache: %v", err)
+	}
+
+	// a download with a size limit evicts files once it is done
+	cc, err := openContentCache(cacheDir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.close()
+	if _, err := os.Stat(obj); !os.IsNotExist(err) {
+		t.Errorf("Expected the files beyond the limit to be evicted when the cache is closed")
+	}
+
+	for s, expected := range map[string]int64{"500GB": 500 * GiB, "1.5T": 1536 * GiB, "unlimited": 0, "64k": 64 * KiB} {
+		if size, err := ParseSize(s); err != nil || size != expected {
+			t.Errorf("Expected %s to be %d bytes, got %d %v", s, expected, size, err)
+		}
+	}
+	if _, err := ParseSize("lots"); err == nil {
+		t.Error("Expected an invalid size to be rejected")
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"runtime"
+	"strings"
 
 	// The dxda package should contain all core functionality
 	"github.com/dnanexus/dxda"
@@ -14,9 +17,45 @@ import (
 
 // download subcommand
 type downloadCmd struct {
-	numThreads int
-	verbose    bool
-	gcInfo     bool
+	numThreads  int
+	verbose     bool
+	gcInfo      bool
+	preallocate bool
+
+	maxBandwidth      string
+	bandwidthSchedule string
+	adaptiveThreads   bool
+	order             string
+	progressFormat    string
+	metricsAddr       string
+	tui               bool
+	controlAddr       string
+	hookCommand       string
+	hookURL           string
+	hookEvents        string
+	checksums         string
+	checksumFormat    string
+	bagIt             bool
+	provenance        string
+	preserveTimes     bool
+	fileMode          string
+	dirMode           string
+	umask             string
+	dedupe            string
+	cacheDir          string
+	cacheMode         string
+	cacheMaxSize      string
+	seedDir           string
+	seedMode          string
+	output            string
+	outputCompression string
+	s3Endpoint        string
+	s3Region          string
+
+	logLevel      string
+	logFormat     string
+	logMaxSizeMB  int64
+	logMaxBackups int
 }
 
 var err error
@@ -33,6 +72,40 @@ func (p *downloadCmd) SetFlags(f *flag.FlagSet) {
 	f.IntVar(&p.numThreads, "max_threads", 0, "An alias for num_threads")
 	f.BoolVar(&p.verbose, "verbose", false, "verbose logging")
 	f.BoolVar(&p.gcInfo, "gc_info", false, "report statistics for golang garbage collection")
+	f.BoolVar(&p.preallocate, "preallocate", false, "Reserve the full size of each file on disk before downloading (fallocate on Linux)")
+	f.StringVar(&p.maxBandwidth, "max_bandwidth", "", "Limit on the total download bandwidth, for example 50MB (per second). By default there is no limit.")
+	f.BoolVar(&p.adaptiveThreads, "adaptive_threads", false, "Adjust the number of threads during the download based on throughput, errors and memory use")
+	f.StringVar(&p.order, "order", dxda.OrderManifest, "Order in which files are downloaded: manifest, file (finish partially downloaded files first), smallest, or priority")
+	f.StringVar(&p.bandwidthSchedule, "bandwidth_schedule", "", "File with time-of-day bandwidth limits, one 'HH:MM-HH:MM RATE' window per line. Re-read when modified.")
+	f.StringVar(&p.progressFormat, "progress_format", dxda.ProgressFormatText, "Format of the progress reports: text, or json for one JSON object per line")
+	f.BoolVar(&p.tui, "tui", false, "Show a full screen view of the download: progress, throughput, workers and recent errors. Falls back to line output when not on a terminal.")
+	f.StringVar(&p.controlAddr, "control_addr", "", "Serve a local API to control the download on this address, for example localhost:9101 or unix:/tmp/dxda.sock")
+	f.StringVar(&p.hookCommand, "hook_command", "", "Shell command to run for each event, receiving the event as JSON on its standard input")
+	f.StringVar(&p.hookURL, "hook_url", "", "URL to POST each event to, as JSON")
+	f.StringVar(&p.hookEvents, "hook_events", "", "Comma separated events for the hooks: file_complete, manifest_complete, file_failed. By default, all of them.")
+	f.StringVar(&p.checksums, "checksums", "", "Compute whole file checksums as files complete: md5, sha256, or md5,sha256. By default, none are computed.")
+	f.StringVar(&p.checksumFormat, "checksum_format", dxda.ChecksumFormatSidecar, "Where to write the checksums: sidecar for a .md5 or .sha256 file next to each file, or manifest for MD5SUMS or SHA256SUMS files")
+	f.BoolVar(&p.bagIt, "bagit", false, "Lay out the download as a BagIt bag: files in the data directory, with bag-info.txt and checksum manifests written when the download completes. Chosen when the download starts.")
+	f.StringVar(&p.provenance, "provenance", "", "Record where each file came from: xattr for extended attributes on the files (Linux only), jsonl for a provenance.jsonl file, or xattr,jsonl")
+	f.BoolVar(&p.preserveTimes, "preserve_times", false, "Set the modification time of each file to its modification time on the platform")
+	f.StringVar(&p.fileMode, "file_mode", "", "Permissions of the downloaded files in octal, for example 0644, regardless of the umask. By default, files are created with 0666 minus the umask.")
+	f.StringVar(&p.dirMode, "dir_mode", "", "Permissions of the download directories in octal, for example 0755, regardless of the umask. By default, directories are created with 0777 minus the umask.")
+	f.StringVar(&p.umask, "umask", "", "Umask in octal, for example 022, used when creating files and directories. By default, the umask of the shell is kept.")
+	f.StringVar(&p.dedupe, "dedupe", "", "Download files listed more than once (by file ID or part checksums) only once, and create the other copies as hardlink, reflink or copy. Duplicates are found when the download starts.")
+	f.StringVar(&p.cacheDir, "cache_dir", "", "Content cache directory shared by downloads on the same storage. Files found there are not downloaded, and downloaded files are added to it.")
+	f.StringVar(&p.cacheMode, "cache_mode", dxda.DedupeReflink, "How files are linked to and from the cache: hardlink, reflink or copy")
+	f.StringVar(&p.cacheMaxSize, "cache_max_size", "", "Evict the least recently used files from the cache beyond this size, for example 500GB. By default there is no limit.")
+	f.StringVar(&p.seedDir, "seed_dir", "", "Directory with an existing copy of some of the files, at the same paths. Parts that match the manifest are copied instead of downloaded.")
+	f.StringVar(&p.output, "output", "", "Write the files to a tar archive at this path, or to the standard output if -, or upload them to s3://bucket/prefix, instead of a directory tree")
+	f.StringVar(&p.outputCompression, "output_compression", "", "Compression of the -output archive: gzip or none. By default, gzip if the path ends in .gz or .tgz.")
+	f.StringVar(&p.s3Endpoint, "s3_endpoint", "", "URL of the S3 compatible store for an s3:// output, for example http://minio.example.com:9000. AWS S3 by default.")
+	f.StringVar(&p.s3Region, "s3_region", "", "Region of the S3 store, us-east-1 by default")
+	f.StringVar(&p.seedMode, "seed_mode", dxda.DedupeReflink, "How files that match as a whole are linked from the seed directory: hardlink, reflink or copy")
+	f.StringVar(&p.logLevel, "log_level", "", "Level of the download log: debug, info, warn or error. The default is info, or debug with -verbose.")
+	f.StringVar(&p.logFormat, "log_format", dxda.LogFormatText, "Format of the download log: text, or json for one JSON object per line")
+	f.Int64Var(&p.logMaxSizeMB, "log_max_size_mb", 0, "Rotate the download log when it grows beyond this size in MiB. By default (or if zero), the log is not rotated.")
+	f.IntVar(&p.logMaxBackups, "log_max_backups", 5, "Number of rotated download logs to keep")
+	f.StringVar(&p.metricsAddr, "metrics_addr", "", "Serve Prometheus metrics on this address while downloading, for example localhost:9100")
 }
 
 func check(e error) {
@@ -48,11 +121,50 @@ func (p *downloadCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface
 		os.Exit(1)
 	}
 	fname := f.Args()[0]
+	if err := dxda.ValidateOutput(p.output, p.outputCompression); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := dxda.ValidateProgressFormat(p.progressFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if p.tui && p.progressFormat == dxda.ProgressFormatJSON {
+		fmt.Println("-tui and -progress_format=json cannot be used together")
+		os.Exit(1)
+	}
+	if p.output == "-" && p.progressFormat == dxda.ProgressFormatJSON {
+		fmt.Println("-output=- and -progress_format=json both write to the standard output")
+		os.Exit(1)
+	}
+	var outputStream, progressStream io.Writer
+	if p.output == "-" {
+		// keep the messages out of the stream
+		outputStream = os.Stdout
+		os.Stdout = os.Stderr
+	}
+	if p.progressFormat == dxda.ProgressFormatJSON {
+		// the standard output has the reports only, the other messages
+		// go to the standard error
+		progressStream = os.Stdout
+		os.Stdout = os.Stderr
+	}
 	logfname := fname + ".download.log"
-	logfile, err := os.OpenFile(logfname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	check(err)
+	logOpts := dxda.LogOptions{
+		Level:      p.logLevel,
+		Format:     p.logFormat,
+		MaxSize:    p.logMaxSizeMB * dxda.MiB,
+		MaxBackups: p.logMaxBackups,
+	}
+	if logOpts.Level == "" && p.verbose {
+		logOpts.Level = "debug"
+	}
+	logfile, err := dxda.SetupLogging(logfname, logOpts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	defer logfile.Close()
-	log.SetOutput(logfile)
 
 	dxda.PrintLogAndOut("Logging detailed output to: " + logfname + "\n")
 
@@ -67,6 +179,116 @@ func (p *downloadCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface
 	opts.NumThreads = p.numThreads
 	opts.Verbose = p.verbose
 	opts.GcInfo = p.gcInfo
+	opts.Preallocate = p.preallocate
+	opts.AdaptiveThreads = p.adaptiveThreads
+	if err := dxda.ValidateOrder(p.order); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts.Order = p.order
+	opts.ProgressFormat = p.progressFormat
+	opts.ProgressStream = progressStream
+	opts.MetricsAddr = p.metricsAddr
+	opts.TUI = p.tui
+	opts.ControlAddr = p.controlAddr
+	if _, err := dxda.ParseHookEvents(p.hookEvents); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts.HookCommand = p.hookCommand
+	opts.HookURL = p.hookURL
+	opts.HookEvents = p.hookEvents
+	if p.checksums != "" {
+		if _, err := dxda.ParseFileChecksums(p.checksums); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if err := dxda.ValidateChecksumFormat(p.checksumFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts.FileChecksums = p.checksums
+	opts.ChecksumFormat = p.checksumFormat
+	opts.BagIt = p.bagIt
+	if p.provenance != "" {
+		if _, err := dxda.ParseProvenance(p.provenance); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	opts.Provenance = p.provenance
+	opts.PreserveTimes = p.preserveTimes
+	if p.fileMode != "" {
+		if opts.FileMode, err = dxda.ParseFileMode(p.fileMode); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if p.dirMode != "" {
+		if opts.DirMode, err = dxda.ParseFileMode(p.dirMode); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if p.umask != "" {
+		mask, err := dxda.ParseFileMode(p.umask)
+		if err == nil {
+			err = dxda.SetUmask(mask)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if err := dxda.ValidateDedupe(p.dedupe); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts.Dedupe = p.dedupe
+	if err := dxda.ValidateDedupeMetadata(opts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := dxda.ValidateCacheMode(p.cacheMode); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts.CacheDir = p.cacheDir
+	opts.CacheMode = p.cacheMode
+	if err := dxda.ValidateCacheMetadata(opts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts.CacheMaxSize, err = dxda.ParseSize(p.cacheMaxSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := dxda.ValidateSeedMode(p.seedMode); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts.SeedDir = p.seedDir
+	opts.SeedMode = p.seedMode
+	opts.Output = p.output
+	opts.OutputCompression = p.outputCompression
+	opts.OutputStream = outputStream
+	opts.S3Endpoint = p.s3Endpoint
+	opts.S3Region = p.s3Region
+	opts.MaxBandwidth, err = dxda.ParseBandwidth(p.maxBandwidth)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if p.bandwidthSchedule != "" {
+		// validate the schedule before starting
+		if _, err := dxda.ReadBandwidthSchedule(p.bandwidthSchedule); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.BandwidthSchedule = p.bandwidthSchedule
+	}
 
 	st := dxda.NewDxDa(dxEnv, fname, opts)
 	defer st.Close()
@@ -89,6 +311,10 @@ func (p *downloadCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
+		if p.bagIt && !st.IsBag() {
+			fmt.Println("Error: this download was started without -bagit. Please delete the .stats.db file and the downloaded files to start over as a bag.")
+			os.Exit(1)
+		}
 		fmt.Printf("Ensuring files are created for existing manifest \n")
 		st.PrepareFilesForDownload(*manifest)
 	}
@@ -99,23 +325,30 @@ func (p *downloadCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface
 	}
 
 	// start a parallel download
-	st.DownloadManifestDB(fname)
+	if err := st.DownloadManifestDB(fname); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
 
 	return subcommands.ExitSuccess
 }
 
 type progressCmd struct {
+	progressFormat string
+	files          bool
 }
 
 func (*progressCmd) Name() string     { return "progress" }
 func (*progressCmd) Synopsis() string { return "show current download progress" }
 
-const progressUsage = "dx-download-agent progress <manifest.json.bz2>"
+const progressUsage = "dx-download-agent progress [-files] [-progress_format=json] <manifest.json.bz2>"
 
 func (*progressCmd) Usage() string {
 	return progressUsage
 }
 func (p *progressCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.progressFormat, "progress_format", dxda.ProgressFormatText, "Format of the progress report: text, or json for a single JSON object")
+	f.BoolVar(&p.files, "files", false, "Also report the progress of each file being downloaded, and the number of completed and remaining files")
 }
 func (p *progressCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	// TODO: Is there a generic way to do this using subcommands?
@@ -131,22 +364,55 @@ func (p *progressCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface
 		os.Exit(1)
 	}
 
+	if err := dxda.ValidateProgressFormat(p.progressFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// the standard output has the reports only, the other messages go
+	// to the standard error
+	reports := os.Stdout
+	if p.progressFormat == dxda.ProgressFormatJSON {
+		os.Stdout = os.Stderr
+	}
+
 	var opts dxda.Opts
+	opts.ProgressFormat = p.progressFormat
+	opts.ProgressStream = reports
 	st := dxda.NewDxDa(dxEnv, fname, opts)
 	defer st.Close()
 
 	st.InitDownloadStatus()
-	fmt.Println(st.DownloadProgressOneTime(60 * 1000 * 1000 * 1000))
+	fmt.Fprintln(reports, st.DownloadProgressOneTime(60*1000*1000*1000))
+
+	if p.files {
+		report, err := st.FilesProgressReport()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if p.progressFormat == dxda.ProgressFormatJSON {
+			fmt.Fprintln(reports, report.JSON())
+		} else {
+			fmt.Fprint(reports, report.String())
+		}
+	}
 	return subcommands.ExitSuccess
 }
 
 // inspect the files, and see that there are no checksum errors
 type inspectCmd struct {
-	numThreads int
-	verbose    bool
+	numThreads    int
+	verbose       bool
+	report        string
+	dryRun        bool
+	incremental   bool
+	full          bool
+	orphans       bool
+	removeOrphans bool
 }
 
-const inspectUsage = "dx-download-agent inspect [-num_threads=N] <manifest.json.bz2>"
+const inspectUsage = "dx-download-agent inspect [-num_threads=N] [-report=report.json] [-dry_run] [-incremental|-full] [-orphans [-remove_orphans]] <manifest.json.bz2>"
 
 func (*inspectCmd) Name() string { return "inspect" }
 func (*inspectCmd) Synopsis() string {
@@ -158,6 +424,12 @@ func (*inspectCmd) Usage() string {
 func (p *inspectCmd) SetFlags(f *flag.FlagSet) {
 	f.IntVar(&p.numThreads, "num_threads", 0, "Number of threads to use when downloading files. By default (or if zero), this number is chosen according to machine memory and CPU constraints.")
 	f.BoolVar(&p.verbose, "verbose", false, "verbose logging")
+	f.StringVar(&p.report, "report", "", "Write a report on every file to this path, in CSV format if it ends with .csv, JSON otherwise")
+	f.BoolVar(&p.dryRun, "dry_run", false, "Only report problems, without resetting files for download. The database is opened read-only.")
+	f.BoolVar(&p.incremental, "incremental", false, "Skip files whose size, modification time and inode have not changed since they last passed inspection")
+	f.BoolVar(&p.full, "full", false, "Compute the checksums of all files, even if they have not changed since they last passed inspection. This is the default.")
+	f.BoolVar(&p.orphans, "orphans", false, "Report files under the download directory that are not in the manifest")
+	f.BoolVar(&p.removeOrphans, "remove_orphans", false, "Remove the files reported by -orphans, after asking for confirmation. Ignored on a dry run.")
 }
 
 func (p *inspectCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -167,6 +439,14 @@ func (p *inspectCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 		os.Exit(1)
 	}
 	fname := f.Args()[0]
+	if p.incremental && p.full {
+		fmt.Println("Error: -incremental and -full cannot be used together")
+		os.Exit(1)
+	}
+	if p.removeOrphans && !p.orphans {
+		fmt.Println("Error: -remove_orphans requires -orphans")
+		os.Exit(1)
+	}
 
 	dxEnv, _, err := dxda.GetDxEnvironment()
 	if err != nil {
@@ -177,6 +457,8 @@ func (p *inspectCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 	var opts dxda.Opts
 	opts.Verbose = p.verbose
 	opts.NumThreads = p.numThreads
+	opts.DryRun = p.dryRun
+	opts.Incremental = p.incremental
 
 	st := dxda.NewDxDa(dxEnv, fname, opts)
 	defer st.Close()
@@ -187,10 +469,322 @@ func (p *inspectCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 		os.Exit(1)
 	}
 
-	integrityFlag := st.CheckFileIntegrity()
-	if !integrityFlag {
+	report := st.Inspect()
+	if p.orphans {
+		if err := st.InspectOrphans(report, p.report); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, o := range report.Orphans {
+			fmt.Printf("%s is not in the manifest\n", o.Path)
+		}
+		if p.removeOrphans && !p.dryRun && len(report.Orphans) > 0 {
+			if confirm(fmt.Sprintf("Remove these %d files? [y/N] ", len(report.Orphans))) {
+				if err := st.RemoveOrphans(report); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				fmt.Printf("Removed %d files\n", len(report.Orphans))
+			} else {
+				fmt.Println("No files were removed")
+			}
+		}
+	}
+	fmt.Print(report.Summary())
+	if p.report != "" {
+		if err := report.Write(p.report); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Report written to %s\n", p.report)
+	}
+	if !report.OK() {
+		if p.dryRun {
+			fmt.Println("This was a dry run, no files were reset. To download the files that failed again, run the repair command with this report.")
+		}
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Ask a yes or no question on the terminal, anything but yes is a no
+func confirm(question string) bool {
+	fmt.Print(question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// write whole file checksums of the downloaded files
+type exportChecksumsCmd struct {
+	numThreads int
+	verbose    bool
+	algorithms string
+	format     string
+}
+
+const exportChecksumsUsage = "dx-download-agent export-checksums [-algorithms=md5,sha256] [-format=sidecar|manifest] <manifest.json.bz2>"
+
+func (*exportChecksumsCmd) Name() string { return "export-checksums" }
+func (*exportChecksumsCmd) Synopsis() string {
+	return "Write whole file checksums of the downloaded files, for md5sum -c or sha256sum -c"
+}
+func (*exportChecksumsCmd) Usage() string {
+	return exportChecksumsUsage
+}
+func (p *exportChecksumsCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.numThreads, "num_threads", 0, "Number of threads to use when reading files. By default (or if zero), this number is chosen according to machine memory and CPU constraints.")
+	f.BoolVar(&p.verbose, "verbose", false, "verbose logging")
+	f.StringVar(&p.algorithms, "algorithms", dxda.FileChecksumMD5, "Checksum algorithms: md5, sha256, or md5,sha256")
+	f.StringVar(&p.format, "format", dxda.ChecksumFormatSidecar, "sidecar for a .md5 or .sha256 file next to each file, or manifest for MD5SUMS or SHA256SUMS files in the download directory")
+}
+
+func (p *exportChecksumsCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if len(f.Args()) == 0 {
+		fmt.Println(exportChecksumsUsage)
+		os.Exit(1)
+	}
+	fname := f.Args()[0]
+	algs, err := dxda.ParseFileChecksums(p.algorithms)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := dxda.ValidateChecksumFormat(p.format); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dxEnv, _, err := dxda.GetDxEnvironment()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var opts dxda.Opts
+	opts.Verbose = p.verbose
+	opts.NumThreads = p.numThreads
+	st := dxda.NewDxDa(dxEnv, fname, opts)
+	defer st.Close()
+
+	if err := st.CheckSchemaVersion(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	export, err := st.ExportChecksums(algs, p.format)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	fmt.Printf("Wrote checksums of %d files\n", export.NumFiles)
+	for _, fname := range export.Written {
+		fmt.Printf("Checksums written to %s\n", fname)
+	}
+	if export.NumIncomplete > 0 {
+		fmt.Printf("%d files are not completely downloaded, and were left out\n", export.NumIncomplete)
+	}
+	if len(export.Failed) > 0 {
+		for _, path := range export.Failed {
+			fmt.Printf("%s failed verification, and was left out\n", path)
+		}
+		fmt.Println("Please run the inspect command to reset these files, and re-issue the download command.")
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// record where the downloaded files came from
+type provenanceCmd struct {
+	outputs string
+}
+
+const provenanceUsage = "dx-download-agent provenance [-outputs=xattr,jsonl] <manifest.json.bz2>"
+
+func (*provenanceCmd) Name() string { return "provenance" }
+func (*provenanceCmd) Synopsis() string {
+	return "Record the DNAnexus file IDs, projects and checksums of the downloaded files"
+}
+func (*provenanceCmd) Usage() string {
+	return provenanceUsage
+}
+func (p *provenanceCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.outputs, "outputs", dxda.ProvenanceJSONL, "xattr for extended attributes on the files (Linux only), jsonl for a provenance.jsonl file, or xattr,jsonl")
+}
+
+func (p *provenanceCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if len(f.Args()) == 0 {
+		fmt.Println(provenanceUsage)
+		os.Exit(1)
+	}
+	fname := f.Args()[0]
+	outputs, err := dxda.ParseProvenance(p.outputs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dxEnv, _, err := dxda.GetDxEnvironment()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	st := dxda.NewDxDa(dxEnv, fname, dxda.Opts{})
+	defer st.Close()
+
+	if err := st.CheckSchemaVersion(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := st.WriteProvenance(outputs[dxda.ProvenanceXattr], outputs[dxda.ProvenanceJSONL]); err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// check a BagIt bag
+type validateBagCmd struct {
+	numThreads int
+}
+
+const validateBagUsage = "dx-download-agent validate-bag [-num_threads=N] <bag directory>"
+
+func (*validateBagCmd) Name() string { return "validate-bag" }
+func (*validateBagCmd) Synopsis() string {
+	return "Check that a BagIt bag is complete, and its files match their checksums"
+}
+func (*validateBagCmd) Usage() string {
+	return validateBagUsage
+}
+func (p *validateBagCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.numThreads, "num_threads", runtime.NumCPU(), "Number of files to read in parallel")
+}
+
+func (p *validateBagCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if len(f.Args()) == 0 {
+		fmt.Println(validateBagUsage)
+		os.Exit(1)
+	}
+	dir := f.Args()[0]
+
+	v, err := dxda.ValidateBag(dir, p.numThreads)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, problem := range v.Problems {
+		fmt.Println(problem)
+	}
+	if !v.OK() {
+		fmt.Printf("%s is not a valid bag, %d problems found\n", dir, len(v.Problems))
+		return subcommands.ExitFailure
+	}
+	fmt.Printf("%s is a valid bag, with %d files (%d bytes)\n", dir, v.NumFiles, v.NumBytes)
+	return subcommands.ExitSuccess
+}
+
+// maintenance of a content cache shared by downloads
+type cacheCmd struct {
+	cacheDir string
+	maxSize  string
+}
+
+const cacheUsage = "dx-download-agent cache gc -cache_dir=DIR [-max_size=SIZE]"
+
+func (*cacheCmd) Name() string { return "cache" }
+func (*cacheCmd) Synopsis() string {
+	return "Evict the least recently used files from a download cache"
+}
+func (*cacheCmd) Usage() string {
+	return cacheUsage
+}
+func (p *cacheCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.cacheDir, "cache_dir", "", "Cache directory, as given to download")
+	f.StringVar(&p.maxSize, "max_size", "", "Size to shrink the cache to, for example 500GB. By default, only entries whose file is missing are removed.")
+}
+
+func (p *cacheCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if len(f.Args()) == 0 || f.Args()[0] != "gc" {
+		fmt.Println(cacheUsage)
+		os.Exit(1)
+	}
+	// flags may also follow the action
+	if err := f.Parse(f.Args()[1:]); err != nil || len(f.Args()) > 0 || p.cacheDir == "" {
+		fmt.Println(cacheUsage)
+		os.Exit(1)
+	}
+	maxSize, err := dxda.ParseSize(p.maxSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	gc, err := dxda.GarbageCollectCache(p.cacheDir, maxSize)
+	if err != nil {
+		fmt.Println(err)
+		return subcommands.ExitFailure
+	}
+	fmt.Printf("Removed %d files (%d bytes), %d files (%d bytes) left in %s\n",
+		gc.NumRemoved, gc.BytesRemoved, gc.NumEntries, gc.NumBytes, p.cacheDir)
+	return subcommands.ExitSuccess
+}
+
+// reset the files that failed a previous inspection
+type repairCmd struct {
+	report  string
+	verbose bool
+}
+
+const repairUsage = "dx-download-agent repair -report=report.json <manifest.json.bz2>"
+
+func (*repairCmd) Name() string { return "repair" }
+func (*repairCmd) Synopsis() string {
+	return "Reset the files that failed inspection in a report, so they are downloaded again"
+}
+func (*repairCmd) Usage() string {
+	return repairUsage
+}
+func (p *repairCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.report, "report", "", "Report written by 'inspect -report', in JSON or CSV format")
+	f.BoolVar(&p.verbose, "verbose", false, "verbose logging")
+}
+
+func (p *repairCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if len(f.Args()) == 0 || p.report == "" {
+		fmt.Println(repairUsage)
+		os.Exit(1)
+	}
+	fname := f.Args()[0]
+
+	report, err := dxda.ReadInspectReport(p.report)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dxEnv, _, err := dxda.GetDxEnvironment()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var opts dxda.Opts
+	opts.Verbose = p.verbose
+	st := dxda.NewDxDa(dxEnv, fname, opts)
+	defer st.Close()
+
+	if err := st.CheckSchemaVersion(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	numReset, err := st.Repair(report)
+	if err != nil {
+		fmt.Println(err)
 		return subcommands.ExitFailure
 	}
+	fmt.Printf("Reset %d files. Please re-issue the download command to download them again.\n", numReset)
 	return subcommands.ExitSuccess
 }
 
@@ -215,6 +809,11 @@ func main() {
 	subcommands.Register(&downloadCmd{}, "")
 	subcommands.Register(&progressCmd{}, "")
 	subcommands.Register(&inspectCmd{}, "")
+	subcommands.Register(&repairCmd{}, "")
+	subcommands.Register(&exportChecksumsCmd{}, "")
+	subcommands.Register(&validateBagCmd{}, "")
+	subcommands.Register(&provenanceCmd{}, "")
+	subcommands.Register(&cacheCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
 
 	// TODO: modify this to use individual subcommand help
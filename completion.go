@@ -0,0 +1,165 @@
+package dxda
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// A file whose parts have all been downloaded and recorded in the database
+type completedFile struct {
+	kind    int // 0 for regular files, 1 for symlinks, as in queuedFile
+	fileId  string
+	project string
+	folder  string
+	name    string
+	size    int64
+	parts   []DBPartRegular // regular files only
+	md5     string          // symlinks only, the checksum of the whole file
+	mtime   time.Time       // modification time on the platform, if preserved
+}
+
+// Local path of the file, relative to the download directory
+func (f completedFile) path() string {
+	return fmt.Sprintf(".%s/%s", f.folder, f.name)
+}
+
+// Whether anything needs to happen when a file completes. Checking for
+// completed files costs a query per file, so it is skipped otherwise.
+func (st *State) trackFileCompletion() bool {
+	return st.hooks != nil || st.checksums != nil || st.provenance != nil || st.metadata != nil ||
+		st.duplicates != nil || st.cache != nil || !st.sink.keepsFiles()
+}
+
+// Find the files that were completed by a batch of jobs. Must be called
+// with the database mutex held, after the jobs are committed.
+func (st *State) completedFilesLocked(jobs []JobInfo) ([]completedFile, error) {
+	seen := make(map[inspectKey]bool)
+
+	var files []completedFile
+	for _, j := range jobs {
+		key := inspectKey{0, j.part.fileId(), j.part.folder(), j.part.fileName()}
+		if _, ok := j.part.(DBPartSymlink); ok {
+			key.kind = 1
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		f, err := st.completedFileLocked(key)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			files = append(files, *f)
+		}
+	}
+	return files, nil
+}
+
+// A file with all its parts downloaded, nil if some are missing. Must be
+// called with the database mutex held.
+func (st *State) completedFileLocked(key inspectKey) (*completedFile, error) {
+	table := "manifest_regular_stats"
+	if key.kind == 1 {
+		table = "manifest_symlink_stats"
+	}
+	var numIncomplete int64
+	err := st.db.QueryRow(fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE file_id = ? AND folder = ? AND name = ? AND bytes_fetched != size", table),
+		key.fileId, key.folder, key.name).Scan(&numIncomplete)
+	if err != nil {
+		return nil, err
+	}
+	if numIncomplete > 0 {
+		return nil, nil
+	}
+	f, err := st.manifestFileLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// A file of the manifest with all its parts, whether they are downloaded
+// or not. Must be called with the database mutex held.
+func (st *State) manifestFileLocked(key inspectKey) (completedFile, error) {
+	f := completedFile{
+		kind:   key.kind,
+		fileId: key.fileId,
+		folder: key.folder,
+		name:   key.name,
+	}
+	if key.kind == 0 {
+		rows, err := st.db.Query(`
+			SELECT * FROM manifest_regular_stats
+			WHERE file_id = ? AND folder = ? AND name = ?
+			ORDER BY part_id`,
+			key.fileId, key.folder, key.name)
+		if err != nil {
+			return f, err
+		}
+		for rows.Next() {
+			var p DBPartRegular
+			err := rows.Scan(&p.FileId, &p.Project, &p.FileName, &p.Folder, &p.PartId, &p.Offset,
+				&p.Size, &p.MD5, &p.BytesFetched, &p.DownloadDoneTime, &p.ChecksumType, &p.Checksum)
+			if err != nil {
+				rows.Close()
+				return f, err
+			}
+			f.project = p.Project
+			f.parts = append(f.parts, p)
+			f.size += int64(p.Size)
+		}
+		rows.Close()
+	} else {
+		err := st.db.QueryRow(
+			"SELECT proj_id, size, md5 FROM symlinks WHERE id = ? AND folder = ? AND name = ?",
+			key.fileId, key.folder, key.name).Scan(&f.project, &f.size, &f.md5)
+		if err != nil {
+			return f, err
+		}
+	}
+	var err error
+	f.mtime, err = st.metadata.mtimeLocked(f.fileId)
+	return f, err
+}
+
+// Mark all the parts of a file as downloaded, for files that are created
+// locally instead of being downloaded.
+func (st *State) markFileComplete(key inspectKey) (*completedFile, error) {
+	table := "manifest_regular_stats"
+	if key.kind == 1 {
+		table = "manifest_symlink_stats"
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	_, err := st.db.Exec(fmt.Sprintf(
+		"UPDATE %s SET bytes_fetched = size, download_done_time = ? WHERE file_id = ? AND folder = ? AND name = ?", table),
+		time.Now().UnixNano(), key.fileId, key.folder, key.name)
+	if err != nil {
+		return nil, err
+	}
+	return st.completedFileLocked(key)
+}
+
+// Called by the database update thread, once for each completed file
+func (st *State) fileCompleted(f completedFile) {
+	slog.Debug("file complete", "file_id", f.fileId, "path", f.path(), "size", f.size)
+	// first, so that checksums are cached with the final modification time
+	st.metadata.apply(f)
+	st.hooks.fileComplete(f)
+	st.checksums.add(f)
+	st.provenance.setXattrs(f)
+	st.cache.insert(f)
+	st.duplicates.sourceCompleted(f)
+	// last, the file may be moved out of the download directory
+	st.sink.fileCompleted(f)
+}
+
+// Number of files in the manifest
+func (st *State) numManifestFiles() int64 {
+	return st.queryDBIntegerResult("SELECT COUNT(*) FROM (SELECT DISTINCT file_id, folder, name FROM manifest_regular_stats)") +
+		st.queryDBIntegerResult("SELECT COUNT(*) FROM symlinks")
+}
@@ -0,0 +1,105 @@
+package dxda
+
+import (
+	"sync"
+)
+
+// Limits the number of workers that download at the same time, and hands
+// out their memory buffers. The limit can be changed while a download is
+// running; buffers beyond the limit are dropped as workers return them, so
+// shrinking the limit also releases memory. While the gate is paused, no
+// worker may start a new part.
+type workerGate struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	active   int
+	paused   bool
+	bufSize  int64
+	freeBufs [][]byte
+	numBufs  int
+}
+
+func newWorkerGate(limit int, bufSize int64) *workerGate {
+	g := &workerGate{
+		limit:   limit,
+		bufSize: bufSize,
+	}
+	g.cond = sync.NewCond(&g.mutex)
+	return g
+}
+
+// Wait for a free slot, and return a memory buffer to download into.
+func (g *workerGate) acquire() []byte {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for g.paused || g.active >= g.limit {
+		g.cond.Wait()
+	}
+	g.active++
+
+	if n := len(g.freeBufs); n > 0 {
+		buf := g.freeBufs[n-1]
+		g.freeBufs = g.freeBufs[:n-1]
+		return buf
+	}
+	g.numBufs++
+	return make([]byte, g.bufSize)
+}
+
+// Return the slot, and the buffer handed out by acquire.
+func (g *workerGate) release(buf []byte) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.active--
+	if g.numBufs > g.limit {
+		// the limit was lowered, let the garbage collector have it
+		g.numBufs--
+	} else {
+		g.freeBufs = append(g.freeBufs, buf)
+	}
+	g.cond.Signal()
+}
+
+func (g *workerGate) setLimit(limit int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.limit = limit
+	for g.numBufs > limit && len(g.freeBufs) > 0 {
+		g.freeBufs = g.freeBufs[:len(g.freeBufs)-1]
+		g.numBufs--
+	}
+	g.cond.Broadcast()
+}
+
+func (g *workerGate) getLimit() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.limit
+}
+
+func (g *workerGate) numActive() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.active
+}
+
+// Stop handing out slots. Workers finish the parts they are downloading.
+func (g *workerGate) pause() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.paused = true
+}
+
+func (g *workerGate) resume() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.paused = false
+	g.cond.Broadcast()
+}
+
+func (g *workerGate) isPaused() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.paused
+}
@@ -0,0 +1,212 @@
+package dxda
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The state of a running download, as reported by the control API
+type ControlStatus struct {
+	ProgressReport
+
+	Paused   bool `json:"paused"`
+	Stopping bool `json:"stopping"`
+
+	// Current and largest number of threads allowed to download
+	Threads    int `json:"threads"`
+	MaxThreads int `json:"max_threads"`
+
+	// Bandwidth limit in bytes per second, zero if unlimited
+	BandwidthLimit int64 `json:"bandwidth_limit"`
+}
+
+// Ask a running download to stop. Parts that are being downloaded are
+// completed and recorded; the remaining parts are left for the next run.
+func (st *State) requestStop() {
+	st.stopOnce.Do(func() {
+		PrintLogAndOut("Stopping the download, waiting for the parts in flight to complete\n")
+		close(st.stopCh)
+	})
+	// paused workers need to wake up to notice
+	st.gate.resume()
+}
+
+func (st *State) stopRequested() bool {
+	select {
+	case <-st.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (st *State) controlStatus() ControlStatus {
+	status := ControlStatus{
+		ProgressReport: st.currentProgress(60 * 1000 * 1000 * 1000),
+		Paused:         st.gate.isPaused(),
+		Stopping:       st.stopRequested(),
+		Threads:        st.gate.getLimit(),
+		MaxThreads:     st.numWorkers,
+		BandwidthLimit: st.limiter.getRate(),
+	}
+	failedParts := st.stats.failedParts.Load()
+	activeWorkers := st.gate.numActive()
+	status.FailedParts = &failedParts
+	status.ActiveWorkers = &activeWorkers
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Routes of the control API. All of them respond with the status of the
+// download, after applying the change.
+func (st *State) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// wrap a handler that changes the download, which requires a POST
+	action := func(apply func(r *http.Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+				return
+			}
+			// a web page cannot send JSON to another origin without asking
+			// first, which keeps browsers from changing the download
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeJSONError(w, http.StatusUnsupportedMediaType, fmt.Errorf("use Content-Type: application/json"))
+				return
+			}
+			if err := apply(r); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, st.controlStatus())
+		}
+	}
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, st.controlStatus())
+	})
+	mux.HandleFunc("/pause", action(func(r *http.Request) error {
+		if st.stopRequested() {
+			return fmt.Errorf("the download is stopping")
+		}
+		st.gate.pause()
+		slog.Info("control: download paused")
+		return nil
+	}))
+	mux.HandleFunc("/resume", action(func(r *http.Request) error {
+		st.gate.resume()
+		slog.Info("control: download resumed")
+		return nil
+	}))
+	mux.HandleFunc("/threads", action(func(r *http.Request) error {
+		var req struct {
+			Threads int `json:"threads"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return fmt.Errorf("expected a body like {\"threads\": 8}: %w", err)
+		}
+		if req.Threads < minNumThreads || req.Threads > st.numWorkers {
+			return fmt.Errorf("the number of threads must be between %d and %d", minNumThreads, st.numWorkers)
+		}
+		st.gate.setLimit(req.Threads)
+		slog.Info("control: threads changed", "threads", req.Threads)
+		return nil
+	}))
+	mux.HandleFunc("/bandwidth", action(func(r *http.Request) error {
+		var req struct {
+			Bandwidth string `json:"bandwidth"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return fmt.Errorf("expected a body like {\"bandwidth\": \"50MB\"}: %w", err)
+		}
+		if req.Bandwidth == "schedule" {
+			// back to the command line limit and schedule
+			st.bandwidthOverride.Store(-1)
+			rate := st.opts.MaxBandwidth
+			if st.opts.BandwidthSchedule != "" {
+				if schedule, err := ReadBandwidthSchedule(st.opts.BandwidthSchedule); err == nil {
+					rate = schedule.rateAt(time.Now(), rate)
+				}
+			}
+			st.limiter.setRate(rate)
+			slog.Info("control: bandwidth limit follows the schedule", "bandwidth", bandwidthString(rate))
+			return nil
+		}
+		rate, err := ParseBandwidth(req.Bandwidth)
+		if err != nil {
+			return err
+		}
+		st.bandwidthOverride.Store(rate)
+		st.limiter.setRate(rate)
+		slog.Info("control: bandwidth limit changed", "bandwidth", bandwidthString(rate))
+		return nil
+	}))
+	mux.HandleFunc("/stop", action(func(r *http.Request) error {
+		st.requestStop()
+		return nil
+	}))
+	return mux
+}
+
+// Open the listener of the control API on [addr]. Addresses of the form
+// unix:/path/to/socket listen on a Unix domain socket, others are TCP
+// addresses, which must be on the loopback interface since the API has
+// no authentication. A socket left behind by a download that did not
+// shut down cleanly is replaced, one still in use is not.
+func listenControl(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("the control API is only served on the loopback interface, "+
+				"for example localhost:9101, or on a Unix socket, not on %q", addr)
+		}
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		slog.Info("removing stale control socket", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve the control API on [listener] until the server is shut down
+func (st *State) serveControl(listener net.Listener) *http.Server {
+	srv := &http.Server{
+		Handler:           st.controlHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("control server stopped", "error", err)
+		}
+	}()
+	PrintLogAndOut("Serving the control API on %s\n", st.opts.ControlAddr)
+	return srv
+}
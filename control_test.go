@@ -0,0 +1,173 @@
+package dxda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Call the control API over a Unix socket, and decode the status
+func controlRequest(t *testing.T, client *http.Client, method, route, body string) (int, ControlStatus) {
+	req, err := http.NewRequest(method, "http://dxda"+route, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status ControlStatus
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, status
+}
+
+func TestControlAPI(t *testing.T) {
+	dir := chdirTemp(t)
+	files := makeTestFiles(8, MiB, 128*KiB)
+	ts := newTestServer(files, 2*MiB, 0)
+	defer ts.Close()
+
+	socket := filepath.Join(dir, "control.sock")
+	st := NewDxDa(ts.dxEnv(t), "test.manifest.json.bz2", Opts{NumThreads: 2, ControlAddr: "unix:" + socket})
+	defer st.Close()
+	st.maxChunkSize = 128 * KiB
+
+	manifest := testManifest(files, "/data")
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+
+	downloadErr := make(chan error)
+	go func() { downloadErr <- st.DownloadManifestDB("test.manifest.json.bz2") }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("The control socket was not created")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	code, status := controlRequest(t, client, "GET", "/status", "")
+	if code != http.StatusOK || status.PartsTotal != 64 || status.Threads != 2 || status.MaxThreads < 2 {
+		t.Fatalf("Unexpected status %d %+v", code, status)
+	}
+
+	// a paused download makes no progress, once the parts in flight complete
+	if code, status = controlRequest(t, client, "POST", "/pause", ""); !status.Paused {
+		t.Fatalf("Expected the download to be paused, got %d %+v", code, status)
+	}
+	time.Sleep(time.Second)
+	_, before := controlRequest(t, client, "GET", "/status", "")
+	time.Sleep(500 * time.Millisecond)
+	_, after := controlRequest(t, client, "GET", "/status", "")
+	if before.PartsComplete != after.PartsComplete || *after.ActiveWorkers != 0 {
+		t.Errorf("Expected no progress while paused, got %d then %d parts", before.PartsComplete, after.PartsComplete)
+	}
+
+	threads := fmt.Sprintf(`{"threads": %d}`, status.MaxThreads)
+	if _, status = controlRequest(t, client, "POST", "/threads", threads); status.Threads != status.MaxThreads {
+		t.Errorf("Expected %d threads, got %d", status.MaxThreads, status.Threads)
+	}
+	if code, _ = controlRequest(t, client, "POST", "/threads", `{"threads": 1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a thread count below the minimum to be rejected, got %d", code)
+	}
+	if _, status = controlRequest(t, client, "POST", "/bandwidth", `{"bandwidth": "1MB"}`); status.BandwidthLimit != MiB {
+		t.Errorf("Expected a 1MB bandwidth limit, got %d", status.BandwidthLimit)
+	}
+	if code, _ = controlRequest(t, client, "GET", "/stop", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected for actions, got %d", code)
+	}
+	// as a form posted by a web page
+	resp, err := client.Post("http://dxda/stop", "application/x-www-form-urlencoded", strings.NewReader("x=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected a POST without JSON to be rejected, got %d", resp.StatusCode)
+	}
+
+	controlRequest(t, client, "POST", "/resume", "")
+	time.Sleep(300 * time.Millisecond)
+	if _, status = controlRequest(t, client, "POST", "/stop", ""); !status.Stopping {
+		t.Errorf("Expected the download to be stopping")
+	}
+
+	select {
+	case err := <-downloadErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("The download did not stop")
+	}
+	partsComplete := st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_regular_stats WHERE bytes_fetched = size")
+	if partsComplete == 0 || partsComplete == 64 {
+		t.Errorf("Expected a partial download after stopping, got %d parts", partsComplete)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the control socket to be removed")
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	dir := chdirTemp(t)
+	socket := filepath.Join(dir, "control.sock")
+
+	// left behind by a download that did not shut down cleanly
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenControl("unix:" + socket)
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced, got %v", err)
+	}
+	defer listener.Close()
+	if _, err := listenControl("unix:" + socket); err == nil {
+		t.Errorf("Expected a socket in use to be rejected")
+	}
+
+	// the API has no authentication, it is not served on other interfaces
+	for _, addr := range []string{":9101", "0.0.0.0:9101", "example.com:9101", "localhost"} {
+		if _, err := listenControl(addr); err == nil {
+			t.Errorf("Expected %q to be rejected", addr)
+		}
+	}
+	local, err := listenControl("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Close()
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2, ControlAddr: "localhost:-1"})
+	defer st.Close()
+	st.CreateManifestDB(Manifest{}, "test.manifest.json.bz2")
+	if err := st.DownloadManifestDB("test.manifest.json.bz2"); err == nil {
+		t.Errorf("Expected the download to fail on a bad control address")
+	}
+}
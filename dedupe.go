@@ -0,0 +1,430 @@
+package dxda
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// How duplicate files in a manifest are created. Duplicates are copies of
+// the same file ID, or regular files with the same list of part
+// checksums. The first of them in the manifest is downloaded, and the
+// others are created from it once it is complete.
+const (
+	DedupeHardlink = "hardlink"
+
+	// A copy-on-write clone, on Linux filesystems that support it such as
+	// btrfs and XFS. Falls back to a copy.
+	DedupeReflink = "reflink"
+
+	DedupeCopy = "copy"
+)
+
+// ValidateDedupe checks that a deduplication mode is supported
+func ValidateDedupe(mode string) error {
+	switch mode {
+	case "", DedupeHardlink, DedupeReflink, DedupeCopy:
+		return nil
+	}
+	return fmt.Errorf("unsupported deduplication mode %q, expected one of %s",
+		mode, strings.Join([]string{DedupeHardlink, DedupeReflink, DedupeCopy}, ", "))
+}
+
+// ValidateDedupeMetadata checks that the metadata of the downloaded files
+// can be set. Hard links share one inode, so duplicates from different
+// file IDs would overwrite each other's times, modes and provenance.
+func ValidateDedupeMetadata(opts Opts) error {
+	if opts.Dedupe != DedupeHardlink {
+		return nil
+	}
+	if opts.PreserveTimes || opts.FileMode != 0 {
+		return fmt.Errorf("the %s deduplication mode cannot be used with preserved times or a file mode, "+
+			"since the duplicates share them", DedupeHardlink)
+	}
+	if outputs, _ := ParseProvenance(opts.Provenance); outputs[ProvenanceXattr] {
+		return fmt.Errorf("the %s deduplication mode cannot be used with provenance in extended attributes, "+
+			"since the duplicates share them", DedupeHardlink)
+	}
+	return nil
+}
+
+// The keys identifying the contents of a file: its file ID, and for
+// regular files, its part checksums. Files with a part without a checksum
+// are only identified by their ID, since sizes alone do not tell that two
+// files have the same contents.
+func dedupeKeys(f DXFile) []string {
+	keys := []string{"id " + f.id()}
+	reg, ok := f.(DXFileRegular)
+	if !ok || len(reg.Parts) == 0 {
+		return keys
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "parts %s", safeDeref(reg.ChecksumType, "MD5"))
+	for _, p := range reg.Parts {
+		if p.MD5 == "" && safeDeref(p.Checksum, "") == "" {
+			return keys
+		}
+		fmt.Fprintf(&sb, " %d:%s", p.Size, p.MD5)
+		if p.Checksum != nil {
+			fmt.Fprintf(&sb, ":%s", *p.Checksum)
+		}
+	}
+	return append(keys, sb.String())
+}
+
+// Record the files of the manifest that duplicate an earlier file, with
+// the file they are created from.
+func (st *State) createDuplicatesTable(manifest Manifest) {
+	sqlStmt := `
+	CREATE TABLE file_duplicates (
+		kind          integer,
+		file_id       text,
+		folder        text,
+		name          text,
+		source_id     text,
+		source_folder text,
+		source_name   text
+	);
+	`
+	_, err := st.db.Exec(sqlStmt)
+	check(err)
+	_, err = st.db.Exec("CREATE INDEX file_duplicates_idx ON file_duplicates (file_id, folder, name)")
+	check(err)
+	_, err = st.db.Exec("CREATE TABLE dedupe_info (mode text)")
+	check(err)
+	_, err = st.db.Exec("INSERT INTO dedupe_info VALUES (?)", st.opts.Dedupe)
+	check(err)
+
+	sources := make(map[string]inspectKey)
+	txn, err := st.db.Begin()
+	check(err)
+	for _, f := range manifest.Files {
+		key := inspectKey{0, f.id(), f.folder(), f.name()}
+		if _, ok := f.(DXFileSymlink); ok {
+			key.kind = 1
+		}
+		keys := dedupeKeys(f)
+		var source *inspectKey
+		for _, k := range keys {
+			if src, ok := sources[fmt.Sprintf("%d %s", key.kind, k)]; ok {
+				source = &src
+				break
+			}
+		}
+		if source == nil {
+			for _, k := range keys {
+				sources[fmt.Sprintf("%d %s", key.kind, k)] = key
+			}
+			continue
+		}
+		if *source == key {
+			// listed twice under the same path
+			continue
+		}
+		_, err := txn.Exec("INSERT INTO file_duplicates VALUES (?, ?, ?, ?, ?, ?, ?)",
+			key.kind, key.fileId, key.folder, key.name, source.fileId, source.folder, source.name)
+		check(err)
+	}
+	err = txn.Commit()
+	check(err)
+}
+
+// A condition on the rows of a part table, or of the symlinks table,
+// leaving out the duplicate files. Empty if the download has none.
+func (st *State) notDuplicate(kind int, alias string, idColumn string) string {
+	if !st.tableExists("file_duplicates") {
+		return ""
+	}
+	return fmt.Sprintf(` AND NOT EXISTS (SELECT 1 FROM file_duplicates d
+		WHERE d.kind = %d AND d.file_id = %s.%s AND d.folder = %s.folder AND d.name = %s.name)`,
+		kind, alias, idColumn, alias, alias)
+}
+
+// The mode duplicates are created with, as recorded when the download
+// was started. Downloads started by older versions did not record it, and
+// create them as hard links unless asked otherwise.
+func (st *State) dedupeMode() string {
+	if st.tableExists("dedupe_info") {
+		var mode string
+		st.mutex.Lock()
+		err := st.db.QueryRow("SELECT mode FROM dedupe_info").Scan(&mode)
+		st.mutex.Unlock()
+		check(err)
+		return mode
+	}
+	if st.opts.Dedupe == "" {
+		return DedupeHardlink
+	}
+	return st.opts.Dedupe
+}
+
+// Whether duplicates take no space of their own on disk
+func (st *State) duplicatesShareSpace() bool {
+	return st.dedupeMode() != DedupeCopy
+}
+
+// All the duplicate files, with the file each is created from
+func (st *State) duplicateSources() map[inspectKey]inspectKey {
+	sources := make(map[inspectKey]inspectKey)
+	if !st.tableExists("file_duplicates") {
+		return sources
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	rows, err := st.db.Query(
+		"SELECT kind, file_id, folder, name, source_id, source_folder, source_name FROM file_duplicates")
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		var dup, src inspectKey
+		check(rows.Scan(&dup.kind, &dup.fileId, &dup.folder, &dup.name, &src.fileId, &src.folder, &src.name))
+		src.kind = dup.kind
+		sources[dup] = src
+	}
+	check(rows.Err())
+	return sources
+}
+
+// Creates the duplicates of files as they complete, and the duplicates of
+// files completed by earlier runs.
+type duplicateLinker struct {
+	st       *State
+	mode     string
+	fellBack atomic.Bool // warned that duplicates are copied instead
+}
+
+// Returns nil if the download has no duplicates
+func newDuplicateLinker(st *State) (*duplicateLinker, error) {
+	if !st.tableExists("file_duplicates") {
+		if st.opts.Dedupe != "" {
+			PrintLogAndOut("The download was started without deduplication, duplicate files are downloaded separately. " +
+				"Delete the .stats.db file and re-run the download to deduplicate them.\n")
+		}
+		return nil, nil
+	}
+	mode := st.dedupeMode()
+	if st.opts.Dedupe != "" && st.opts.Dedupe != mode {
+		PrintLogAndOut("The download was started with -dedupe=%s, which is kept. "+
+			"Delete the .stats.db file and re-run the download to change it.\n", mode)
+	}
+	opts := st.opts
+	opts.Dedupe = mode
+	if err := ValidateDedupeMetadata(opts); err != nil {
+		return nil, err
+	}
+	return &duplicateLinker{st: st, mode: mode}, nil
+}
+
+// Create a duplicate at a temporary path next to it, and move it in place
+// of the empty file created for it.
+func (dl *duplicateLinker) materialize(src string, dst string) error {
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".dedupe")
+	return linkOrCopy(dl.mode, src, dst, tmp, &dl.fellBack)
+}
+
+// Create dst from src as a hard link, a reflink or a copy, through a
+// temporary path that is then renamed. Links that cannot be created fall
+// back to copies, with a warning the first time.
+func linkOrCopy(mode string, src string, dst string, tmp string, fellBack *atomic.Bool) error {
+	os.Remove(tmp)
+
+	var err error
+	switch mode {
+	case DedupeHardlink:
+		err = os.Link(src, tmp)
+	case DedupeReflink:
+		err = reflinkPath(src, tmp)
+	}
+	if err != nil {
+		if !fellBack.Swap(true) {
+			slog.Warn("could not "+mode+" files, copying them instead", "path", dst, "error", err)
+		}
+		os.Remove(tmp)
+	}
+	if mode == DedupeCopy || err != nil {
+		err = copyPath(src, tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Empty a file that may be a hard link to a duplicate or a cache object.
+// The file is replaced by a new empty one, leaving the data of the other
+// links alone, which the owner can write to. A missing file stays missing.
+func emptyFile(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := restoreDirAccess(filepath.Dir(path), make(map[string]bool)); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm()|0200)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Give a file with several hard links its own copy of the data, before it
+// is modified in place.
+func unshareFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || numLinks(path, fi) <= 1 {
+		return err
+	}
+	if err := restoreDirAccess(filepath.Dir(path), make(map[string]bool)); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".unshare")
+	return linkOrCopy(DedupeCopy, path, path, tmp, nil)
+}
+
+func copyPath(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Create a duplicate from its complete source, and mark its parts as
+// downloaded. The duplicate is then handled like any completed file.
+func (dl *duplicateLinker) create(dup inspectKey, src inspectKey) error {
+	srcPath := filepath.Join(".", src.folder, src.name)
+	dstPath := filepath.Join(".", dup.folder, dup.name)
+	if err := dl.materialize(srcPath, dstPath); err != nil {
+		return err
+	}
+
+	f, err := dl.st.markFileComplete(dup)
+	if err != nil {
+		return err
+	}
+	slog.Debug("duplicate created", "file_id", dup.fileId, "path", dstPath, "source", srcPath, "mode", dl.mode)
+	if f != nil {
+		dl.st.fileCompleted(*f)
+	}
+	return nil
+}
+
+// Create the duplicates of a file that just completed
+func (dl *duplicateLinker) sourceCompleted(f completedFile) {
+	if dl == nil {
+		return
+	}
+	st := dl.st
+	st.mutex.Lock()
+	rows, err := st.db.Query(
+		"SELECT file_id, folder, name FROM file_duplicates WHERE kind = ? AND source_id = ? AND source_folder = ? AND source_name = ?",
+		f.kind, f.fileId, f.folder, f.name)
+	check(err)
+	var dups []inspectKey
+	for rows.Next() {
+		dup := inspectKey{kind: f.kind}
+		check(rows.Scan(&dup.fileId, &dup.folder, &dup.name))
+		dups = append(dups, dup)
+	}
+	check(rows.Err())
+	rows.Close()
+	st.mutex.Unlock()
+
+	src := inspectKey{f.kind, f.fileId, f.folder, f.name}
+	for _, dup := range dups {
+		if err := dl.create(dup, src); err != nil {
+			dl.failed(dup, err)
+		}
+	}
+}
+
+// A duplicate that could not be created is left incomplete, and created
+// again on the next run.
+func (dl *duplicateLinker) failed(dup inspectKey, err error) {
+	path := filepath.Join(".", dup.folder, dup.name)
+	slog.Error("could not create duplicate file", "file_id", dup.fileId, "path", path, "error", err)
+	table := "manifest_regular_stats"
+	if dup.kind == 1 {
+		table = "manifest_symlink_stats"
+	}
+	var numParts int64
+	dl.st.mutex.Lock()
+	err = dl.st.db.QueryRow(fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE file_id = ? AND folder = ? AND name = ? AND bytes_fetched != size", table),
+		dup.fileId, dup.folder, dup.name).Scan(&numParts)
+	dl.st.mutex.Unlock()
+	check(err)
+	dl.st.stats.failedParts.Add(numParts)
+}
+
+// Create the missing duplicates of files that are already complete, for
+// example those removed by inspect, or left over by an interrupted run.
+func (dl *duplicateLinker) createPending() error {
+	if dl == nil {
+		return nil
+	}
+	st := dl.st
+	type pending struct{ dup, src inspectKey }
+	var todo []pending
+
+	st.mutex.Lock()
+	for kind, table := range []string{"manifest_regular_stats", "manifest_symlink_stats"} {
+		rows, err := st.db.Query(fmt.Sprintf(`
+			SELECT d.file_id, d.folder, d.name, d.source_id, d.source_folder, d.source_name
+			FROM file_duplicates d
+			WHERE d.kind = %d
+			AND EXISTS (SELECT 1 FROM %s p
+				WHERE p.file_id = d.file_id AND p.folder = d.folder AND p.name = d.name AND p.bytes_fetched != p.size)
+			AND NOT EXISTS (SELECT 1 FROM %s p
+				WHERE p.file_id = d.source_id AND p.folder = d.source_folder AND p.name = d.source_name AND p.bytes_fetched != p.size)`,
+			kind, table, table))
+		if err != nil {
+			st.mutex.Unlock()
+			return err
+		}
+		for rows.Next() {
+			p := pending{dup: inspectKey{kind: kind}, src: inspectKey{kind: kind}}
+			if err := rows.Scan(&p.dup.fileId, &p.dup.folder, &p.dup.name,
+				&p.src.fileId, &p.src.folder, &p.src.name); err != nil {
+				rows.Close()
+				st.mutex.Unlock()
+				return err
+			}
+			todo = append(todo, p)
+		}
+		rows.Close()
+	}
+	st.mutex.Unlock()
+
+	if len(todo) > 0 {
+		PrintLogAndOut("Creating %d duplicate files from their downloaded copies\n", len(todo))
+	}
+	for _, p := range todo {
+		if err := dl.create(p.dup, p.src); err != nil {
+			dl.failed(p.dup, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package dxda
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDedupe(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(2, 300*KiB, 128*KiB)
+	ts := newTestServer(files, 0, 0)
+	defer ts.Close()
+
+	// the same file ID in two folders, and a clone of the second file with
+	// another ID, which the server does not know about
+	clone := files[1]
+	clone.id = "file-clone0000000000000000"
+	var manifest Manifest
+	for _, e := range []DXFileRegular{
+		files[0].manifestEntry("/a"),
+		files[1].manifestEntry("/a"),
+		files[0].manifestEntry("/b"),
+		clone.manifestEntry("/c"),
+	} {
+		manifest.Files = append(manifest.Files, e)
+	}
+
+	download := func() {
+		if err := ts.download(t, Opts{NumThreads: 2, Dedupe: DedupeHardlink}, manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sameFile := func(a string, b string) bool {
+		fa, errA := os.Stat(a)
+		fb, errB := os.Stat(b)
+		return errA == nil && errB == nil && os.SameFile(fa, fb)
+	}
+	download()
+	for path, f := range map[string]testFile{"b/" + files[0].name: files[0], "c/" + clone.name: clone} {
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != string(f.data) {
+			t.Errorf("Expected the contents of %s in %s", f.id, path)
+		}
+	}
+	if !sameFile("a/"+files[0].name, "b/"+files[0].name) || !sameFile("a/"+files[1].name, "c/"+clone.name) {
+		t.Error("Expected the duplicates to be hard links to the downloaded files")
+	}
+
+	// inspect reports the relationship, and repairs a removed duplicate
+	os.Remove("b/" + files[0].name)
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	report := st.Inspect()
+	st.Close()
+	byPath := make(map[string]InspectFile)
+	for _, f := range report.Files {
+		byPath[f.Path] = f
+	}
+	if f := byPath["c/"+clone.name]; f.Status != statusOK || f.DuplicateOf != "a/"+files[1].name ||
+		f.Message != "Hard link to a/"+files[1].name {
+		t.Errorf("Expected the clone to be reported as a hard link, got %+v", f)
+	}
+	if f := byPath["b/"+files[0].name]; f.Status != statusMissing || f.DuplicateOf != "a/"+files[0].name {
+		t.Errorf("Expected the removed duplicate to be missing, got %+v", f)
+	}
+	download()
+	if !sameFile("a/"+files[0].name, "b/"+files[0].name) {
+		t.Error("Expected the removed duplicate to be linked again")
+	}
+
+	// copies do not share the file
+	dl := &duplicateLinker{mode: DedupeCopy}
+	if err := dl.materialize("a/"+files[0].name, "copy.bam"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile("copy.bam")
+	if string(data) != string(files[0].data) || sameFile("a/"+files[0].name, "copy.bam") {
+		t.Error("Expected a separate copy of the file")
+	}
+}
+
+// The mode is kept when the download is resumed without it
+func TestDedupeModeKept(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(1, 300*KiB, 128*KiB)
+	ts := newTestServer(files, 0, 0)
+	defer ts.Close()
+	manifest := Manifest{Files: []DXFile{files[0].manifestEntry("/a"), files[0].manifestEntry("/b")}}
+
+	if err := ts.download(t, Opts{NumThreads: 2, Dedupe: DedupeCopy}, manifest); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("b/" + files[0].name)
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	st.Inspect()
+	st.Close()
+	if err := ts.download(t, Opts{NumThreads: 2}, manifest); err != nil {
+		t.Fatal(err)
+	}
+	fa, errA := os.Stat("a/" + files[0].name)
+	fb, errB := os.Stat("b/" + files[0].name)
+	if errA != nil || errB != nil || os.SameFile(fa, fb) {
+		t.Errorf("Expected the duplicate to be copied again, got %v %v", errA, errB)
+	}
+
+	// hard links would share the metadata of different files
+	for _, opts := range []Opts{
+		{Dedupe: DedupeHardlink, PreserveTimes: true},
+		{Dedupe: DedupeHardlink, FileMode: 0644},
+		{Dedupe: DedupeHardlink, Provenance: "jsonl,xattr"},
+	} {
+		if err := ValidateDedupeMetadata(opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+	if err := ValidateDedupeMetadata(Opts{Dedupe: DedupeCopy, PreserveTimes: true, Provenance: "xattr"}); err != nil {
+		t.Error(err)
+	}
+}
+
+// Files without part checksums are only duplicates of the same file ID
+func TestDedupeKeysWithoutChecksums(t *testing.T) {
+	a := DXFileRegular{Id: "file-a", Parts: []DXPart{{Id: 1, Size: 100, MD5: "0123"}, {Id: 2, Size: 10}}}
+	b := DXFileRegular{Id: "file-b", Parts: []DXPart{{Id: 1, Size: 100, MD5: "0123"}, {Id: 2, Size: 10}}}
+	if keys := dedupeKeys(a); len(keys) != 1 || keys[0] != "id file-a" {
+		t.Errorf("Expected only the file ID as a key, got %v", keys)
+	}
+	b.Parts[1].MD5 = "4567"
+	if keys := dedupeKeys(b); len(keys) != 2 || keys[1] != "parts MD5 100:0123 10:4567" {
+		t.Errorf("Expected the part checksums as a key, got %v", keys)
+	}
+}
+
+// Resetting or repairing a file does not change the other hard links to it
+func TestResetLinkedFile(t *testing.T) {
+	chdirTemp(t)
+	data := []byte("shared contents")
+	if err := os.WriteFile("object", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"reset.bam", "repaired.bam"} {
+		if err := os.Link("object", name); err != nil {
+			t.Skip("hard links are not supported here")
+		}
+	}
+
+	if err := emptyFile("reset.bam"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat("reset.bam"); err != nil || fi.Size() != 0 {
+		t.Errorf("Expected an empty file, got %v %v", fi, err)
+	}
+	if err := unshareFile("repaired.bam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate("repaired.bam", 6); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile("object"); string(got) != string(data) {
+		t.Errorf("Expected the linked file to be left alone, got %q", got)
+	}
+	if err := emptyFile("missing.bam"); err != nil {
+		t.Errorf("Expected nothing to do for a missing file, got %v", err)
+	}
+	if _, err := os.Stat("missing.bam"); !os.IsNotExist(err) {
+		t.Errorf("Expected the missing file to stay missing")
+	}
+}
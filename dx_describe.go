@@ -25,6 +25,8 @@ type DxDescribeDataObject struct {
 	Parts         map[string]DXPart // a list of parts for a DNAx file
 	Symlink       *DXSymlink
 	ChecksumType  string
+	Created       int64 // milliseconds since the epoch
+	Modified      int64
 }
 
 // description of part of a file
@@ -81,6 +83,8 @@ type DxDescribeRaw struct {
 	MD5           *string           `json:"md5,omitempty"`
 	Drive         *string           `json:"drive,omitempty"`
 	ChecksumType  *string           `json:"checksumType,omitempty"`
+	Created       int64             `json:"created"`
+	Modified      int64             `json:"modified"`
 }
 
 // Describe a large number of file-ids in one API call.
@@ -107,6 +111,8 @@ func submit(
 			"drive":         true,
 			"md5":           true,
 			"checksumType":  true,
+			"created":       true,
+			"modified":      true,
 		},
 	}
 	var payload []byte
@@ -171,6 +177,8 @@ func submit(
 			Parts:         descRaw.Parts,
 			ChecksumType:  *descRaw.ChecksumType,
 			Symlink:       symlink,
+			Created:       descRaw.Created,
+			Modified:      descRaw.Modified,
 		}
 		//fmt.Printf("%v\n", desc)
 		files[desc.Id] = desc
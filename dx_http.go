@@ -10,7 +10,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -96,6 +96,14 @@ func isGood(status int) bool {
 	return (200 <= status && status < 300)
 }
 
+// Connection errors that are retried: ECONNREFUSED, ECONNRESET
+func isRetryableConnError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
 func isRetryable(ctx context.Context, requestType string, status int) bool {
 	// do not retry on context.Canceled or context.DeadlineExceeded
 	if ctx.Err() != nil {
@@ -200,7 +208,7 @@ func NewHttpClient() *http.Client {
 
 	// Append our cert to the system pool
 	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-		log.Println("No certs appended, using system certs only")
+		slog.Warn("no certs appended, using system certs only", "cert_file", localCertFile)
 	}
 
 	// Trust the augmented cert pool in our client
@@ -292,10 +300,15 @@ func DxHttpRequest(
 				return nil, hErr
 			}
 			// A retryable http error.
+			slog.Warn("request attempt failed",
+				"method", requestType, "host", urlHost(URL), "status", hErr.StatusCode,
+				"attempt", tCnt+1, "max_attempts", numRetries+1)
 			continue
 		case *url.Error:
-			// Retry ECONNREFUSED, ECONNRESET
-			if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+			if isRetryableConnError(ctx, err) {
+				slog.Warn("request attempt failed",
+					"method", requestType, "host", urlHost(URL), "error", err,
+					"attempt", tCnt+1, "max_attempts", numRetries+1)
 				continue
 			} else {
 				return nil, err
@@ -305,8 +318,8 @@ func DxHttpRequest(
 			return nil, err
 		}
 	}
-	log.Printf("%s request to '%s' failed after %d attempts, err=%s",
-		requestType, URL, tCnt, err.Error())
+	slog.Error("request failed",
+		"method", requestType, "host", urlHost(URL), "attempts", tCnt, "error", err)
 	return nil, err
 }
 
@@ -327,10 +340,9 @@ func DxHttpRequestData(
 	for ccCnt := 0; ccCnt < contextCanceledNumRetries; ccCnt++ {
 		// Safety procedure to force timeout to prevent hanging
 		ctx2, cancel := context.WithCancel(ctx)
-		timer := time.AfterFunc(requestOverallTimeout, func() {
-			cancel()
-		})
-		defer timer.Stop()
+		deadline := newRequestDeadline(requestOverallTimeout, cancel)
+		defer deadline.stop()
+		ctx2 = context.WithValue(ctx2, requestDeadlineKey{}, deadline)
 
 		contextCanceled := false
 		bytesFetched := 0
@@ -360,7 +372,8 @@ func DxHttpRequestData(
 			// check that the length is correct
 			if recvLen != dataLen {
 				// Note: it would be preferable to collect partial results and concatenate them.
-				log.Printf("received length is wrong, got %d, expected %d. Retrying.", recvLen, dataLen)
+				slog.Warn("received length is wrong, retrying",
+					"host", urlHost(url), "received", recvLen, "expected", dataLen, "attempt", i+1)
 				time.Sleep(time.Duration(badLengthTimeout) * time.Second)
 				continue
 			}
@@ -372,8 +385,9 @@ func DxHttpRequestData(
 				requestType, url, badLengthNumRetries)
 		}
 
-		log.Printf("Filepart was not successfully downloaded within %.f minutes (only %d of %d bytes fetched). Retrying (attempt %d of %d).",
-			requestOverallTimeout.Minutes(), bytesFetched, dataLen, ccCnt+1, contextCanceledNumRetries)
+		slog.Warn("request timed out, retrying",
+			"host", urlHost(url), "timeout", requestOverallTimeout, "received", bytesFetched, "expected", dataLen,
+			"attempt", ccCnt+1, "max_attempts", contextCanceledNumRetries)
 		time.Sleep(time.Duration(contextCanceledTimeout) * time.Second)
 	}
 
@@ -422,13 +436,13 @@ func DxAPI(
 			if len(hErr.Message) < maxSizeResponse {
 				var dxErrJson DxErrorJson
 				if err := json.Unmarshal(hErr.Message, &dxErrJson); err != nil {
-					log.Printf("could not unmarshal JSON response (%s)", hErr.Message)
+					slog.Warn("could not unmarshal JSON response", "api", api, "response", string(hErr.Message))
 				}
 				dxErr.EType = dxErrJson.E.EType
 				dxErr.Message = dxErrJson.E.Message
 			} else {
-				log.Printf("response is larger than maximum, %d > %d",
-					len(hErr.Message), maxSizeResponse)
+				slog.Warn("response is larger than maximum",
+					"api", api, "size", len(hErr.Message), "max_size", maxSizeResponse)
 			}
 
 			// the status can just be copied from the http error.
@@ -14,12 +14,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3" // Following canonical example on go-sqlite3 'simple.go'
@@ -33,6 +35,9 @@ const (
 	numRetries                     = 10
 	numRetriesChecksumMismatch     = 10
 	secondsInYear              int = 60 * 60 * 24 * 365
+
+	// Capacity of each of the channels between the download stages
+	jobQueueSize = 1024
 )
 
 var err error
@@ -101,6 +106,16 @@ func (slnk DBPartSymlink) project() string  { return slnk.Project }
 func (slnk DBPartSymlink) offset() int64    { return slnk.Offset }
 func (slnk DBPartSymlink) size() int        { return slnk.Size }
 
+func partId(p DBPart) int {
+	switch p.(type) {
+	case DBPartRegular:
+		return p.(DBPartRegular).PartId
+	case DBPartSymlink:
+		return p.(DBPartSymlink).PartId
+	}
+	return 0
+}
+
 // JobInfo ...
 type JobInfo struct {
 	part       DBPart
@@ -126,11 +141,30 @@ type DownloadStatus struct {
 type State struct {
 	dxEnv           DXEnvironment
 	opts            Opts
+	manifestFname   string
 	mutex           sync.Mutex
 	db              *sql.DB
 	ds              *DownloadStatus // only the progress report thread accesses this field
 	timeOfLastError int
 	maxChunkSize    int64
+	limiter         *bandwidthLimiter // shared by all download workers
+	stats           *downloadStats
+	gate            *workerGate // limits the number of active download workers
+	activity        *workerActivity
+	hooks           *hookRunner       // nil if no hooks are configured
+	checksums       *fileChecksummer  // nil unless computed during the download
+	provenance      *provenanceWriter // nil unless provenance is recorded
+	metadata        *fileMetadata     // nil unless times or modes are set
+	duplicates      *duplicateLinker  // nil unless duplicates are created from their copies
+	cache           *contentCache     // nil unless a cache directory is used
+	sink            outputSink        // where the downloaded files are written
+	queue           *partTableQueue   // nil if the download queue is a table, see ordering.go
+	numWorkers      int               // download workers started, the most that can be active
+
+	// Controls for a running download, see control.go
+	bandwidthOverride atomic.Int64 // bandwidth limit set through the control API, -1 if none
+	stopCh            chan struct{}
+	stopOnce          sync.Once
 }
 
 //-----------------------------------------------------------------
@@ -168,6 +202,9 @@ func calcNumThreads(maxChunkSize int64) int {
 // Initialize the state
 func NewDxDa(dxEnv DXEnvironment, fname string, optsRaw Opts) *State {
 	statsFname := fname + ".stats.db?_busy_timeout=60000&cache=shared&mode=rwc"
+	if optsRaw.DryRun {
+		statsFname = fname + ".stats.db?_busy_timeout=60000&cache=shared&mode=ro"
+	}
 	db, err := sql.Open("sqlite3", statsFname)
 	check(err)
 	db.SetMaxOpenConns(1)
@@ -198,15 +235,21 @@ func NewDxDa(dxEnv DXEnvironment, fname string, optsRaw Opts) *State {
 	fmt.Printf("maximal memory chunk size: %d MiB\n", maxChunkSize/MiB)
 	//	runtime.GOMAXPROCS(st.opts.NumThreads + 2)
 
-	return &State{
+	st := &State{
 		dxEnv:           dxEnv,
 		opts:            opts,
+		manifestFname:   fname,
 		mutex:           sync.Mutex{},
 		db:              db,
 		ds:              nil,
 		timeOfLastError: 0,
 		maxChunkSize:    maxChunkSize,
+		limiter:         newBandwidthLimiter(opts.MaxBandwidth),
+		stats:           newDownloadStats(),
+		sink:            directorySink{},
 	}
+	st.bandwidthOverride.Store(-1)
+	return st
 }
 
 func (st *State) Close() {
@@ -301,12 +344,31 @@ func diskSpaceString(numBytes int64) string {
 // CheckDiskSpace ...
 // Check that we have enough disk space for all downloaded files
 func (st *State) CheckDiskSpace() error {
+	if IsS3Output(st.opts.Output) {
+		// nothing is written locally
+		return nil
+	}
 	// Calculate total disk space required. To get an accurate number,
 	// query the database, and sum the space for missing pieces.
 	//
+	// Duplicates linked to their copies take no space.
+	regularFilter, symlinkFilter := "", ""
+	if st.duplicatesShareSpace() {
+		regularFilter = st.notDuplicate(0, "r", "file_id")
+		symlinkFilter = st.notDuplicate(1, "r", "file_id")
+	}
 	totalSizeBytes :=
-		st.queryDBIntegerResult("SELECT SUM(size) FROM manifest_regular_stats WHERE bytes_fetched != size") +
-			st.queryDBIntegerResult("SELECT SUM(size) FROM manifest_symlink_stats WHERE bytes_fetched != size")
+		st.queryDBIntegerResult("SELECT SUM(size) FROM manifest_regular_stats r WHERE bytes_fetched != size"+regularFilter) +
+			st.queryDBIntegerResult("SELECT SUM(size) FROM manifest_symlink_stats r WHERE bytes_fetched != size"+symlinkFilter)
+
+	// Preallocated files already hold their space. What remains to be
+	// checked is the space that could not be reserved.
+	if st.opts.Preallocate {
+		totalSizeBytes, err = st.unallocatedBytes()
+		if err != nil {
+			return err
+		}
+	}
 
 	// Find how much local disk space is available
 	wd, err := os.Getwd()
@@ -385,6 +447,10 @@ func (st *State) addSymlinkToTable(txn *sql.Tx, slnk DXFileSymlink) {
 // Read the manifest file, and build a database with an empty state
 // for each part in each file.
 func (st *State) CreateManifestDB(manifest Manifest, fname string) {
+	original := manifest
+	if st.opts.BagIt {
+		manifest = bagPayloadManifest(manifest)
+	}
 	statsFname := fname + ".stats.db?_busy_timeout=60000&cache=shared&mode=rwc"
 	os.Remove(statsFname)
 	// db, err := sql.Open("sqlite3", statsFname)
@@ -458,30 +524,171 @@ func (st *State) CreateManifestDB(manifest Manifest, fname string) {
 
 	err = txn.Commit()
 	check(err)
+	err = st.createPartIndexes()
+	check(err)
+
+	st.addFilePriorities(manifest)
+	st.addFileTimes(manifest)
+	if st.opts.Dedupe != "" {
+		st.createDuplicatesTable(manifest)
+	}
+	if st.opts.BagIt {
+		st.createBagTable()
+	}
 
 	// TODO Log network settings and other helpful info for debugging
 	PrintLogAndOut("Preparing files for download\n")
-	st.PrepareFilesForDownload(manifest)
+	st.PrepareFilesForDownload(original)
 }
 
-// create an empty file for each download filepath.
+// create an empty file for each download filepath. If preallocation is
+// enabled, reserve the full size of each file on disk.
 //
 // TODO: Optimize this for only files that need to be downloaded
 func (st *State) PrepareFilesForDownload(m Manifest) {
+	if IsS3Output(st.opts.Output) {
+		// nothing is written locally
+		return
+	}
+	if st.IsBag() {
+		m = bagPayloadManifest(m)
+	}
+	preallocate := st.opts.Preallocate
+	// duplicates replace their empty file once they are created
+	duplicates := st.duplicateSources()
+	// Files left incomplete are written to, even if an earlier run made
+	// them or their directories read-only. Complete files keep their modes.
+	incomplete := st.incompleteFiles()
+	seenDirs := make(map[string]bool)
 	for _, f := range m.Files {
+		key := inspectKey{0, f.id(), f.folder(), f.name()}
+		if _, ok := f.(DXFileSymlink); ok {
+			key.kind = 1
+		}
+		if incomplete[key] {
+			check(restoreDirAccess(filepath.Join(".", f.folder()), seenDirs))
+		}
+
 		// Create directory structure and initialize file if it doesn't exist
 		wd, err := os.Getwd()
 		check(err)
 		folder := filepath.Join(wd, f.folder())
 		fname := filepath.Join(folder, f.name())
 		if _, err := os.Stat(fname); os.IsNotExist(err) {
+			check(restoreDirAccess(filepath.Join(".", f.folder()), seenDirs))
 			err := os.MkdirAll(folder, 0777)
 			check(err)
 			localf, err := os.Create(fname)
 			check(err)
 			localf.Close()
+		} else if incomplete[key] {
+			check(restoreOwnerWrite(fname))
+		}
+
+		// complete files need no room
+		if _, ok := duplicates[key]; preallocate && !ok && incomplete[key] {
+			if err := preallocatePath(fname, f.size()); err != nil {
+				// Do not fail here. The disk space check that follows
+				// reports how much space is still missing.
+				PrintLogAndOut("Could not preallocate %s: %s\n", fname, err.Error())
+				preallocate = false
+			}
+		}
+	}
+}
+
+// The files with parts left to download
+func (st *State) incompleteFiles() map[inspectKey]bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	files := make(map[inspectKey]bool)
+	for kind, table := range []string{"manifest_regular_stats", "manifest_symlink_stats"} {
+		rows, err := st.db.Query(fmt.Sprintf(
+			"SELECT DISTINCT file_id, folder, name FROM %s WHERE bytes_fetched != size", table))
+		check(err)
+		for rows.Next() {
+			key := inspectKey{kind: kind}
+			check(rows.Scan(&key.fileId, &key.folder, &key.name))
+			files[key] = true
 		}
+		check(rows.Err())
+		rows.Close()
 	}
+	return files
+}
+
+func preallocatePath(fname string, size int64) error {
+	localf, err := os.OpenFile(fname, os.O_WRONLY, 0777)
+	if err != nil {
+		return err
+	}
+	defer localf.Close()
+	return preallocateFile(localf, size)
+}
+
+// Sum of the bytes that are not yet reserved on disk, across all files in
+// the manifest. Only meaningful when files are preallocated.
+func (st *State) unallocatedBytes() (int64, error) {
+	type localFile struct {
+		fname string
+		size  int64
+	}
+	var files []localFile
+
+	regularFilter, symlinkFilter := "", ""
+	if st.duplicatesShareSpace() {
+		regularFilter = st.notDuplicate(0, "r", "file_id")
+		symlinkFilter = st.notDuplicate(1, "s", "id")
+	}
+	st.mutex.Lock()
+	rows, err := st.db.Query("SELECT folder, name, SUM(size) FROM manifest_regular_stats r WHERE 1" + regularFilter +
+		" GROUP BY file_id, folder, name")
+	if err != nil {
+		st.mutex.Unlock()
+		return 0, err
+	}
+	for rows.Next() {
+		var folder, name string
+		var size int64
+		if err := rows.Scan(&folder, &name, &size); err != nil {
+			rows.Close()
+			st.mutex.Unlock()
+			return 0, err
+		}
+		files = append(files, localFile{fmt.Sprintf(".%s/%s", folder, name), size})
+	}
+	rows.Close()
+
+	rows, err = st.db.Query("SELECT folder, name, size FROM symlinks s WHERE 1" + symlinkFilter)
+	if err != nil {
+		st.mutex.Unlock()
+		return 0, err
+	}
+	for rows.Next() {
+		var folder, name string
+		var size int64
+		if err := rows.Scan(&folder, &name, &size); err != nil {
+			rows.Close()
+			st.mutex.Unlock()
+			return 0, err
+		}
+		files = append(files, localFile{fmt.Sprintf(".%s/%s", folder, name), size})
+	}
+	rows.Close()
+	st.mutex.Unlock()
+
+	total := int64(0)
+	for _, f := range files {
+		fi, err := os.Stat(f.fname)
+		if err != nil {
+			total += f.size
+			continue
+		}
+		if missing := f.size - allocatedBytes(f.fname, fi); missing > 0 {
+			total += missing
+		}
+	}
+	return total, nil
 }
 
 // InitDownloadStatus ...
@@ -513,9 +720,9 @@ func (st *State) InitDownloadStatus() {
 		MaxWindowSize:    int64(2 * 60 * 1000 * 1000 * 1000),
 	}
 
-	if st.opts.Verbose {
-		log.Printf("init download status %v\n", st.ds)
-	}
+	slog.Debug("init download status",
+		"num_parts", st.ds.NumParts, "num_bytes", st.ds.NumBytes,
+		"progress_interval", st.ds.ProgressInterval)
 }
 
 // Calculate bandwidth in MB/sec. Query the database, and find
@@ -530,14 +737,15 @@ func (st *State) calcBandwidth(timeWindowNanoSec int64) float64 {
 	now := time.Now().UnixNano()
 	lowerBound := now - timeWindowNanoSec
 
+	// duplicates are not downloaded
 	queryReg := fmt.Sprintf(
-		"SELECT SUM(bytes_fetched) FROM manifest_regular_stats WHERE download_done_time > %d",
-		lowerBound)
+		"SELECT SUM(bytes_fetched) FROM manifest_regular_stats r WHERE download_done_time > %d%s",
+		lowerBound, st.notDuplicate(0, "r", "file_id"))
 	regBytesDownloadedInTimeWindow := st.queryDBIntegerResult(queryReg)
 
 	querySlnk := fmt.Sprintf(
-		"SELECT SUM(bytes_fetched) FROM manifest_symlink_stats WHERE download_done_time > %d",
-		lowerBound)
+		"SELECT SUM(bytes_fetched) FROM manifest_symlink_stats r WHERE download_done_time > %d%s",
+		lowerBound, st.notDuplicate(1, "r", "file_id"))
 	slnkBytesDownloadedInTimeWindow := st.queryDBIntegerResult(querySlnk)
 
 	bytesDownloadedInTimeWindow := regBytesDownloadedInTimeWindow + slnkBytesDownloadedInTimeWindow
@@ -555,16 +763,10 @@ func bytes2MiB(bytes int64) int64 {
 // DownloadProgressOneTime ...
 // Report on progress so far
 func (st *State) DownloadProgressOneTime(timeWindowNanoSec int64) string {
-	// query the current progress
-	st.ds.NumBytesComplete =
-		st.queryDBIntegerResult("SELECT SUM(bytes_fetched) FROM manifest_regular_stats WHERE bytes_fetched = size") +
-			st.queryDBIntegerResult("SELECT SUM(bytes_fetched) FROM manifest_symlink_stats WHERE bytes_fetched = size")
-	st.ds.NumPartsComplete =
-		st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_regular_stats WHERE bytes_fetched = size") +
-			st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_symlink_stats WHERE bytes_fetched = size")
-
-	// calculate bandwitdh
-	bandwidthMBSec := st.calcBandwidth(timeWindowNanoSec)
+	report := st.progressReport(timeWindowNanoSec)
+	if st.opts.ProgressFormat == ProgressFormatJSON {
+		return report.JSON()
+	}
 
 	// report on GC statistics
 	gcReport := ""
@@ -580,18 +782,26 @@ func (st *State) DownloadProgressOneTime(timeWindowNanoSec int64) string {
 			bytes2MiB(crntAlloc), bytes2MiB(totalAlloc),
 			pauseNs/1e6, numGcCycles)
 	}
-	desc := fmt.Sprintf("Downloaded %d/%d MB\t%d/%d Parts (~%.1f MB/s written to disk estimated over the last %ds)%s",
-		bytes2MiB(st.ds.NumBytesComplete), bytes2MiB(st.ds.NumBytes),
-		st.ds.NumPartsComplete, st.ds.NumParts,
-		bandwidthMBSec,
-		timeWindowNanoSec/1e9,
+	etaReport := ""
+	if report.EtaSec != nil && report.BytesComplete < report.BytesTotal {
+		etaReport = fmt.Sprintf("   ETA %s", etaString(*report.EtaSec))
+	}
+	desc := fmt.Sprintf("Downloaded %d/%d MB\t%d/%d Parts (~%.1f MB/s written to disk estimated over the last %ds)%s%s",
+		bytes2MiB(report.BytesComplete), bytes2MiB(report.BytesTotal),
+		report.PartsComplete, report.PartsTotal,
+		report.BandwidthMBSec,
+		report.WindowSec,
+		etaReport,
 		gcReport)
 
 	return desc
 }
 
-// A loop that reports on download progress periodically.
-func (st *State) downloadProgressContinuous(wg *sync.WaitGroup) {
+// A loop that reports on download progress periodically, until all parts
+// are complete or the done channel is closed.
+func (st *State) downloadProgressContinuous(wg *sync.WaitGroup, done <-chan struct{}) {
+	defer wg.Done()
+
 	// Start time of the measurements, in nano seconds
 	startTime := time.Now()
 	lastReportTs := startTime
@@ -602,10 +812,12 @@ func (st *State) downloadProgressContinuous(wg *sync.WaitGroup) {
 		// Sleep for a number of seconds, so as to not flood the screen
 		// with messages. This also substantially limits the number
 		// of database queries.
-		time.Sleep(1 * time.Second)
+		select {
+		case <-done:
+			return
+		case <-time.After(1 * time.Second):
+		}
 		if st.ds.NumPartsComplete >= st.ds.NumParts {
-			// signal that the thread is done
-			wg.Done()
 			return
 		}
 
@@ -623,15 +835,16 @@ func (st *State) downloadProgressContinuous(wg *sync.WaitGroup) {
 		}
 		desc := st.DownloadProgressOneTime(deltaNanoSec)
 
-		if st.dxEnv.DxJobId == "" {
+		if st.dxEnv.DxJobId == "" && st.opts.ProgressFormat != ProgressFormatJSON {
 			// running on a console, erase the previous line
 			// TODO: Get rid of this temporary space-padding fix for carriage returns
 			fmt.Printf("                                                                      \r")
 			fmt.Printf("%s\r", desc)
 		} else {
-			// We are on a dx-job, and we want to see the history of printouts
+			// We are on a dx-job, or writing JSON lines, and we want to see
+			// the history of printouts.
 			// Note: the "\r" character causes problems in job logs, so do not use it.
-			fmt.Printf("%s\n", desc)
+			fmt.Fprintf(st.progressStream(), "%s\n", desc)
 		}
 	}
 }
@@ -643,13 +856,12 @@ func (st *State) downloadSymlinkPart(
 	u DXDownloadURL,
 	memoryBuf []byte) error {
 
-	if st.opts.Verbose {
-		log.Printf("downloadSymlinkPart %v %v\n", p, u)
-	}
+	slog.Debug("downloading symlink part", append(partAttrs(p), "host", urlHost(u.URL))...)
 
-	fname := fmt.Sprintf(".%s/%s", p.folder(), p.fileName())
-	localf, err := os.OpenFile(fname, os.O_WRONLY, 0777)
-	check(err)
+	localf, err := st.sink.openPart(p)
+	if err != nil {
+		return err
+	}
 	defer localf.Close()
 
 	headers := make(map[string]string)
@@ -659,13 +871,16 @@ func (st *State) downloadSymlinkPart(
 		headers[k] = v
 	}
 	err = DxHttpRequestData(context.TODO(), httpClient, "GET", u.URL, headers, []byte("{}"), p.Size, memoryBuf)
-	check(err)
+	if err != nil {
+		return err
+	}
 	body := memoryBuf[:p.Size]
 
-	_, err = localf.WriteAt(body, p.offset())
-	check(err)
-
-	return nil
+	if _, err := localf.WriteAt(body, p.offset()); err != nil {
+		return err
+	}
+	// the checksum of the whole file is verified at the end
+	return localf.commit()
 }
 
 // Download part of a file and verify its checksum in memory
@@ -675,13 +890,12 @@ func (st *State) downloadRegPartCheckSum(
 	u DXDownloadURL,
 	memoryBuf []byte) (bool, error) {
 
-	if st.opts.Verbose {
-		log.Printf("downloadRegPart %v %v\n", p, u)
-	}
+	slog.Debug("downloading part", append(partAttrs(p), "host", urlHost(u.URL))...)
 
-	fname := fmt.Sprintf(".%s/%s", p.folder(), p.fileName())
-	localf, err := os.OpenFile(fname, os.O_WRONLY, 0777)
-	check(err)
+	localf, err := st.sink.openPart(p)
+	if err != nil {
+		return false, err
+	}
 	defer localf.Close()
 
 	// compute the checksum as we go
@@ -700,16 +914,18 @@ func (st *State) downloadRegPartCheckSum(
 		}
 
 		err := DxHttpRequestData(context.TODO(), httpClient, "GET", u.URL, headers, []byte("{}"), chunkSize, memoryBuf)
-		check(err)
+		if err != nil {
+			return false, err
+		}
 		body := memoryBuf[:chunkSize]
 
 		// write to disk
-		_, err = localf.WriteAt(body, ofs)
-		check(err)
+		if _, err := localf.WriteAt(body, ofs); err != nil {
+			return false, err
+		}
 
 		// update the checksum
 		_, err = io.Copy(hasher, bytes.NewReader(body))
-
 		check(err)
 	}
 
@@ -721,7 +937,7 @@ func (st *State) downloadRegPartCheckSum(
 		}
 	}
 
-	return true, nil
+	return true, localf.commit()
 }
 
 func (st *State) downloadRegPart(
@@ -738,13 +954,14 @@ func (st *State) downloadRegPart(
 		if ok {
 			return nil
 		}
-		if p.MD5 != "" {
-			log.Printf("MD5 string of part Id %d does not match stored MD5sum. Retrying.", p.PartId)
-		}
-
+		st.stats.checksumMismatches.Add(1)
+		st.stats.recent.add(fmt.Sprintf("%s part %d checksum mismatch", p.FileName, p.PartId))
+		checksumType := "md5"
 		if p.ChecksumType != "" {
-			log.Printf("Checkum %s of part Id %d does not match stored checksum. Retrying.", p.ChecksumType, p.PartId)
+			checksumType = p.ChecksumType
 		}
+		slog.Warn("checksum mismatch, retrying",
+			append(partAttrs(p), "checksum_type", checksumType, "attempt", i+1)...)
 	}
 
 	return fmt.Errorf("MD5 checksum mismatch for part %d url=%s. Gave up after %d attempts",
@@ -773,9 +990,10 @@ func (st *State) createURL(p DBPart, urls map[string]DXDownloadURL, httpClient *
 		fmt.Sprintf("%s/download", p.fileId()),
 		payload)
 	check(err)
+	st.stats.urlGenerations.Add(1)
 
 	if err := json.Unmarshal(body, &u); err != nil {
-		log.Printf(err.Error())
+		slog.Error("could not unmarshal download URL", "file_id", p.fileId(), "error", err)
 		panic("Could not unmarshal response from dnanexus for download URL")
 	}
 
@@ -790,6 +1008,11 @@ func (st *State) preauthUrlsWorker(jobs <-chan JobInfo, jobsWithUrls chan JobInf
 	urls := make(map[string]DXDownloadURL)
 
 	for j := range jobs {
+		if st.stopRequested() {
+			// the workers drop the remaining jobs, no need for URLs
+			jobsWithUrls <- j
+			continue
+		}
 		switch j.part.(type) {
 		case DBPartRegular:
 			p := j.part.(DBPartRegular)
@@ -821,18 +1044,59 @@ func (st *State) worker(id int, jobsWithUrls <-chan JobInfo, jobsDbUpdate chan J
 	// Create one http client per worker. This should, hopefully, allow
 	// caching open TCP/HTTP connections, reducing startup times.
 	httpClient := NewHttpClient()
-	memoryBuf := make([]byte, st.maxChunkSize)
+	httpClient.Transport = &monitoredTransport{
+		base: &throttledTransport{
+			base:    httpClient.Transport,
+			limiter: st.limiter,
+		},
+		stats: st.stats,
+	}
+
+	for {
+		// wait until this worker is allowed to run
+		memoryBuf := st.gate.acquire()
+		j, ok := <-jobsWithUrls
+		if !ok {
+			st.gate.release(memoryBuf)
+			break
+		}
+		if st.stopRequested() {
+			// drain the queue without downloading
+			st.gate.release(memoryBuf)
+			continue
+		}
+		st.activity.set(id, j.part)
 
-	for j := range jobsWithUrls {
+		var err error
+		start := time.Now()
 		switch j.part.(type) {
 		case DBPartRegular:
 			p := j.part.(DBPartRegular)
-			st.downloadRegPart(httpClient, p, *j.url, memoryBuf)
+			err = st.downloadRegPart(httpClient, p, *j.url, memoryBuf)
 
 		case DBPartSymlink:
 			pLnk := j.part.(DBPartSymlink)
-			st.downloadSymlinkPart(httpClient, pLnk, *j.url, memoryBuf)
+			err = st.downloadSymlinkPart(httpClient, pLnk, *j.url, memoryBuf)
 		}
+		st.gate.release(memoryBuf)
+		st.activity.clear(id)
+
+		if err != nil {
+			// Leave the part incomplete in the database, it will be
+			// retried the next time the download command is issued.
+			st.stats.failedParts.Add(1)
+			slog.Error("failed to download part",
+				append(partAttrs(j.part), "host", urlHost(j.url.URL), "duration", time.Since(start), "error", err)...)
+			st.stats.recent.add(fmt.Sprintf("%s part %d failed", j.part.fileName(), partId(j.part)))
+			st.hooks.partFailed(j.part, err)
+			if staging, ok := st.sink.(stagingSink); ok {
+				staging.partFailed(j.part)
+			}
+			continue
+		}
+
+		slog.Debug("downloaded part",
+			append(partAttrs(j.part), "size", j.part.size(), "worker", id, "duration", time.Since(start))...)
 
 		// move the jobs to the next phase, which is updating the database
 		j.completeNs = time.Now().UnixNano()
@@ -846,24 +1110,39 @@ func (st *State) dbApplyBulkUpdates(completedJobs []JobInfo) {
 		return
 	}
 	st.mutex.Lock()
-	defer st.mutex.Unlock()
-
 	txn, err := st.db.Begin()
 	check(err)
-	defer txn.Commit()
 
 	for _, j := range completedJobs {
 		st.updateDBPart(txn, j.part, j.completeNs)
+		st.stats.partsComplete.Add(1)
+		st.stats.bytesComplete.Add(int64(j.part.size()))
+		st.stats.lastCompleteNs.Store(j.completeNs)
+	}
+	err = txn.Commit()
+	check(err)
+
+	var files []completedFile
+	if st.trackFileCompletion() {
+		files, err = st.completedFilesLocked(completedJobs)
+		check(err)
+	}
+	st.mutex.Unlock()
+
+	for _, f := range files {
+		st.fileCompleted(f)
 	}
 }
 
 // update the database when a job completes
-// Do this in bulk
+// Do this in bulk, without holding back completed jobs when no others
+// are waiting: a tar output may wait for them before more files are
+// handed out.
 func (st *State) dbUpdateWorker(jobsDbUpdate <-chan JobInfo, wg *sync.WaitGroup) {
 	var accu []JobInfo
 	for j := range jobsDbUpdate {
 		accu = append(accu, j)
-		if len(accu) == 10 {
+		if len(accu) == 10 || len(jobsDbUpdate) == 0 {
 			st.dbApplyBulkUpdates(accu)
 			accu = make([]JobInfo, 0)
 		}
@@ -873,76 +1152,148 @@ func (st *State) dbUpdateWorker(jobsDbUpdate <-chan JobInfo, wg *sync.WaitGroup)
 	wg.Done()
 }
 
-// Download all the files that are mentioned in the manifest.
-func (st *State) DownloadManifestDB(fname string) {
-	if st.opts.Verbose {
-		log.Printf("DownloadManifestDB %s\n", fname)
-	}
+// Download all the files that are mentioned in the manifest. Parts that
+// could not be downloaded are left incomplete, and an error is returned.
+func (st *State) DownloadManifestDB(fname string) (err error) {
+	slog.Debug("download manifest", "manifest", fname)
+	// the caller reports the error, it is logged here
+	defer func() {
+		if err != nil {
+			slog.Error("download failed", "error", err)
+		}
+	}()
 	st.timeOfLastError = time.Now().Second()
+	st.stopCh = make(chan struct{})
+	st.stopOnce = sync.Once{}
+	st.stats.failedParts.Store(0)
 
-	// build a job-channel that will hold all the parts. If we make it too small,
-	// we will block before creating the worker threads.
-	cntReg := st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_regular_stats WHERE bytes_fetched != size")
-	cntSlnk := st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_symlink_stats WHERE bytes_fetched != size")
-	totNumJobs := cntReg + cntSlnk
-	jobs := make(chan JobInfo, totNumJobs)
+	st.hooks, err = newHookRunner(st.opts, fname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// reported with the other errors, if the hooks were not closed
+		// at the end of the download
+		err = errors.Join(err, st.hooks.close())
+	}()
 
-	// create a job for each incomplete data file part
-	rows, err := st.db.Query("SELECT * FROM manifest_regular_stats WHERE bytes_fetched != size")
-	check(err)
+	st.checksums, err = newFileChecksummer(st)
+	if err != nil {
+		return err
+	}
+	defer st.checksums.close()
 
-	numRows := 0
-	for rows.Next() {
-		var p DBPartRegular
-		err := rows.Scan(&p.FileId, &p.Project, &p.FileName, &p.Folder, &p.PartId, &p.Offset,
-			&p.Size, &p.MD5, &p.BytesFetched, &p.DownloadDoneTime, &p.ChecksumType, &p.Checksum)
-		check(err)
-		j := JobInfo{
-			part: p,
-			url:  nil,
-		}
-		jobs <- j
-		numRows++
+	st.provenance, err = newProvenanceWriter(st)
+	if err != nil {
+		return err
 	}
-	rows.Close()
-	if st.opts.Verbose {
-		log.Printf("There are %d regular file pieces\n", numRows)
+	st.metadata = newFileMetadata(st)
+	st.duplicates, err = newDuplicateLinker(st)
+	if err != nil {
+		return err
+	}
+	st.cache, err = newContentCache(st)
+	if err != nil {
+		return fmt.Errorf("could not open the cache in %s: %w", st.opts.CacheDir, err)
+	}
+	defer st.cache.close()
+	if err := st.recordLocalPaths(); err != nil {
+		return err
+	}
+	// last, since it depends on the other options
+	st.sink, err = newOutputSink(st)
+	if err != nil {
+		return err
+	}
+	defer st.sink.close()
+	if perPart := st.sink.memoryPerPart(); perPart > 0 {
+		// each thread also keeps a whole part in memory
+		limit := int((memorySizeBytes() - GiB) / st.memoryPerThread())
+		if limit < minNumThreads {
+			limit = minNumThreads
+		}
+		if st.opts.NumThreads > limit {
+			PrintLogAndOut("Using %d threads, since each keeps a part of up to %s in memory until it is written out\n",
+				limit, diskSpaceString(perPart))
+			st.opts.NumThreads = limit
+		}
 	}
 
-	// create a job for each imcomplete data symlink part
-	rows, err = st.db.Query("SELECT * FROM manifest_symlink_stats WHERE bytes_fetched != size")
-	check(err)
+	// In adaptive mode, start the largest number of workers we may need.
+	// The gate limits how many of them are active at a time. It is set up
+	// before the metrics are served, as they report on it.
+	st.gate = newWorkerGate(st.opts.NumThreads, st.maxChunkSize)
+	st.activity = newWorkerActivity()
+	st.numWorkers = st.opts.NumThreads
+	if st.opts.AdaptiveThreads || st.opts.ControlAddr != "" {
+		// the number of threads may be raised while downloading
+		st.numWorkers = st.maxAdaptiveThreads()
+	}
 
-	for rows.Next() {
-		var p DBPartSymlink
-		err = rows.Scan(&p.FileId, &p.Project, &p.FileName, &p.Folder, &p.PartId, &p.Offset,
-			&p.Size, &p.BytesFetched, &p.DownloadDoneTime)
-		check(err)
-		j := JobInfo{
-			part: p,
-			url:  nil,
+	if st.opts.MetricsAddr != "" {
+		metricsServer, err := st.serveMetrics(st.opts.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("could not serve metrics on %s: %w", st.opts.MetricsAddr, err)
 		}
-		jobs <- j
+		defer metricsServer.Close()
+	}
+	// a bad control address is reported before anything is downloaded
+	var controlListener net.Listener
+	if st.opts.ControlAddr != "" {
+		controlListener, err = listenControl(st.opts.ControlAddr)
+		if err != nil {
+			return fmt.Errorf("could not serve the control API on %s: %w", st.opts.ControlAddr, err)
+		}
+		defer controlListener.Close()
 	}
-	rows.Close()
 
-	// Close the job channel, there will be no more jobs.
-	close(jobs)
+	// Queue the files with incomplete parts, in the order chosen by the user.
+	// The parts themselves are streamed from the database into bounded
+	// channels, so that the download starts right away and memory use does
+	// not depend on the size of the manifest. Databases created by older
+	// versions are indexed once.
+	order := st.downloadOrder()
+	err = st.createPartIndexes()
+	check(err)
+	err = st.buildDownloadQueue(order)
+	check(err)
+	slog.Debug("download queue built", "order", order)
+	if err := st.duplicates.createPending(); err != nil {
+		return err
+	}
+	if err := st.restoreFromCache(); err != nil {
+		return err
+	}
+	if err := st.seedFromDir(); err != nil {
+		return err
+	}
+
+	jobs := make(chan JobInfo, jobQueueSize)
+	go st.jobsProducer(jobs)
 
 	// the preauth thread adds a valid URL to each job.
-	jobsWithUrls := make(chan JobInfo, totNumJobs)
+	jobsWithUrls := make(chan JobInfo, jobQueueSize)
 	go st.preauthUrlsWorker(jobs, jobsWithUrls, &st.dxEnv)
 
 	// the db-update thread updates the database when jobs
 	// complete.
 	var wgDb sync.WaitGroup
-	jobsDbUpdate := make(chan JobInfo, totNumJobs)
+	jobsDbUpdate := make(chan JobInfo, jobQueueSize)
 	wgDb.Add(1)
 	go st.dbUpdateWorker(jobsDbUpdate, &wgDb)
 
+	// apply the bandwidth limits, and follow the schedule if there is one
+	stopScheduler := make(chan struct{})
+	go st.bandwidthScheduler(stopScheduler)
+
 	// start concurrent workers to download the file parts
+	stopAdaptive := make(chan struct{})
+	if st.opts.AdaptiveThreads {
+		go st.adaptiveConcurrency(st.gate, stopAdaptive)
+	}
+
 	var wgDownload sync.WaitGroup
-	for w := 1; w <= st.opts.NumThreads; w++ {
+	for w := 1; w <= st.numWorkers; w++ {
 		wgDownload.Add(1)
 		go st.worker(w, jobsWithUrls, jobsDbUpdate, &wgDownload)
 	}
@@ -950,22 +1301,79 @@ func (st *State) DownloadManifestDB(fname string) {
 	var wgProgressReport sync.WaitGroup
 	wgProgressReport.Add(1)
 	st.InitDownloadStatus()
-	go st.downloadProgressContinuous(&wgProgressReport)
+
+	// the control API reports on the download status, so it is served
+	// once the status is initialized
+	if controlListener != nil {
+		controlServer := st.serveControl(controlListener)
+		defer controlServer.Close()
+	}
+	progressDone := make(chan struct{})
+	if st.useTUI() {
+		go st.downloadProgressTUI(&wgProgressReport, progressDone)
+	} else {
+		go st.downloadProgressContinuous(&wgProgressReport, progressDone)
+	}
 
 	// wait for downloads to complete
 	wgDownload.Wait()
 	close(jobsDbUpdate)
+	close(stopScheduler)
+	close(stopAdaptive)
 
 	// wait for database updates to complete
 	wgDb.Wait()
 
 	// wait for progress report thread
+	close(progressDone)
 	wgProgressReport.Wait()
 
 	// completed all downloads
-	PrintLogAndOut(st.DownloadProgressOneTime(60*1000*1000*1000) + "\n")
+	if st.opts.ProgressFormat == ProgressFormatJSON {
+		fmt.Fprintln(st.progressStream(), st.DownloadProgressOneTime(60*1000*1000*1000))
+	} else {
+		PrintLogAndOut(st.DownloadProgressOneTime(60*1000*1000*1000) + "\n")
+	}
+	// write out the files left, the error is reported once the failed
+	// parts are
+	sinkErr := st.sink.close()
+	// the metadata and provenance of the files downloaded so far, even if
+	// some failed
+	if st.sink.keepsFiles() {
+		if err := st.metadata.applyAll(); err != nil {
+			return fmt.Errorf("could not set the times and modes of the files: %w", err)
+		}
+	}
+	if err := st.provenance.writeAll(); err != nil {
+		return fmt.Errorf("could not write the provenance of the files: %w", err)
+	}
+	if numFailed := st.stats.failedParts.Load(); numFailed > 0 {
+		return fmt.Errorf("%d parts could not be downloaded, see the log for details. Please re-issue the download command to retry them", numFailed)
+	}
+	if sinkErr != nil {
+		return fmt.Errorf("could not write the output: %w", sinkErr)
+	}
+	if st.stopRequested() {
+		PrintLogAndOut("Download stopped on request. Re-issue the download command to resume.\n")
+		return nil
+	}
+	if err := st.checksums.export(); err != nil {
+		return fmt.Errorf("could not write the file checksums: %w", err)
+	}
+	if st.IsBag() {
+		if err := st.WriteBag(); err != nil {
+			return fmt.Errorf("could not write the bag: %w", err)
+		}
+		PrintLogAndOut("The download is laid out as a BagIt bag, with the files in the %s directory.\n", bagPayloadDir)
+	}
+	st.hooks.manifestComplete(st.numManifestFiles(), st.ds.NumBytes)
+	// anything relying on the hooks misses the dropped events
+	if err := st.hooks.close(); err != nil {
+		return err
+	}
 	PrintLogAndOut("Download completed successfully.\n")
 	PrintLogAndOut("To perform additional post-download integrity checks, please use the 'inspect' subcommand.\n")
+	return nil
 }
 
 // UpdateDBPart.
@@ -997,9 +1405,9 @@ func (st *State) resetDBPart(p DBPartRegular) {
 	check(err)
 	defer tx.Commit()
 
-	_, err = tx.Exec(fmt.Sprintf(
-		"UPDATE manifest_regular_stats SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = '%s' AND part_id = '%d'",
-		p.FileId, p.PartId))
+	_, err = tx.Exec(
+		"UPDATE manifest_regular_stats SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = ? AND folder = ? AND name = ? AND part_id = ?",
+		p.FileId, p.Folder, p.FileName, p.PartId)
 	check(err)
 }
 
@@ -1011,10 +1419,7 @@ func (st *State) resetRegularFile(p DBPartRegular) {
 	check(err)
 	folder := filepath.Join(wd, p.Folder)
 	fname := filepath.Join(folder, p.FileName)
-	err = os.Truncate(fname, 0)
-	if !os.IsNotExist(err) {
-		check(err)
-	}
+	check(emptyFile(fname))
 
 	st.mutex.Lock()
 	defer st.mutex.Unlock()
@@ -1023,9 +1428,9 @@ func (st *State) resetRegularFile(p DBPartRegular) {
 	check(err)
 	defer tx.Commit()
 
-	_, err = tx.Exec(fmt.Sprintf(
-		"UPDATE manifest_regular_stats SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = '%s'",
-		p.FileId))
+	_, err = tx.Exec(
+		"UPDATE manifest_regular_stats SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = ? AND folder = ? AND name = ?",
+		p.FileId, p.Folder, p.FileName)
 	check(err)
 }
 
@@ -1037,10 +1442,7 @@ func (st *State) resetSymlinkFile(slnk DXFileSymlink) {
 	check(err)
 	folder := filepath.Join(wd, slnk.Folder)
 	fname := filepath.Join(folder, slnk.Name)
-	err = os.Truncate(fname, 0)
-	if !os.IsNotExist(err) {
-		check(err)
-	}
+	check(emptyFile(fname))
 	st.mutex.Lock()
 	defer st.mutex.Unlock()
 
@@ -1048,24 +1450,37 @@ func (st *State) resetSymlinkFile(slnk DXFileSymlink) {
 	check(err)
 	defer tx.Commit()
 
-	_, err = tx.Exec(fmt.Sprintf(
-		"UPDATE manifest_symlink_stats SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = '%s'",
-		slnk.Id))
+	_, err = tx.Exec(
+		"UPDATE manifest_symlink_stats SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = ? AND folder = ? AND name = ?",
+		slnk.Id, slnk.Folder, slnk.Name)
 	check(err)
 }
 
 // -----------------------------------------
 // inspect: validation of downloaded parts
+//
+// The checks only report problems. Resetting the parts that failed, so
+// they are downloaded again, is done separately, see repair.go.
 
 // check that a database part has the correct md5 checksum
-func (st *State) checkDBPartRegular(p DBPartRegular, integrityMsgs chan string) {
+func (st *State) checkDBPartRegular(p DBPartRegular, integrityMsgs chan integrityResult) {
+	result := integrityResult{
+		kind:         0,
+		fileId:       p.FileId,
+		folder:       p.Folder,
+		name:         p.FileName,
+		partId:       p.PartId,
+		checksumType: p.ChecksumType,
+	}
+	if p.ChecksumType == "" && p.MD5 != "" {
+		result.checksumType = "MD5"
+	}
+
 	fname := fmt.Sprintf(".%s/%s", p.Folder, p.FileName)
 	if _, err := os.Stat(fname); os.IsNotExist(err) {
-		st.resetRegularFile(p)
-		msg := fmt.Sprintf(
+		integrityMsgs <- result.with(statusMissing, fmt.Sprintf(
 			"File %s does not exist. Please re-issue the download command to resolve.",
-			fname)
-		integrityMsgs <- msg
+			fname))
 		return
 	}
 
@@ -1076,62 +1491,64 @@ func (st *State) checkDBPartRegular(p DBPartRegular, integrityMsgs chan string)
 	// limit the file-descriptor to read only this part. Start at the beginning
 	// of the part, and read [part-size] bytes.
 	if _, err := localf.Seek(p.Offset, 0); err != nil {
-		integrityMsgs <- fmt.Sprintf("Error seeking %s to %d %s", fname, p.Offset, err.Error())
+		integrityMsgs <- result.with(statusMismatch, fmt.Sprintf("Error seeking %s to %d %s", fname, p.Offset, err.Error()))
 		return
 	}
 	partReader := io.LimitReader(localf, int64(p.Size))
 
 	if p.MD5 == "" && p.ChecksumType == "" {
-		msg := fmt.Sprintf(
+		integrityMsgs <- result.with(statusUnverifiable, fmt.Sprintf(
 			"No checksum type nor MD5 available for %s part %d. Cannot verify integrity.",
-			p.FileName, p.PartId)
-		integrityMsgs <- msg
+			p.FileName, p.PartId))
+		return
 	}
 
 	if p.MD5 != "" {
 		hasher := md5.New()
 		if _, err := io.Copy(hasher, partReader); err != nil {
-			st.resetDBPart(p)
-			integrityMsgs <- fmt.Sprintf("Error reading %s %s", fname, err.Error())
+			integrityMsgs <- result.with(statusMismatch, fmt.Sprintf("Error reading %s %s", fname, err.Error()))
 			return
 		}
 		diskSum := hex.EncodeToString(hasher.Sum(nil))
 
 		if diskSum != p.MD5 {
-			st.resetDBPart(p)
-			msg := fmt.Sprintf(
+			result.checksumType = "MD5"
+			result.expected = p.MD5
+			result.computed = diskSum
+			integrityMsgs <- result.with(statusMismatch, fmt.Sprintf(
 				"Identified md5sum mismatch for %s part %d. Please re-issue the download command to resolve.",
-				p.FileName, p.PartId)
-			integrityMsgs <- msg
+				p.FileName, p.PartId))
+			return
 		}
 	}
 
 	if p.ChecksumType != "" {
 		data, err := io.ReadAll(partReader)
 		if err != nil {
-			st.resetDBPart(p)
-			integrityMsgs <- fmt.Sprintf("Error reading %s %s", fname, err.Error())
+			integrityMsgs <- result.with(statusMismatch, fmt.Sprintf("Error reading %s %s", fname, err.Error()))
+			return
 		}
 
 		calculatedChecksum, err := CalculateChecksum(p.ChecksumType, data)
 		if err != nil {
-			msg := fmt.Sprintf("Unsupported checksum type %s for %s part %d",
-				p.ChecksumType, p.FileName, p.PartId)
-			integrityMsgs <- msg
+			integrityMsgs <- result.with(statusUnverifiable, fmt.Sprintf("Unsupported checksum type %s for %s part %d",
+				p.ChecksumType, p.FileName, p.PartId))
 			return
 		}
 
 		if calculatedChecksum != p.Checksum {
-			st.resetDBPart(p)
-			msg := fmt.Sprintf(
+			result.expected = p.Checksum
+			result.computed = calculatedChecksum
+			integrityMsgs <- result.with(statusMismatch, fmt.Sprintf(
 				"Identified %s checksum mismatch for %s part %d. Please re-issue the download command to resolve.",
-				p.ChecksumType, p.FileName, p.PartId)
-			integrityMsgs <- msg
+				p.ChecksumType, p.FileName, p.PartId))
+			return
 		}
 	}
+	integrityMsgs <- result.with(statusOK, "")
 }
 
-func (st *State) filePartIntegrityWorker(id int, jobs <-chan JobInfo, integrityMsgs chan string, wg *sync.WaitGroup) {
+func (st *State) filePartIntegrityWorker(id int, jobs <-chan JobInfo, integrityMsgs chan integrityResult, wg *sync.WaitGroup) {
 	for j := range jobs {
 		switch j.part.(type) {
 		case DBPartRegular:
@@ -1144,11 +1561,21 @@ func (st *State) filePartIntegrityWorker(id int, jobs <-chan JobInfo, integrityM
 	wg.Done()
 }
 
-func (st *State) validateSymlinkChecksum(f DXFileSymlink, integrityMsgs chan string) {
+func (st *State) validateSymlinkChecksum(f DXFileSymlink, integrityMsgs chan integrityResult) {
+	result := integrityResult{
+		kind:         1,
+		fileId:       f.Id,
+		folder:       f.Folder,
+		name:         f.Name,
+		checksumType: "MD5",
+		expected:     f.MD5,
+	}
+
 	fname := fmt.Sprintf(".%s/%s", f.Folder, f.Name)
 	if _, err := os.Stat(fname); os.IsNotExist(err) {
-		st.resetSymlinkFile(f)
-		fmt.Printf("File %s does not exist. Please re-issue the download command to resolve.", fname)
+		integrityMsgs <- result.with(statusMissing, fmt.Sprintf(
+			"File %s does not exist. Please re-issue the download command to resolve.",
+			fname))
 		return
 	}
 
@@ -1163,17 +1590,18 @@ func (st *State) validateSymlinkChecksum(f DXFileSymlink, integrityMsgs chan str
 	// This is supposed to NOT load the entire file into memory.
 	hasher := md5.New()
 	if _, err := io.Copy(hasher, localf); err != nil {
-		st.resetSymlinkFile(f)
-		integrityMsgs <- fmt.Sprintf("Error reading %s %s", fname, err.Error())
+		integrityMsgs <- result.with(statusMismatch, fmt.Sprintf("Error reading %s %s", fname, err.Error()))
 		return
 	}
 	diskSum := hex.EncodeToString(hasher.Sum(nil))
+	result.computed = diskSum
 
 	if diskSum == f.MD5 {
 		if st.opts.Verbose {
 			fmt.Printf("symlink file %s, has the correct checksum %s\n",
 				f.Name, f.MD5)
 		}
+		integrityMsgs <- result.with(statusOK, "")
 	} else {
 		msg := fmt.Sprintf(`
 Identified md5sum mismatch for symbolic link
@@ -1182,36 +1610,40 @@ Identified md5sum mismatch for symbolic link
     checksum  %s
 Please re-issue the download command to resolve`,
 			f.Name, f.Id, f.MD5)
-		integrityMsgs <- msg
-		st.resetSymlinkFile(f)
+		integrityMsgs <- result.with(statusMismatch, msg)
 	}
 }
 
-// make sure all the part checksums are correct on disk.
-func (st *State) checkAllRegularFileIntegrity() bool {
-	cnt := st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_regular_stats WHERE bytes_fetched == size")
-	if cnt == 0 {
-		fmt.Printf("%d regular file parts to check\n", cnt)
-		return true
-	}
-	jobs := make(chan JobInfo, cnt)
-	integrityMsgs := make(chan string, cnt)
-	var wg sync.WaitGroup
-
+// make sure all the part checksums are correct on disk. Files in the
+// skip set are not checked.
+func (st *State) checkAllRegularFileIntegrity(skip map[inspectKey]fileVerification) []integrityResult {
 	rows, err := st.db.Query("SELECT * FROM manifest_regular_stats WHERE bytes_fetched == size")
 	check(err)
 
+	var parts []DBPartRegular
 	for rows.Next() {
 		var p DBPartRegular
 		err = rows.Scan(&p.FileId, &p.Project, &p.FileName, &p.Folder, &p.PartId, &p.Offset,
 			&p.Size, &p.MD5, &p.BytesFetched, &p.DownloadDoneTime, &p.ChecksumType, &p.Checksum)
 		check(err)
-		j := JobInfo{
-			part: p,
+		if _, ok := skip[inspectKey{0, p.FileId, p.Folder, p.FileName}]; ok {
+			continue
 		}
-		jobs <- j
+		parts = append(parts, p)
 	}
 	rows.Close()
+
+	cnt := len(parts)
+	if cnt == 0 {
+		fmt.Printf("%d regular file parts to check\n", cnt)
+		return nil
+	}
+	jobs := make(chan JobInfo, cnt)
+	integrityMsgs := make(chan integrityResult, cnt)
+	var wg sync.WaitGroup
+	for _, p := range parts {
+		jobs <- JobInfo{part: p}
+	}
 	close(jobs)
 
 	for w := 1; w <= st.opts.NumThreads; w++ {
@@ -1222,22 +1654,23 @@ func (st *State) checkAllRegularFileIntegrity() bool {
 	close(integrityMsgs)
 
 	// read all the integrity messages
+	var results []integrityResult
 	numIntegrityErrors := 0
-	for msg := range integrityMsgs {
-		fmt.Println(msg)
-		numIntegrityErrors++
+	for r := range integrityMsgs {
+		results = append(results, r)
+		if r.status != statusOK {
+			fmt.Println(r.msg)
+			numIntegrityErrors++
+		}
 	}
-	if numIntegrityErrors > 0 {
-		// there were errors, validation failed
-		return false
+	if numIntegrityErrors == 0 {
+		fmt.Println("")
+		fmt.Println("Integrity check for regular files complete.")
 	}
-
-	fmt.Println("")
-	fmt.Println("Integrity check for regular files complete.")
-	return true
+	return results
 }
 
-func (st *State) fileCheckSymlinkWorker(id int, jobs <-chan DXFileSymlink, integrityMsgs chan string, wg *sync.WaitGroup) {
+func (st *State) fileCheckSymlinkWorker(id int, jobs <-chan DXFileSymlink, integrityMsgs chan integrityResult, wg *sync.WaitGroup) {
 	for j := range jobs {
 		// 1. calculate the MD5 checksum of the entire file.
 		// 2. compare it to the expected result
@@ -1246,7 +1679,7 @@ func (st *State) fileCheckSymlinkWorker(id int, jobs <-chan DXFileSymlink, integ
 	wg.Done()
 }
 
-func (st *State) checkAllSymlinkIntegrity() bool {
+func (st *State) checkAllSymlinkIntegrity(skip map[inspectKey]fileVerification) []integrityResult {
 	rows, err := st.db.Query("SELECT * FROM symlinks")
 	check(err)
 
@@ -1259,7 +1692,7 @@ func (st *State) checkAllSymlinkIntegrity() bool {
 	}
 	rows.Close()
 	if len(allSymlinks) == 0 {
-		return true
+		return nil
 	}
 
 	// skip files that weren't entirely downloaded
@@ -1271,17 +1704,20 @@ func (st *State) checkAllSymlinkIntegrity() bool {
 		if numBytesComplete < slnk.Size {
 			continue
 		}
+		if _, ok := skip[inspectKey{1, slnk.Id, slnk.Folder, slnk.Name}]; ok {
+			continue
+		}
 		completed = append(completed, slnk)
 	}
 	numSymlinksCompleted := len(completed)
 	fmt.Printf("%d symlinks %d have completed downloading\n",
 		len(allSymlinks), numSymlinksCompleted)
 	if numSymlinksCompleted == 0 {
-		return true
+		return nil
 	}
 
 	jobs := make(chan DXFileSymlink, numSymlinksCompleted)
-	integrityMsgs := make(chan string, numSymlinksCompleted)
+	integrityMsgs := make(chan integrityResult, numSymlinksCompleted)
 	var wg sync.WaitGroup
 
 	// Create a job to verify all of the symlinks.
@@ -1303,32 +1739,24 @@ func (st *State) checkAllSymlinkIntegrity() bool {
 	close(integrityMsgs)
 
 	// read all the integrity messages
+	var results []integrityResult
 	numIntegrityErrors := 0
-	for msg := range integrityMsgs {
-		fmt.Println(msg)
-		numIntegrityErrors++
+	for r := range integrityMsgs {
+		results = append(results, r)
+		if r.status != statusOK {
+			fmt.Println(r.msg)
+			numIntegrityErrors++
+		}
 	}
-	if numIntegrityErrors > 0 {
-		// there were errors, validation failed
-		return false
+	if numIntegrityErrors == 0 {
+		fmt.Println("")
+		fmt.Println("Integrity check for symlinks complete.")
 	}
-	fmt.Println("")
-	fmt.Println("Integrity check for symlinks complete.")
-	return true
+	return results
 }
 
 // check the on-disk integrity of all files
 // return false if there is an integrity problem.
 func (st *State) CheckFileIntegrity() bool {
-	// regular files
-	if !st.checkAllRegularFileIntegrity() {
-		return false
-	}
-
-	// symlinks
-	if !st.checkAllSymlinkIntegrity() {
-		return false
-	}
-
-	return true
+	return st.Inspect().OK()
 }
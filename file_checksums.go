@@ -0,0 +1,513 @@
+package dxda
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Whole file checksums, in the formats of the md5sum and sha256sum tools.
+// The part checksums in the manifest cannot be compared with these, so
+// they are computed from the downloaded files, verifying the parts on the
+// way.
+const (
+	FileChecksumMD5    = "md5"
+	FileChecksumSHA256 = "sha256"
+)
+
+// Where the whole file checksums are written
+const (
+	// A file next to each downloaded file, named after it, with the
+	// algorithm as extension: sample.bam.md5
+	ChecksumFormatSidecar = "sidecar"
+
+	// A single file in the download directory for each algorithm, MD5SUMS
+	// or SHA256SUMS, listing all the downloaded files
+	ChecksumFormatManifest = "manifest"
+)
+
+const checksumQueueSize = 1024
+
+// ParseFileChecksums checks a comma separated list of algorithms
+func ParseFileChecksums(s string) ([]string, error) {
+	var algs []string
+	for _, alg := range strings.Split(s, ",") {
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		switch alg {
+		case FileChecksumMD5, FileChecksumSHA256:
+			algs = append(algs, alg)
+		default:
+			return nil, fmt.Errorf("unsupported checksum algorithm %q, expected %s or %s",
+				alg, FileChecksumMD5, FileChecksumSHA256)
+		}
+	}
+	return algs, nil
+}
+
+// ValidateChecksumFormat checks that a checksum output format is supported
+func ValidateChecksumFormat(format string) error {
+	switch format {
+	case "", ChecksumFormatSidecar, ChecksumFormatManifest:
+		return nil
+	}
+	return fmt.Errorf("unsupported checksum format %q, expected %s or %s",
+		format, ChecksumFormatSidecar, ChecksumFormatManifest)
+}
+
+func newFileHasher(alg string) hash.Hash {
+	if alg == FileChecksumSHA256 {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+// Name of the checksum manifest for an algorithm, as written by coreutils
+// users by convention
+func checksumManifestName(alg string) string {
+	return strings.ToUpper(alg) + "SUMS"
+}
+
+// A line in the format read by md5sum -c and sha256sum -c. Names with a
+// backslash or a newline are escaped, and the line starts with a backslash.
+func checksumLine(sum, name string) string {
+	if strings.ContainsAny(name, "\\\n") {
+		name = strings.ReplaceAll(name, "\\", "\\\\")
+		name = strings.ReplaceAll(name, "\n", "\\n")
+		return "\\" + sum + "  " + name + "\n"
+	}
+	return sum + "  " + name + "\n"
+}
+
+// Compute the whole file checksums of a downloaded file. The file is read
+// once, and each part is verified against the manifest as it goes by.
+func fileDigests(f completedFile, algs []string) (map[string]string, error) {
+	return fileDigestsAt(f.path(), f, algs)
+}
+
+// Same as fileDigests, for a copy of the file at another path
+func fileDigestsAt(path string, f completedFile, algs []string) (map[string]string, error) {
+	localf, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer localf.Close()
+
+	hashers := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, alg := range algs {
+		hashers[alg] = newFileHasher(alg)
+		writers = append(writers, hashers[alg])
+	}
+	whole := io.MultiWriter(writers...)
+
+	var size int64
+	if f.kind == 0 {
+		for _, p := range f.parts {
+			data := make([]byte, p.Size)
+			if _, err := io.ReadFull(localf, data); err != nil {
+				return nil, fmt.Errorf("reading part %d: %w", p.PartId, err)
+			}
+			if p.MD5 != "" {
+				sum := md5.Sum(data)
+				if hex.EncodeToString(sum[:]) != p.MD5 {
+					return nil, fmt.Errorf("md5 checksum mismatch for part %d", p.PartId)
+				}
+			}
+			if p.ChecksumType != "" {
+				sum, err := CalculateChecksum(p.ChecksumType, data)
+				if err == nil && sum != p.Checksum {
+					return nil, fmt.Errorf("%s checksum mismatch for part %d", p.ChecksumType, p.PartId)
+				}
+			}
+			whole.Write(data)
+			size += int64(p.Size)
+		}
+	} else {
+		fileMD5 := md5.New()
+		n, err := io.Copy(io.MultiWriter(whole, fileMD5), localf)
+		if err != nil {
+			return nil, err
+		}
+		if f.md5 != "" && hex.EncodeToString(fileMD5.Sum(nil)) != f.md5 {
+			return nil, fmt.Errorf("md5 checksum mismatch")
+		}
+		size = n
+	}
+
+	fi, err := localf.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != size {
+		return nil, fmt.Errorf("file has %d bytes, expected %d", fi.Size(), size)
+	}
+
+	digests := make(map[string]string)
+	for alg, h := range hashers {
+		digests[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// Whole file checksums are kept in the database, with the state of the
+// file when they were computed, so that they are only computed again if
+// the file changes.
+func (st *State) createFileChecksumsTable() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS file_checksums (
+		kind      integer,
+		file_id   text,
+		folder    text,
+		name      text,
+		algorithm text,
+		checksum  text,
+		size      integer,
+		mtime     integer,
+		inode     integer,
+		PRIMARY KEY (kind, file_id, folder, name, algorithm)
+	);
+	`)
+	return err
+}
+
+// The checksums of a file computed earlier, if the file has not changed
+func (st *State) cachedFileDigests(f completedFile, algs []string, s fileVerification) map[string]string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	digests := make(map[string]string)
+	for _, alg := range algs {
+		var sum string
+		var cached fileVerification
+		var inode int64
+		err := st.db.QueryRow(`
+			SELECT checksum, size, mtime, inode FROM file_checksums
+			WHERE kind = ? AND file_id = ? AND folder = ? AND name = ? AND algorithm = ?`,
+			f.kind, f.fileId, f.folder, f.name, alg).Scan(&sum, &cached.size, &cached.mtimeNs, &inode)
+		cached.inode = uint64(inode)
+		if err != nil || !cached.sameFile(s) {
+			return nil
+		}
+		digests[alg] = sum
+	}
+	return digests
+}
+
+func (st *State) storeFileDigests(f completedFile, digests map[string]string, s fileVerification) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for alg, sum := range digests {
+		_, err := st.db.Exec("INSERT OR REPLACE INTO file_checksums VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			f.kind, f.fileId, f.folder, f.name, alg, sum, s.size, s.mtimeNs, int64(s.inode))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The checksums of a file, computed unless they are known already
+func (st *State) wholeFileDigests(f completedFile, algs []string) (map[string]string, error) {
+	before, err := statFile(f.path())
+	if err != nil {
+		return nil, err
+	}
+	if digests := st.cachedFileDigests(f, algs, before); digests != nil {
+		return digests, nil
+	}
+	digests, err := fileDigests(f, algs)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.storeFileDigests(f, digests, before); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+func writeChecksumSidecars(f completedFile, digests map[string]string) error {
+	for alg, sum := range digests {
+		line := checksumLine(sum, f.name)
+		if err := os.WriteFile(f.path()+"."+alg, []byte(line), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether a path is one of the checksum files written for the manifest
+func isChecksumFile(path string, manifestPaths map[string]bool) bool {
+	for _, alg := range []string{FileChecksumMD5, FileChecksumSHA256} {
+		if path == checksumManifestName(alg) {
+			return true
+		}
+		if strings.HasSuffix(path, "."+alg) && manifestPaths[strings.TrimSuffix(path, "."+alg)] {
+			return true
+		}
+	}
+	return false
+}
+
+// All the files whose parts are completely downloaded
+func (st *State) completeFiles() ([]completedFile, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var files []completedFile
+	rows, err := st.db.Query("SELECT * FROM manifest_regular_stats ORDER BY file_id, folder, name, part_id")
+	if err != nil {
+		return nil, err
+	}
+	var cur *completedFile
+	incomplete := false
+	flush := func() {
+		if cur != nil && !incomplete {
+			files = append(files, *cur)
+		}
+	}
+	for rows.Next() {
+		var p DBPartRegular
+		err := rows.Scan(&p.FileId, &p.Project, &p.FileName, &p.Folder, &p.PartId, &p.Offset,
+			&p.Size, &p.MD5, &p.BytesFetched, &p.DownloadDoneTime, &p.ChecksumType, &p.Checksum)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if cur == nil || cur.fileId != p.FileId || cur.folder != p.Folder || cur.name != p.FileName {
+			flush()
+			cur = &completedFile{fileId: p.FileId, project: p.Project, folder: p.Folder, name: p.FileName}
+			incomplete = false
+		}
+		incomplete = incomplete || p.BytesFetched != p.Size
+		cur.parts = append(cur.parts, p)
+		cur.size += int64(p.Size)
+	}
+	flush()
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = st.db.Query(`
+		SELECT s.id, s.proj_id, s.folder, s.name, s.size, s.md5
+		FROM symlinks s JOIN manifest_symlink_stats p
+		ON p.file_id = s.id AND p.folder = s.folder AND p.name = s.name
+		GROUP BY s.id, s.folder, s.name HAVING MIN(p.bytes_fetched = p.size) = 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := completedFile{kind: 1}
+		if err := rows.Scan(&f.fileId, &f.project, &f.folder, &f.name, &f.size, &f.md5); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// A file with its whole file checksums
+type fileDigestResult struct {
+	f       completedFile
+	digests map[string]string
+}
+
+// Compute the checksums of files in parallel. Returns the files sorted by
+// path, and the paths of the files that failed verification.
+func (st *State) computeFileDigests(files []completedFile, algs []string) ([]fileDigestResult, []string) {
+	type result struct {
+		fileDigestResult
+		err error
+	}
+	jobs := make(chan completedFile, len(files))
+	results := make(chan result, len(files))
+	for _, f := range files {
+		jobs <- f
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for w := 0; w < max(st.opts.NumThreads, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				digests, err := st.wholeFileDigests(f, algs)
+				results <- result{fileDigestResult{f, digests}, err}
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var done []fileDigestResult
+	var failed []string
+	for r := range results {
+		if r.err != nil {
+			slog.Error("could not compute file checksums", "file_id", r.f.fileId, "path", r.f.path(), "error", r.err)
+			failed = append(failed, filepath.Join(".", r.f.folder, r.f.name))
+			continue
+		}
+		done = append(done, r.fileDigestResult)
+	}
+	sort.Strings(failed)
+	sort.Slice(done, func(i, j int) bool { return done[i].f.path() < done[j].f.path() })
+	return done, failed
+}
+
+// ChecksumExport summarizes the checksum files written for a manifest
+type ChecksumExport struct {
+	NumFiles      int      // files with checksums written
+	NumIncomplete int      // files not completely downloaded, left out
+	Failed        []string // files that failed verification, left out
+	Written       []string // checksum manifests written, for the manifest format
+}
+
+// ExportChecksums writes the whole file checksums of the downloaded files,
+// in the format given. Files that are not completely downloaded, or fail
+// verification, are left out.
+func (st *State) ExportChecksums(algs []string, format string) (*ChecksumExport, error) {
+	if err := st.createFileChecksumsTable(); err != nil {
+		return nil, err
+	}
+	files, err := st.completeFiles()
+	if err != nil {
+		return nil, err
+	}
+	export := &ChecksumExport{
+		NumIncomplete: int(st.numManifestFiles()) - len(files),
+	}
+
+	done, failed := st.computeFileDigests(files, algs)
+	export.Failed = failed
+	export.NumFiles = len(done)
+
+	if format == ChecksumFormatManifest {
+		for _, alg := range algs {
+			var sb strings.Builder
+			for _, r := range done {
+				sb.WriteString(checksumLine(r.digests[alg], filepath.ToSlash(filepath.Join(".", r.f.folder, r.f.name))))
+			}
+			fname := checksumManifestName(alg)
+			if err := os.WriteFile(fname, []byte(sb.String()), 0644); err != nil {
+				return export, err
+			}
+			export.Written = append(export.Written, fname)
+		}
+		return export, nil
+	}
+	for _, r := range done {
+		if err := writeChecksumSidecars(r.f, r.digests); err != nil {
+			return export, err
+		}
+	}
+	return export, nil
+}
+
+// Computes the checksums of files as they complete during a download, in
+// the background. The checksums are stored in the database, where the
+// export at the end of the download finds them.
+type fileChecksummer struct {
+	st     *State
+	algs   []string
+	format string
+	queue  chan completedFile
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// Start computing checksums during the download, if requested in the
+// options. Returns nil otherwise.
+func newFileChecksummer(st *State) (*fileChecksummer, error) {
+	if st.opts.FileChecksums == "" {
+		return nil, nil
+	}
+	algs, err := ParseFileChecksums(st.opts.FileChecksums)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateChecksumFormat(st.opts.ChecksumFormat); err != nil {
+		return nil, err
+	}
+	if err := st.createFileChecksumsTable(); err != nil {
+		return nil, err
+	}
+	fc := &fileChecksummer{
+		st:     st,
+		algs:   algs,
+		format: st.opts.ChecksumFormat,
+		queue:  make(chan completedFile, checksumQueueSize),
+	}
+	if fc.format == "" {
+		fc.format = ChecksumFormatSidecar
+	}
+	fc.wg.Add(1)
+	go fc.run()
+	return fc, nil
+}
+
+func (fc *fileChecksummer) add(f completedFile) {
+	if fc == nil {
+		return
+	}
+	fc.queue <- f
+}
+
+func (fc *fileChecksummer) run() {
+	defer fc.wg.Done()
+	for f := range fc.queue {
+		digests, err := fc.st.wholeFileDigests(f, fc.algs)
+		if err != nil {
+			slog.Error("could not compute file checksums, run the inspect command to check the file",
+				"file_id", f.fileId, "path", f.path(), "error", err)
+			continue
+		}
+		if fc.format == ChecksumFormatSidecar {
+			if err := writeChecksumSidecars(f, digests); err != nil {
+				slog.Error("could not write checksum files", "file_id", f.fileId, "path", f.path(), "error", err)
+			}
+		}
+	}
+}
+
+// Wait for the checksums of the queued files
+func (fc *fileChecksummer) close() {
+	if fc == nil {
+		return
+	}
+	fc.once.Do(func() {
+		close(fc.queue)
+		fc.wg.Wait()
+	})
+}
+
+// Once the download is complete, write the checksums of all the files,
+// including those downloaded by earlier runs.
+func (fc *fileChecksummer) export() error {
+	if fc == nil {
+		return nil
+	}
+	fc.close()
+	export, err := fc.st.ExportChecksums(fc.algs, fc.format)
+	if err != nil {
+		return err
+	}
+	if len(export.Failed) > 0 {
+		return fmt.Errorf("%d files failed verification, and have no checksums", len(export.Failed))
+	}
+	return nil
+}
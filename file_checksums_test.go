@@ -0,0 +1,118 @@
+package dxda
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportChecksums(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(3, 1000, 400)
+	manifest := testManifest(files[:2], "/data")
+	linkSum := md5.Sum(files[2].data)
+	manifest.Files = append(manifest.Files, DXFileSymlink{Folder: "/links", Id: files[2].id, ProjId: "project-test",
+		Name: files[2].name, Size: int64(len(files[2].data)), MD5: hex.EncodeToString(linkSum[:])})
+	// a file that is not downloaded yet
+	pending := makeTestFiles(4, 100, 100)[3]
+	manifest.Files = append(manifest.Files, pending.manifestEntry("/data"))
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	defer st.Close()
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+	for i, fname := range []string{"data/" + files[0].name, "data/" + files[1].name, "links/" + files[2].name} {
+		if err := os.WriteFile(fname, files[i].data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stmt := range []string{
+		"UPDATE manifest_regular_stats SET bytes_fetched = size WHERE file_id != '" + pending.id + "'",
+		"UPDATE manifest_symlink_stats SET bytes_fetched = size",
+	} {
+		if _, err := st.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export, err := st.ExportChecksums([]string{FileChecksumMD5, FileChecksumSHA256}, ChecksumFormatManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.NumFiles != 3 || export.NumIncomplete != 1 || len(export.Failed) != 0 || len(export.Written) != 2 {
+		t.Fatalf("Unexpected export %+v", export)
+	}
+	var expected string
+	for i, path := range []string{"data/" + files[0].name, "data/" + files[1].name, "links/" + files[2].name} {
+		sum := sha256.Sum256(files[i].data)
+		expected += hex.EncodeToString(sum[:]) + "  " + path + "\n"
+	}
+	if data, _ := os.ReadFile("SHA256SUMS"); string(data) != expected {
+		t.Errorf("Expected SHA256SUMS\n%s\ngot\n%s", expected, data)
+	}
+
+	// sidecars are named after the file, and list its base name
+	if _, err := st.ExportChecksums([]string{FileChecksumMD5}, ChecksumFormatSidecar); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(files[0].data)
+	data, _ := os.ReadFile("data/" + files[0].name + ".md5")
+	if string(data) != hex.EncodeToString(sum[:])+"  "+files[0].name+"\n" {
+		t.Errorf("Unexpected sidecar %q", data)
+	}
+
+	// checksum files are not orphans
+	orphans, err := st.FindOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("Expected no orphans, got %+v", orphans)
+	}
+
+	// a corrupted file is left out
+	corrupted := append([]byte{}, files[1].data...)
+	corrupted[500] ^= 0xff
+	if err := os.WriteFile("data/"+files[1].name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	export, err = st.ExportChecksums([]string{FileChecksumMD5}, ChecksumFormatManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.NumFiles != 2 || len(export.Failed) != 1 || export.Failed[0] != "data/"+files[1].name {
+		t.Errorf("Expected the corrupted file to fail, got %+v", export)
+	}
+
+	if line := checksumLine("abc", "a\\b"); line != "\\abc  a\\\\b\n" {
+		t.Errorf("Unexpected escaped line %q", line)
+	}
+}
+
+func TestChecksumsDuringDownload(t *testing.T) {
+	files := makeTestFiles(3, 300*KiB, 128*KiB)
+	opts := Opts{NumThreads: 2, FileChecksums: "md5", ChecksumFormat: ChecksumFormatManifest}
+	st := downloadTestFiles(t, opts, files)
+
+	data, err := os.ReadFile("MD5SUMS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(files) {
+		t.Fatalf("Expected %d lines in MD5SUMS, got %q", len(files), data)
+	}
+	for i, f := range files {
+		sum := md5.Sum(f.data)
+		if lines[i] != hex.EncodeToString(sum[:])+"  exome/"+f.name {
+			t.Errorf("Unexpected line %q for %s", lines[i], f.name)
+		}
+	}
+
+	// the checksums are kept for later exports
+	if n := st.queryDBIntegerResult("SELECT COUNT(*) FROM file_checksums"); n != int64(len(files)) {
+		t.Errorf("Expected %d checksums in the database, got %d", len(files), n)
+	}
+}
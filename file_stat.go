@@ -0,0 +1,34 @@
+//go:build !windows
+
+package dxda
+
+import (
+	"os"
+	"syscall"
+)
+
+// Number of bytes actually reserved on disk for a file. For sparse files
+// this is smaller than the apparent size.
+func allocatedBytes(path string, fi os.FileInfo) int64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+	return fi.Size()
+}
+
+// Number of hard links to a file
+func numLinks(path string, fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+// Inode number of a file, used to notice files that were replaced since
+// they were last inspected.
+func fileInode(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
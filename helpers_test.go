@@ -0,0 +1,194 @@
+package dxda
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A file served by the test server
+type testFile struct {
+	id       string
+	name     string
+	data     []byte
+	partSize int
+}
+
+// A local stand-in for the DNAnexus API and the object store. Downloads
+// share a bandwidth ceiling, and requests beyond a concurrency limit are
+// rejected with 429.
+type testServer struct {
+	*httptest.Server
+	files         map[string]testFile
+	ceiling       *bandwidthLimiter
+	maxConcurrent int32
+	active        atomic.Int32
+	numThrottled  atomic.Int64
+}
+
+func newTestServer(files []testFile, ceiling int64, maxConcurrent int32) *testServer {
+	ts := &testServer{
+		files:         make(map[string]testFile),
+		ceiling:       newBandwidthLimiter(ceiling),
+		maxConcurrent: maxConcurrent,
+	}
+	for _, f := range files {
+		ts.files[f.id] = f
+	}
+	ts.Server = httptest.NewServer(http.HandlerFunc(ts.handle))
+	return ts
+}
+
+func (ts *testServer) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+
+	// API call to create a download URL: /file-xxxx/download
+	if r.Method == "POST" && strings.HasSuffix(path, "/download") {
+		fileId := strings.TrimSuffix(path, "/download")
+		json.NewEncoder(w).Encode(DXDownloadURL{
+			URL:     ts.URL + "/data/" + fileId,
+			Headers: map[string]string{},
+		})
+		return
+	}
+
+	f, ok := ts.files[strings.TrimPrefix(path, "data/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if ts.maxConcurrent > 0 {
+		if ts.active.Add(1) > ts.maxConcurrent {
+			ts.active.Add(-1)
+			ts.numThrottled.Add(1)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		defer ts.active.Add(-1)
+	}
+
+	var start, end int
+	fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+	body := f.data[start : end+1]
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusPartialContent)
+	for len(body) > 0 {
+		n := MinInt(len(body), 32*KiB)
+		ts.ceiling.wait(r.Context(), n)
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		body = body[n:]
+	}
+}
+
+func (ts *testServer) dxEnv(t *testing.T) DXEnvironment {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DXEnvironment{
+		ApiServerHost:     host,
+		ApiServerPort:     safeString2Int(port),
+		ApiServerProtocol: "http",
+		Token:             "test-token",
+	}
+}
+
+func makeTestFiles(numFiles int, fileSize int, partSize int) []testFile {
+	rnd := rand.New(rand.NewSource(1))
+	var files []testFile
+	for i := 0; i < numFiles; i++ {
+		data := make([]byte, fileSize)
+		rnd.Read(data)
+		files = append(files, testFile{
+			id:       fmt.Sprintf("file-%024d", i),
+			name:     fmt.Sprintf("sample_%d.bam", i),
+			data:     data,
+			partSize: partSize,
+		})
+	}
+	return files
+}
+
+func (f testFile) manifestEntry(folder string) DXFileRegular {
+	var parts []DXPart
+	for ofs, id := 0, 1; ofs < len(f.data); ofs, id = ofs+f.partSize, id+1 {
+		end := MinInt(ofs+f.partSize, len(f.data))
+		sum := md5.Sum(f.data[ofs:end])
+		parts = append(parts, DXPart{Id: id, MD5: hex.EncodeToString(sum[:]), Size: end - ofs})
+	}
+	return DXFileRegular{
+		Folder: folder,
+		Id:     f.id,
+		ProjId: "project-test",
+		Name:   f.name,
+		Size:   int64(len(f.data)),
+		Parts:  parts,
+	}
+}
+
+// A manifest of the files, all in one folder
+func testManifest(files []testFile, folder string) Manifest {
+	var manifest Manifest
+	for _, f := range files {
+		manifest.Files = append(manifest.Files, f.manifestEntry(folder))
+	}
+	return manifest
+}
+
+// Download a manifest into the current directory, as the download command
+// does: the manifest database is created on the first run, and the files
+// are prepared again on later runs.
+func (ts *testServer) download(t *testing.T, opts Opts, manifest Manifest) error {
+	t.Helper()
+	st := NewDxDa(ts.dxEnv(t), "test.manifest.json.bz2", opts)
+	defer st.Close()
+	if _, err := os.Stat("test.manifest.json.bz2.stats.db"); os.IsNotExist(err) {
+		st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+	} else {
+		st.PrepareFilesForDownload(manifest)
+	}
+	return st.DownloadManifestDB("test.manifest.json.bz2")
+}
+
+// Download the files into a new temporary directory, under /exome. The
+// state is returned for further checks, and closed at the end of the test.
+func downloadTestFiles(t *testing.T, opts Opts, files []testFile) *State {
+	t.Helper()
+	chdirTemp(t)
+	ts := newTestServer(files, 0, 0)
+	t.Cleanup(ts.Close)
+	st := NewDxDa(ts.dxEnv(t), "test.manifest.json.bz2", opts)
+	t.Cleanup(st.Close)
+	st.CreateManifestDB(testManifest(files, "/exome"), "test.manifest.json.bz2")
+	if err := st.DownloadManifestDB("test.manifest.json.bz2"); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// Run the test from inside a temporary directory, since downloads are
+// written relative to the working directory.
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
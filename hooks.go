@@ -0,0 +1,388 @@
+package dxda
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events that trigger hooks
+const (
+	// A file was downloaded, and its checksums verified
+	HookFileComplete = "file_complete"
+
+	// All the files in the manifest were downloaded
+	HookManifestComplete = "manifest_complete"
+
+	// A file could not be downloaded. It is left incomplete, and retried
+	// the next time the download command is issued.
+	HookFileFailed = "file_failed"
+)
+
+var allHookEvents = []string{HookFileComplete, HookManifestComplete, HookFileFailed}
+
+const (
+	hookQueueSize  = 1024
+	hookTimeout    = 5 * time.Minute
+	hookNumRetries = 3
+)
+
+// How long a file event waits for room in the queue before it is dropped
+var hookSendTimeout = 30 * time.Second
+
+// ParseHookEvents checks a comma separated list of events. An empty list
+// selects all the events.
+func ParseHookEvents(s string) (map[string]bool, error) {
+	events := make(map[string]bool)
+	if strings.TrimSpace(s) == "" {
+		for _, e := range allHookEvents {
+			events[e] = true
+		}
+		return events, nil
+	}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		switch e {
+		case HookFileComplete, HookManifestComplete, HookFileFailed:
+			events[e] = true
+		default:
+			return nil, fmt.Errorf("unknown hook event %q, expected one of %s",
+				e, strings.Join(allHookEvents, ", "))
+		}
+	}
+	return events, nil
+}
+
+// Checksum of a single part, from the manifest
+type HookPartChecksum struct {
+	Id       int    `json:"id"`
+	Size     int    `json:"size"`
+	MD5      string `json:"md5,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Checksums of a file. Regular files have per-part checksums, symbolic
+// links have an MD5 checksum of the whole file.
+type HookChecksums struct {
+	MD5          string             `json:"md5,omitempty"`
+	ChecksumType string             `json:"checksum_type,omitempty"`
+	Parts        []HookPartChecksum `json:"parts,omitempty"`
+}
+
+// HookEvent is the JSON payload of a hook. The file fields are set for
+// file events, the totals for the manifest_complete event.
+type HookEvent struct {
+	Event     string `json:"event"`
+	Timestamp string `json:"timestamp"` // RFC 3339
+	Manifest  string `json:"manifest"`
+
+	FileId    string         `json:"file_id,omitempty"`
+	Project   string         `json:"project,omitempty"`
+	Path      string         `json:"path,omitempty"` // absolute local path
+	Size      int64          `json:"size,omitempty"`
+	Checksums *HookChecksums `json:"checksums,omitempty"`
+	Error     string         `json:"error,omitempty"`
+
+	NumFiles int64 `json:"num_files,omitempty"`
+	NumBytes int64 `json:"num_bytes,omitempty"`
+
+	// MD5 checksum of the whole file to verify before delivering the
+	// event, for symbolic links
+	verifyMD5 string
+}
+
+// Delivers hook events in the background, in the order they occur, so
+// that slow hooks do not hold up the download. When the hooks fall too far
+// behind, file events wait a while for room in the queue, and are then
+// dropped and logged. Dropped events fail the download.
+type hookRunner struct {
+	command  string
+	url      string
+	events   map[string]bool
+	manifest string
+	wd       string
+	queue    chan HookEvent
+	wg       sync.WaitGroup
+	dropped  atomic.Int64
+	closed   sync.Once
+
+	// files reported as failed in this run, each is reported once
+	mutex  sync.Mutex
+	failed map[string]bool
+}
+
+// Start delivering the hooks configured in the options. Returns nil if
+// there are none.
+func newHookRunner(opts Opts, manifest string) (*hookRunner, error) {
+	if opts.HookCommand == "" && opts.HookURL == "" {
+		return nil, nil
+	}
+	events, err := ParseHookEvents(opts.HookEvents)
+	if err != nil {
+		return nil, err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	manifestPath, err := filepath.Abs(manifest)
+	if err != nil {
+		return nil, err
+	}
+	hr := &hookRunner{
+		command:  opts.HookCommand,
+		url:      opts.HookURL,
+		events:   events,
+		manifest: manifestPath,
+		wd:       wd,
+		queue:    make(chan HookEvent, hookQueueSize),
+		failed:   make(map[string]bool),
+	}
+	hr.wg.Add(1)
+	go hr.deliver()
+	return hr, nil
+}
+
+func (hr *hookRunner) newEvent(event string) HookEvent {
+	return HookEvent{
+		Event:     event,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Manifest:  hr.manifest,
+	}
+}
+
+func (hr *hookRunner) localPath(folder, name string) string {
+	return filepath.Join(hr.wd, folder, name)
+}
+
+// Queue a file event, unless it was not selected. This is called by the
+// download workers and the database update thread, which wait a bounded
+// time for the hooks.
+func (hr *hookRunner) send(e HookEvent) {
+	if hr == nil || !hr.selected(e) {
+		return
+	}
+	select {
+	case hr.queue <- e:
+		return
+	default:
+	}
+	timer := time.NewTimer(hookSendTimeout)
+	defer timer.Stop()
+	select {
+	case hr.queue <- e:
+	case <-timer.C:
+		hr.dropped.Add(1)
+		slog.Warn("hook event dropped, the hooks are falling behind",
+			"event", e.Event, "file_id", e.FileId, "path", e.Path)
+	}
+}
+
+// Whether the hooks run for an event. Symbolic links are reported as
+// complete or failed once they are verified.
+func (hr *hookRunner) selected(e HookEvent) bool {
+	if e.verifyMD5 != "" {
+		return hr.events[HookFileComplete] || hr.events[HookFileFailed]
+	}
+	return hr.events[e.Event]
+}
+
+func (hr *hookRunner) fileComplete(f completedFile) {
+	if hr == nil {
+		return
+	}
+	e := hr.newEvent(HookFileComplete)
+	e.FileId = f.fileId
+	e.Project = f.project
+	e.Path = hr.localPath(f.folder, f.name)
+	e.Size = f.size
+	e.Checksums = &HookChecksums{}
+	if f.kind == 0 {
+		for _, p := range f.parts {
+			e.Checksums.ChecksumType = p.ChecksumType
+			e.Checksums.Parts = append(e.Checksums.Parts, HookPartChecksum{
+				Id:       p.PartId,
+				Size:     p.Size,
+				MD5:      p.MD5,
+				Checksum: p.Checksum,
+			})
+		}
+	} else {
+		// Symbolic links are downloaded without part checksums. The whole
+		// file is verified before reporting it, in the background.
+		e.Checksums.MD5 = f.md5
+		e.verifyMD5 = f.md5
+	}
+	hr.send(e)
+}
+
+// Verify a symbolic link, reporting it as failed if its checksum does not
+// match
+func (hr *hookRunner) verify(e HookEvent) HookEvent {
+	err := verifyFileMD5(e.Path, e.verifyMD5)
+	if err == nil {
+		return e
+	}
+	slog.Error("symbolic link failed verification", "file_id", e.FileId, "path", e.Path, "error", err)
+	e.Event = HookFileFailed
+	e.Error = "md5 checksum of the whole file does not match, run the inspect command to reset it"
+	e.Checksums = nil
+	return e
+}
+
+// Report a part that could not be downloaded. Only the first failure of
+// each file is reported.
+func (hr *hookRunner) partFailed(p DBPart, err error) {
+	if hr == nil {
+		return
+	}
+	path := hr.localPath(p.folder(), p.fileName())
+	hr.mutex.Lock()
+	if hr.failed[path] {
+		hr.mutex.Unlock()
+		return
+	}
+	hr.failed[path] = true
+	hr.mutex.Unlock()
+
+	e := hr.newEvent(HookFileFailed)
+	e.FileId = p.fileId()
+	e.Project = p.project()
+	e.Path = path
+	e.Error = fmt.Sprintf("part %d: %s", partId(p), err.Error())
+	hr.send(e)
+}
+
+func (hr *hookRunner) manifestComplete(numFiles, numBytes int64) {
+	if hr == nil {
+		return
+	}
+	if !hr.events[HookManifestComplete] {
+		return
+	}
+	e := hr.newEvent(HookManifestComplete)
+	e.NumFiles = numFiles
+	e.NumBytes = numBytes
+	// sent once the download is over, there is nothing left to hold up
+	hr.queue <- e
+}
+
+// Wait for the queued events to be delivered. The first call returns an
+// error if events were dropped, later calls do nothing.
+func (hr *hookRunner) close() error {
+	if hr == nil {
+		return nil
+	}
+	var err error
+	hr.closed.Do(func() {
+		close(hr.queue)
+		hr.wg.Wait()
+		if numDropped := hr.dropped.Load(); numDropped > 0 {
+			err = fmt.Errorf("%d hook events were dropped because the hooks could not keep up, see the log for details", numDropped)
+		}
+	})
+	return err
+}
+
+func (hr *hookRunner) deliver() {
+	defer hr.wg.Done()
+	httpClient := NewHttpClient()
+	for e := range hr.queue {
+		if e.verifyMD5 != "" {
+			e = hr.verify(e)
+			if !hr.events[e.Event] {
+				continue
+			}
+		}
+		payload, err := json.Marshal(e)
+		check(err)
+		if hr.command != "" {
+			if err := hr.runCommand(e, payload); err != nil {
+				slog.Warn("hook command failed", "event", e.Event, "file_id", e.FileId, "path", e.Path, "error", err)
+			}
+		}
+		if hr.url != "" {
+			if err := hr.post(httpClient, payload); err != nil {
+				slog.Warn("hook post failed", "event", e.Event, "file_id", e.FileId, "path", e.Path,
+					"host", urlHost(hr.url), "error", err)
+			}
+		}
+	}
+}
+
+// Run the hook command in a shell. The payload is passed on the standard
+// input, and the main fields in environment variables.
+func (hr *hookRunner) runCommand(e HookEvent, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", hr.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", hr.command)
+	}
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"DXDA_EVENT="+e.Event,
+		"DXDA_MANIFEST="+e.Manifest,
+		"DXDA_FILE_ID="+e.FileId,
+		"DXDA_PATH="+e.Path,
+		"DXDA_SIZE="+strconv.FormatInt(e.Size, 10),
+	)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		slog.Info("hook command output", "event", e.Event, "file_id", e.FileId, "path", e.Path, "output", string(output))
+	}
+	return err
+}
+
+func (hr *hookRunner) post(httpClient *http.Client, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	headers := map[string]string{
+		"User-Agent":   UserAgent,
+		"Content-Type": "application/json",
+	}
+	resp, err := DxHttpRequest(ctx, httpClient, hookNumRetries, "POST", hr.url, headers, payload)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+// Compare the MD5 checksum of a local file with the expected one
+func verifyFileMD5(path string, expected string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != expected {
+		return fmt.Errorf("md5 checksum %s does not match the expected %s", sum, expected)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package dxda
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	dir := chdirTemp(t)
+	files := makeTestFiles(3, 300*KiB, 128*KiB)
+	ts := newTestServer(files, 0, 0)
+	defer ts.Close()
+
+	// the last file is missing on the server, and fails
+	missing := testFile{id: "file-missing", name: "missing.bam", data: make([]byte, 100), partSize: 100}
+
+	var mutex sync.Mutex
+	var posted []HookEvent
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e HookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		posted = append(posted, e)
+		mutex.Unlock()
+	}))
+	defer webhook.Close()
+
+	opts := Opts{
+		NumThreads:  2,
+		HookCommand: `echo "$DXDA_EVENT $DXDA_SIZE $DXDA_PATH" >> hook.log`,
+		HookURL:     webhook.URL,
+	}
+	st := NewDxDa(ts.dxEnv(t), "test.manifest.json.bz2", opts)
+	defer st.Close()
+
+	st.CreateManifestDB(testManifest(append(files, missing), "/data"), "test.manifest.json.bz2")
+	if err := st.DownloadManifestDB("test.manifest.json.bz2"); err == nil {
+		t.Fatal("Expected the download of the missing file to fail")
+	}
+
+	events := make(map[string]HookEvent)
+	for _, e := range posted {
+		events[e.Event+" "+filepath.Base(e.Path)] = e
+	}
+	if len(posted) != 4 {
+		t.Errorf("Expected 4 events, got %v", posted)
+	}
+	for _, f := range files {
+		e, ok := events[HookFileComplete+" "+f.name]
+		if !ok {
+			t.Errorf("Missing completion event for %s", f.name)
+			continue
+		}
+		if e.FileId != f.id || e.Size != int64(len(f.data)) || e.Path != filepath.Join(dir, "data", f.name) {
+			t.Errorf("Unexpected completion event %+v", e)
+		}
+		if e.Checksums == nil || len(e.Checksums.Parts) != 3 || e.Checksums.Parts[0].MD5 == "" {
+			t.Errorf("Expected the part checksums in the event, got %+v", e.Checksums)
+		}
+	}
+	if e, ok := events[HookFileFailed+" "+missing.name]; !ok || e.Error == "" {
+		t.Errorf("Expected a failure event for the missing file, got %v", posted)
+	}
+	if _, ok := events[HookManifestComplete+" "]; ok {
+		t.Errorf("Unexpected manifest completion with a failed file")
+	}
+
+	log, err := os.ReadFile("hook.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(lines) != 4 || !strings.Contains(string(log), "file_complete 307200 "+filepath.Join(dir, "data", files[0].name)) {
+		t.Errorf("Unexpected hook command output:\n%s", log)
+	}
+
+	// once everything is downloaded, the manifest completes
+	_, err = st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size WHERE file_id = ?", missing.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	posted = nil
+	if err := st.DownloadManifestDB("test.manifest.json.bz2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 1 || posted[0].Event != HookManifestComplete || posted[0].NumFiles != 4 {
+		t.Errorf("Expected a single manifest completion event, got %+v", posted)
+	}
+
+	if _, err := ParseHookEvents("file_complete,bogus"); err == nil {
+		t.Errorf("Expected an error for an unknown event")
+	}
+}
+
+// Slow hooks do not hold up the download for long, events that wait too
+// long for the queue are dropped, and fail the download
+func TestHooksDropped(t *testing.T) {
+	saved := hookSendTimeout
+	hookSendTimeout = 10 * time.Millisecond
+	defer func() { hookSendTimeout = saved }()
+
+	events, _ := ParseHookEvents("")
+	hr := &hookRunner{events: events, queue: make(chan HookEvent, 1)}
+	for i := 0; i < 3; i++ {
+		hr.send(hr.newEvent(HookFileComplete))
+	}
+	if len(hr.queue) != 1 || hr.dropped.Load() != 2 {
+		t.Errorf("Expected one queued and two dropped events, got %d and %d", len(hr.queue), hr.dropped.Load())
+	}
+	if err := hr.close(); err == nil || !strings.Contains(err.Error(), "2 hook events were dropped") {
+		t.Errorf("Expected the dropped events to be reported, got %v", err)
+	}
+	if err := hr.close(); err != nil {
+		t.Errorf("Expected the dropped events to be reported once, got %v", err)
+	}
+}
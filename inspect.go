@@ -0,0 +1,362 @@
+package dxda
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status of a file, or a part, after inspection
+const (
+	statusOK           = "ok"
+	statusMissing      = "missing"
+	statusMismatch     = "mismatch"
+	statusUnverifiable = "unverifiable"
+	statusIncomplete   = "incomplete"
+)
+
+// Statuses in order of severity, the status of a file is the most severe
+// status of its parts.
+var statusSeverity = map[string]int{
+	statusOK:           0,
+	statusIncomplete:   1,
+	statusUnverifiable: 2,
+	statusMismatch:     3,
+	statusMissing:      4,
+}
+
+// The outcome of checking a part of a regular file, or a whole symbolic link
+type integrityResult struct {
+	kind         int // 0 for regular files, 1 for symlinks
+	fileId       string
+	folder       string
+	name         string
+	partId       int // zero for whole file checks
+	status       string
+	checksumType string
+	expected     string
+	computed     string
+	msg          string
+}
+
+func (r integrityResult) with(status string, msg string) integrityResult {
+	r.status = status
+	r.msg = msg
+	return r
+}
+
+// A part that did not pass inspection
+type InspectPart struct {
+	PartId   int    `json:"part_id"`
+	Status   string `json:"status"`
+	Expected string `json:"expected,omitempty"`
+	Computed string `json:"computed,omitempty"`
+	Message  string `json:"message"`
+}
+
+// InspectFile is the outcome of inspecting a file. Expected and computed
+// checksums are set for symbolic links, which have a checksum of the whole
+// file; regular files list the parts that failed instead.
+type InspectFile struct {
+	FileId          string        `json:"file_id"`
+	Project         string        `json:"project"`
+	Path            string        `json:"path"`
+	Kind            string        `json:"kind"` // regular or symlink
+	Size            int64         `json:"size"`
+	Status          string        `json:"status"`
+	ChecksumType    string        `json:"checksum_type,omitempty"`
+	PartsTotal      int64         `json:"parts_total"`
+	PartsIncomplete int64         `json:"parts_incomplete"`
+	Expected        string        `json:"expected,omitempty"`
+	Computed        string        `json:"computed,omitempty"`
+	FailedParts     []InspectPart `json:"failed_parts,omitempty"`
+	Message         string        `json:"message,omitempty"`
+
+	// Time the file last passed inspection, and whether its checksums
+	// were skipped because it has not changed since.
+	VerifiedAt string `json:"verified_at,omitempty"` // RFC 3339
+	Skipped    bool   `json:"skipped,omitempty"`
+
+	// Path of the file a duplicate is created from, see Opts.Dedupe
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+type InspectTotals struct {
+	NumFiles       int64            `json:"num_files"`
+	NumBytes       int64            `json:"num_bytes"`
+	NumFailedParts int64            `json:"num_failed_parts"`
+	NumSkipped     int64            `json:"num_skipped"`
+	NumOrphans     int64            `json:"num_orphans"`
+	ByStatus       map[string]int64 `json:"by_status"`
+}
+
+// InspectReport lists every file in the manifest with its status
+type InspectReport struct {
+	Manifest  string        `json:"manifest"`
+	Timestamp string        `json:"timestamp"` // RFC 3339
+	Files     []InspectFile `json:"files"`
+	Totals    InspectTotals `json:"totals"`
+
+	// Only listed when asked for, see InspectOrphans
+	Orphans []InspectOrphan `json:"orphans,omitempty"`
+}
+
+// OK is true if all the downloaded files passed inspection. Files that
+// are not completely downloaded do not fail the inspection.
+func (r *InspectReport) OK() bool {
+	for _, f := range r.Files {
+		if statusSeverity[f.Status] > statusSeverity[statusIncomplete] {
+			return false
+		}
+	}
+	return true
+}
+
+type inspectKey struct {
+	kind                 int
+	fileId, folder, name string
+}
+
+// All the files in the database, with their part counts
+func (st *State) inspectFiles() ([]InspectFile, []inspectKey) {
+	var files []InspectFile
+	var keys []inspectKey
+
+	rows, err := st.db.Query(`
+		SELECT file_id, project, folder, name, MAX(checksum_type), SUM(size), COUNT(*), SUM(bytes_fetched != size)
+		FROM manifest_regular_stats GROUP BY file_id, folder, name ORDER BY MIN(rowid)`)
+	check(err)
+	for rows.Next() {
+		f := InspectFile{Kind: "regular"}
+		var key inspectKey
+		err := rows.Scan(&f.FileId, &f.Project, &key.folder, &key.name, &f.ChecksumType,
+			&f.Size, &f.PartsTotal, &f.PartsIncomplete)
+		check(err)
+		key.fileId = f.FileId
+		files = append(files, f)
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	rows, err = st.db.Query(`
+		SELECT s.id, s.proj_id, s.folder, s.name, s.size, COUNT(p.part_id), COALESCE(SUM(p.bytes_fetched != p.size), 0)
+		FROM symlinks s LEFT JOIN manifest_symlink_stats p
+		ON p.file_id = s.id AND p.folder = s.folder AND p.name = s.name
+		GROUP BY s.id, s.folder, s.name ORDER BY MIN(s.rowid)`)
+	check(err)
+	for rows.Next() {
+		f := InspectFile{Kind: "symlink", ChecksumType: "MD5"}
+		key := inspectKey{kind: 1}
+		err := rows.Scan(&f.FileId, &f.Project, &key.folder, &key.name, &f.Size,
+			&f.PartsTotal, &f.PartsIncomplete)
+		check(err)
+		key.fileId = f.FileId
+		files = append(files, f)
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	for i, key := range keys {
+		files[i].Path = filepath.Join(".", key.folder, key.name)
+	}
+	return files, keys
+}
+
+// Inspect checks the downloaded files against their checksums, and reports
+// on every file in the manifest. Unless this is a dry run, the files that
+// pass are recorded, and the parts that fail are reset, so they are
+// downloaded again on the next run. An incremental inspection skips the
+// files that have not changed since they last passed.
+func (st *State) Inspect() *InspectReport {
+	// list the files before checking, since failed parts are reset
+	files, keys := st.inspectFiles()
+	startTime := time.Now()
+	stats := statCompleteFiles(files, keys)
+	skip := make(map[inspectKey]fileVerification)
+	if st.opts.Incremental {
+		skip = unchangedFiles(stats, st.previousVerifications())
+		fmt.Printf("Skipping %d files unchanged since their last inspection\n", len(skip))
+	}
+
+	// Duplicates that are hard links to their source are not read again,
+	// they get the outcome of the source.
+	sources := st.duplicateSources()
+	unchecked := make(map[inspectKey]fileVerification)
+	for key, v := range skip {
+		unchecked[key] = v
+	}
+	linked := make(map[inspectKey]bool)
+	for dup, src := range sources {
+		d, dupOk := stats[dup]
+		s, srcOk := stats[src]
+		if dupOk && srcOk && d.inode != 0 && d.inode == s.inode {
+			linked[dup] = true
+			unchecked[dup] = d
+		}
+	}
+
+	results := st.checkAllRegularFileIntegrity(unchecked)
+	results = append(results, st.checkAllSymlinkIntegrity(unchecked)...)
+	byFile := make(map[inspectKey][]integrityResult)
+	for _, r := range results {
+		key := inspectKey{r.kind, r.fileId, r.folder, r.name}
+		byFile[key] = append(byFile[key], r)
+	}
+
+	report := &InspectReport{
+		Manifest:  st.manifestFname,
+		Timestamp: startTime.Format(time.RFC3339),
+		Files:     files,
+		Totals:    InspectTotals{ByStatus: make(map[string]int64)},
+	}
+	index := make(map[inspectKey]int)
+	for i := range report.Files {
+		f := &report.Files[i]
+		index[keys[i]] = i
+		f.Status = statusOK
+		if f.PartsIncomplete > 0 {
+			f.Status = statusIncomplete
+		}
+
+		fileResults := byFile[keys[i]]
+		sort.Slice(fileResults, func(a, b int) bool { return fileResults[a].partId < fileResults[b].partId })
+		for _, r := range fileResults {
+			if r.status == statusOK {
+				if r.partId == 0 {
+					f.Expected, f.Computed = r.expected, r.computed
+				}
+				continue
+			}
+			if statusSeverity[r.status] > statusSeverity[f.Status] {
+				f.Status = r.status
+				f.Message = strings.TrimSpace(r.msg)
+			}
+			if r.partId == 0 {
+				f.Expected, f.Computed = r.expected, r.computed
+			} else if r.status != statusMissing {
+				f.FailedParts = append(f.FailedParts, InspectPart{
+					PartId:   r.partId,
+					Status:   r.status,
+					Expected: r.expected,
+					Computed: r.computed,
+					Message:  strings.TrimSpace(r.msg),
+				})
+			}
+		}
+		if src, ok := sources[keys[i]]; ok {
+			f.DuplicateOf = filepath.Join(".", src.folder, src.name)
+		}
+		// the source of a duplicate comes first in the manifest, so it
+		// is already inspected
+		if j, ok := index[sources[keys[i]]]; ok && linked[keys[i]] {
+			s := report.Files[j]
+			f.Status, f.Message = s.Status, s.Message
+			f.Expected, f.Computed = s.Expected, s.Computed
+			f.FailedParts = s.FailedParts
+			if f.Status == statusOK {
+				f.Message = "Hard link to " + f.DuplicateOf
+			}
+		}
+		// data appended to a file does not show in the part checksums
+		if s, ok := stats[keys[i]]; ok && s.size != f.Size &&
+			statusSeverity[f.Status] < statusSeverity[statusMismatch] {
+			f.Status = statusMismatch
+			f.Message = fmt.Sprintf("File %s has %d bytes, expected %d", f.Path, s.size, f.Size)
+		}
+		if f.Status == statusIncomplete && f.Message == "" {
+			f.Message = fmt.Sprintf("%d of %d parts are not downloaded", f.PartsIncomplete, f.PartsTotal)
+		}
+		if v, ok := skip[keys[i]]; ok {
+			f.Skipped = true
+			f.VerifiedAt = time.Unix(0, v.verifiedAt).Format(time.RFC3339)
+			f.Message = "Unchanged since it was last inspected"
+			report.Totals.NumSkipped++
+		} else if f.Status == statusOK {
+			f.VerifiedAt = report.Timestamp
+		}
+
+		report.Totals.NumFiles++
+		report.Totals.NumBytes += f.Size
+		report.Totals.NumFailedParts += int64(len(f.FailedParts))
+		report.Totals.ByStatus[f.Status]++
+	}
+
+	if !st.opts.DryRun {
+		check(st.recordVerifications(report, keys, stats, skip, startTime))
+		_, err := st.Repair(report)
+		check(err)
+	}
+	return report
+}
+
+// Summary of the report, one line per status
+func (r *InspectReport) Summary() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Inspected %d files (%s):", r.Totals.NumFiles, diskSpaceString(r.Totals.NumBytes))
+	for _, status := range []string{statusOK, statusIncomplete, statusUnverifiable, statusMismatch, statusMissing} {
+		fmt.Fprintf(&sb, " %d %s", r.Totals.ByStatus[status], status)
+		if status != statusMissing {
+			sb.WriteString(",")
+		}
+	}
+	if r.Totals.NumOrphans > 0 {
+		fmt.Fprintf(&sb, " (%d files not in the manifest)", r.Totals.NumOrphans)
+	}
+	if r.Totals.NumSkipped > 0 {
+		fmt.Fprintf(&sb, " (%d unchanged files skipped)", r.Totals.NumSkipped)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// Write the report to a file. Files ending in .csv get one row per failed
+// part, or per file if no part failed; other files get JSON.
+func (r *InspectReport) Write(fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !strings.HasSuffix(strings.ToLower(fname), ".csv") {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"file_id", "project", "path", "kind", "size", "status", "checksum_type",
+		"part_id", "part_status", "expected", "computed", "message"})
+	for _, file := range r.Files {
+		row := []string{file.FileId, file.Project, file.Path, file.Kind,
+			strconv.FormatInt(file.Size, 10), file.Status, file.ChecksumType}
+		if len(file.FailedParts) == 0 {
+			w.Write(append(row, "", "", file.Expected, file.Computed, file.Message))
+			continue
+		}
+		for _, p := range file.FailedParts {
+			w.Write(append(row, strconv.Itoa(p.PartId), p.Status, p.Expected, p.Computed, p.Message))
+		}
+	}
+	for _, o := range r.Orphans {
+		status := "orphan"
+		if o.Removed {
+			status = "removed"
+		}
+		w.Write([]string{"", "", o.Path, "orphan", strconv.FormatInt(o.Size, 10), status, "", "", "", "", "", ""})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,320 @@
+package dxda
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInspectReport(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(5, 1000, 400)
+	manifest := testManifest(files, "/data")
+	// no checksums for the fourth file
+	unverifiable := manifest.Files[3].(DXFileRegular)
+	for i := range unverifiable.Parts {
+		unverifiable.Parts[i].MD5 = ""
+	}
+	manifest.Files[3] = unverifiable
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	defer st.Close()
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+
+	// write the files as if downloaded, except the last one
+	for _, f := range files[:4] {
+		if err := os.WriteFile("data/"+f.name, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size WHERE file_id != ?", files[4].id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the second part of the second file, and remove the third
+	corrupted := append([]byte{}, files[1].data...)
+	corrupted[500] ^= 0xff
+	if err := os.WriteFile("data/"+files[1].name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data/" + files[2].name)
+
+	report := st.Inspect()
+	expected := []string{statusOK, statusMismatch, statusMissing, statusUnverifiable, statusIncomplete}
+	for i, f := range report.Files {
+		if f.Status != expected[i] {
+			t.Errorf("Expected %s for %s, got %s (%s)", expected[i], f.Path, f.Status, f.Message)
+		}
+	}
+	if report.OK() {
+		t.Errorf("Expected the inspection to fail")
+	}
+	mismatch := report.Files[1]
+	if len(mismatch.FailedParts) != 1 || mismatch.FailedParts[0].PartId != 2 ||
+		mismatch.FailedParts[0].Expected == mismatch.FailedParts[0].Computed {
+		t.Errorf("Expected part 2 to fail with different checksums, got %+v", mismatch.FailedParts)
+	}
+	if report.Totals.NumFiles != 5 || report.Totals.NumFailedParts != 4 || report.Totals.ByStatus[statusOK] != 1 {
+		t.Errorf("Unexpected totals %+v", report.Totals)
+	}
+
+	if err := report.Write("report.json"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded InspectReport
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Files) != 5 || decoded.Files[2].Status != statusMissing {
+		t.Errorf("Unexpected JSON report %s", data)
+	}
+
+	if err := report.Write("report.csv"); err != nil {
+		t.Fatal(err)
+	}
+	csvFile, err := os.Open("report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csvFile.Close()
+	records, err := csv.NewReader(csvFile).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a header, one row for each file, and three rows for the parts of the unverifiable file
+	if len(records) != 1+4+3 || records[2][7] != "2" {
+		t.Errorf("Unexpected CSV report %v", records)
+	}
+}
+
+func TestInspectDryRunAndRepair(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(3, 1000, 400)
+	manifest := testManifest(files, "/data")
+	// a copy of the second file, which stays intact
+	manifest.Files = append(manifest.Files, files[1].manifestEntry("/copy"))
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+	for _, f := range files {
+		if err := os.WriteFile("data/"+f.name, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile("copy/"+files[1].name, files[1].data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size"); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	// corrupt the first part of the first file, and remove the second
+	corrupted := append([]byte{}, files[0].data...)
+	corrupted[10] ^= 0xff
+	if err := os.WriteFile("data/"+files[0].name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("data/" + files[1].name)
+
+	incomplete := func(st *State) int64 {
+		return st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_regular_stats WHERE bytes_fetched != size")
+	}
+
+	st = NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2, DryRun: true})
+	report := st.Inspect()
+	if report.OK() || report.Files[0].Status != statusMismatch || report.Files[1].Status != statusMissing {
+		t.Fatalf("Unexpected report %+v", report.Files)
+	}
+	if n := incomplete(st); n != 0 {
+		t.Errorf("Expected a dry run to leave the database unchanged, %d parts were reset", n)
+	}
+	for _, fname := range []string{"report.json", "report.csv"} {
+		if err := report.Write(fname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.Close()
+
+	for _, fname := range []string{"report.json", "report.csv"} {
+		saved, err := ReadInspectReport(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st = NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+
+		// a report that does not match the manifest changes nothing
+		unknown := *saved
+		unknown.Files = append(append([]InspectFile{}, saved.Files...),
+			InspectFile{FileId: "file-unknown", Path: "data/unknown.bam", Kind: "regular", Status: statusMissing})
+		if _, err := st.Repair(&unknown); err == nil || incomplete(st) != 0 {
+			t.Errorf("Expected an unknown file to fail the repair before any reset, %d parts were reset", incomplete(st))
+		}
+
+		numReset, err := st.Repair(saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the corrupted part, and the three parts of the missing file, but
+		// not its copy
+		if numReset != 2 || incomplete(st) != 1+3 {
+			t.Errorf("Repair from %s reset %d files and %d parts", fname, numReset, incomplete(st))
+		}
+		if _, err := st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size"); err != nil {
+			t.Fatal(err)
+		}
+		st.Close()
+	}
+}
+
+func TestIncrementalInspect(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(3, 1000, 400)
+	manifest := testManifest(files, "/data")
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	defer st.Close()
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+	for _, f := range files {
+		if err := os.WriteFile("data/"+f.name, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size"); err != nil {
+		t.Fatal(err)
+	}
+
+	inspect := func(incremental bool) *InspectReport {
+		st.opts.Incremental = incremental
+		return st.Inspect()
+	}
+
+	report := inspect(true)
+	if !report.OK() || report.Totals.NumSkipped != 0 {
+		t.Fatalf("Expected all files to be checked on the first inspection, got %+v", report.Totals)
+	}
+	report = inspect(true)
+	if !report.OK() || report.Totals.NumSkipped != 3 || !report.Files[0].Skipped || report.Files[0].VerifiedAt == "" {
+		t.Fatalf("Expected all files to be skipped, got %+v", report.Files)
+	}
+
+	// corrupt the first file, keeping its size and modification time. An
+	// incremental inspection cannot tell, a full one can.
+	fi, err := os.Stat("data/" + files[0].name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte{}, files[0].data...)
+	corrupted[10] ^= 0xff
+	if err := os.WriteFile("data/"+files[0].name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("data/"+files[0].name, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if report = inspect(true); !report.OK() {
+		t.Errorf("Expected an incremental inspection to skip the unchanged file")
+	}
+	report = inspect(false)
+	if report.OK() || report.Files[0].Status != statusMismatch || report.Totals.NumSkipped != 0 {
+		t.Errorf("Expected a full inspection to find the mismatch, got %+v", report.Files[0])
+	}
+
+	// a file that was touched is checked again
+	later := fi.ModTime().Add(time.Minute)
+	if err := os.Chtimes("data/"+files[1].name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	report = inspect(true)
+	expected := []string{statusIncomplete, statusOK, statusOK}
+	for i, f := range report.Files {
+		if f.Status != expected[i] || f.Skipped != (i == 2) {
+			t.Errorf("Expected %s for %s, skipped %v, got %+v", expected[i], f.Path, i == 2, f)
+		}
+	}
+}
+
+func TestInspectSizeAndOrphans(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(2, 1000, 400)
+	manifest := testManifest(files, "/data")
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	defer st.Close()
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+	for _, f := range files {
+		if err := os.WriteFile("data/"+f.name, f.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size"); err != nil {
+		t.Fatal(err)
+	}
+
+	// append to the first file, and add files that are not in the manifest
+	if err := os.WriteFile("data/"+files[0].name, append(files[0].data, "extra"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir("other", 0755)
+	os.MkdirAll("cache/objects", 0755)
+	for _, fname := range []string{"data/stray.txt", "other/notes.txt", "report.csv", "cache/objects/0a1b"} {
+		if err := os.WriteFile(fname, []byte("stray"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := st.Inspect()
+	if report.Files[0].Status != statusMismatch || report.Files[0].Message != "File data/"+files[0].name+" has 1005 bytes, expected 1000" {
+		t.Errorf("Expected a size mismatch, got %+v", report.Files[0])
+	}
+	if report.Files[1].Status != statusOK {
+		t.Errorf("Expected the second file to pass, got %+v", report.Files[1])
+	}
+	if fi, err := os.Stat("data/" + files[0].name); err != nil || fi.Size() != 1000 {
+		t.Errorf("Expected the appended data to be removed by the repair")
+	}
+
+	// the report itself, the files of the manifest database, and the cache
+	// of an earlier download, are not orphans
+	st.opts.CacheDir = "cache"
+	if err := st.recordLocalPaths(); err != nil {
+		t.Fatal(err)
+	}
+	st.opts.CacheDir = ""
+	if err := st.InspectOrphans(report, "report.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 2 || report.Orphans[0].Path != "data/stray.txt" ||
+		report.Orphans[1].Path != "other/notes.txt" || report.Orphans[1].Removed {
+		t.Fatalf("Unexpected orphans %+v", report.Orphans)
+	}
+	if err := st.RemoveOrphans(report); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("cache/objects/0a1b"); err != nil {
+		t.Errorf("Expected the cache to be kept")
+	}
+	for _, o := range report.Orphans {
+		if _, err := os.Stat(o.Path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", o.Path)
+		}
+	}
+
+	if err := report.Write("report.csv"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadInspectReport("report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Files) != 2 || len(saved.Orphans) != 2 || !saved.Orphans[0].Removed {
+		t.Errorf("Unexpected report read back from CSV %+v", saved)
+	}
+}
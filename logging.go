@@ -0,0 +1,174 @@
+package dxda
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Formats of the download log
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogOptions configure the download log
+type LogOptions struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
+
+	// Rotate the log when it grows beyond MaxSize bytes, keeping
+	// MaxBackups old logs. The log is never rotated if MaxSize is zero.
+	MaxSize    int64
+	MaxBackups int
+}
+
+// ParseLogLevel converts a level name to a slog level
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+// ValidateLogFormat checks that a log format is supported
+func ValidateLogFormat(format string) error {
+	switch format {
+	case "", LogFormatText, LogFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unsupported log format %q, expected %s or %s", format, LogFormatText, LogFormatJSON)
+}
+
+// A log file that is rotated when it reaches a maximal size. The current
+// log is renamed to [path].1, the previous one to [path].2, and so on.
+type rotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	f          *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups < 1 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.f.Close()
+}
+
+// Build a structured logger writing to [w]
+func newLogger(w io.Writer, lo LogOptions) (*slog.Logger, error) {
+	level, err := ParseLogLevel(lo.Level)
+	if err != nil {
+		return nil, err
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if lo.Format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	}
+	if err := ValidateLogFormat(lo.Format); err != nil {
+		return nil, err
+	}
+	return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+}
+
+// SetupLogging directs the log of the dxda package to [path]. Messages
+// written through the standard log package are included, at the info
+// level. The returned closer closes the log file.
+func SetupLogging(path string, lo LogOptions) (io.Closer, error) {
+	rf, err := openRotatingFile(path, lo.MaxSize, lo.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	logger, err := newLogger(rf, lo)
+	if err != nil {
+		rf.Close()
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return rf, nil
+}
+
+// The host part of a URL, for logging without query strings and tokens
+func urlHost(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// Attributes identifying a part in the log
+func partAttrs(p DBPart) []any {
+	return []any{
+		"file_id", p.fileId(),
+		"part_id", partId(p),
+		"path", fmt.Sprintf(".%s/%s", p.folder(), p.fileName()),
+	}
+}
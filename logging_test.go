@@ -0,0 +1,76 @@
+package dxda
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.download.log")
+	rf, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 12; i++ {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+
+	// two lines fit in each file, and only two backups are kept
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 80 {
+			t.Errorf("Expected %s to hold two lines, got %d bytes", name, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most two backups")
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, LogOptions{Level: "warn", Format: LogFormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(saved)
+
+	p := DBPartRegular{FileId: "file-xxxx", Folder: "/data", FileName: "a.bam", PartId: 3}
+	slog.Info("not logged at the warn level")
+	slog.Warn("checksum mismatch, retrying", append(partAttrs(p), "host", urlHost("https://dl.example.com/F/x?token=secret"))...)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a single JSON entry, got %q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"level":   "WARN",
+		"file_id": "file-xxxx",
+		"part_id": float64(3),
+		"path":    "./data/a.bam",
+		"host":    "dl.example.com",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("Expected %s=%v in the log entry, got %v", k, v, entry[k])
+		}
+	}
+
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Errorf("Expected an error for an unknown log level")
+	}
+}
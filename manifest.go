@@ -29,6 +29,7 @@ type DXFile interface {
 	projId() string
 	folder() string
 	name() string
+	size() int64
 }
 
 // Data file on dnanexus
@@ -40,26 +41,37 @@ type DXFileRegular struct {
 	Size         int64
 	ChecksumType *string
 	Parts        []DXPart
+	Priority     int
+
+	// Creation and modification times on the platform, in milliseconds
+	// since the epoch. Zero if unknown.
+	Created  int64
+	Modified int64
 }
 
 func (reg DXFileRegular) id() string     { return reg.Id }
 func (reg DXFileRegular) projId() string { return reg.ProjId }
 func (reg DXFileRegular) folder() string { return reg.Folder }
 func (reg DXFileRegular) name() string   { return reg.Name }
+func (reg DXFileRegular) size() int64    { return reg.Size }
 
 type DXFileSymlink struct {
-	Folder string
-	Id     string
-	ProjId string
-	Name   string
-	Size   int64
-	MD5    string
+	Folder   string
+	Id       string
+	ProjId   string
+	Name     string
+	Size     int64
+	MD5      string
+	Priority int
+	Created  int64
+	Modified int64
 }
 
 func (slnk DXFileSymlink) id() string     { return slnk.Id }
 func (slnk DXFileSymlink) projId() string { return slnk.ProjId }
 func (slnk DXFileSymlink) folder() string { return slnk.Folder }
 func (slnk DXFileSymlink) name() string   { return slnk.Name }
+func (slnk DXFileSymlink) size() int64    { return slnk.Size }
 
 //----------------------------------------------------------------------------------
 
@@ -77,6 +89,9 @@ type ManifestRawFile struct {
 	Name         string             `json:"name"`
 	ChecksumType *string            `json:"checksumType,omitempty"`
 	Parts        *map[string]DXPart `json:"parts,omitempty"`
+	Priority     int                `json:"priority,omitempty"`
+	Created      int64              `json:"created,omitempty"`
+	Modified     int64              `json:"modified,omitempty"`
 }
 
 func validateDirName(p string) error {
@@ -184,6 +199,9 @@ func (mRaw ManifestRaw) genTrustedManifest() (*Manifest, error) {
 				Size:         size,
 				Parts:        parts,
 				ChecksumType: f.ChecksumType,
+				Priority:     f.Priority,
+				Created:      f.Created,
+				Modified:     f.Modified,
 			}
 			manifest.Files = append(manifest.Files, dxFile)
 		}
@@ -239,23 +257,29 @@ func (mRaw ManifestRaw) makeValidatedManifest(ctx context.Context, dxEnv *DXEnvi
 			if fDesc.Symlink == nil {
 				// regular file
 				dxFile := DXFileRegular{
-					Folder: folder,
-					Id:     f.Id,
-					ProjId: projId,
-					Name:   f.Name,
-					Size:   fDesc.Size,
-					Parts:  processFileParts(fDesc.Parts),
+					Folder:   folder,
+					Id:       f.Id,
+					ProjId:   projId,
+					Name:     f.Name,
+					Size:     fDesc.Size,
+					Parts:    processFileParts(fDesc.Parts),
+					Priority: f.Priority,
+					Created:  fDesc.Created,
+					Modified: fDesc.Modified,
 				}
 				manifest.Files = append(manifest.Files, dxFile)
 			} else {
 				// symbolic link
 				dxSymlink := DXFileSymlink{
-					Folder: folder,
-					Id:     f.Id,
-					ProjId: projId,
-					Name:   f.Name,
-					Size:   fDesc.Size,
-					MD5:    fDesc.Symlink.MD5,
+					Folder:   folder,
+					Id:       f.Id,
+					ProjId:   projId,
+					Name:     f.Name,
+					Size:     fDesc.Size,
+					MD5:      fDesc.Symlink.MD5,
+					Priority: f.Priority,
+					Created:  fDesc.Created,
+					Modified: fDesc.Modified,
 				}
 				manifest.Files = append(manifest.Files, dxSymlink)
 			}
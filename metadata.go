@@ -0,0 +1,224 @@
+package dxda
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ParseFileMode reads permission bits in octal, for example 0644 or 755
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, expected permission bits in octal, for example 0644", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Give the owner back the permission to write to a file, or to a
+// directory and search it, taken away by a read-only -file_mode or
+// -dir_mode, so that the file can be written or replaced
+func restoreOwnerWrite(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	want := os.FileMode(0200)
+	if fi.IsDir() {
+		want = 0300
+	}
+	if fi.Mode().Perm()&want == want {
+		return nil
+	}
+	return os.Chmod(path, fi.Mode().Perm()|want)
+}
+
+// Restore the owner permissions of a directory, and of the directories
+// above it up to the current directory, from the top down. Directories
+// already seen are skipped.
+func restoreDirAccess(dir string, seen map[string]bool) error {
+	dir = filepath.Clean(dir)
+	if dir == "." || dir == string(filepath.Separator) || seen[dir] {
+		return nil
+	}
+	if err := restoreDirAccess(filepath.Dir(dir), seen); err != nil {
+		return err
+	}
+	seen[dir] = true
+	if err := restoreOwnerWrite(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Record the creation and modification times of the files on the
+// platform. Files without times are not listed.
+func (st *State) addFileTimes(manifest Manifest) {
+	sqlStmt := `
+	CREATE TABLE file_times (
+		file_id  text,
+		created  integer,
+		modified integer
+	);
+	`
+	_, err := st.db.Exec(sqlStmt)
+	check(err)
+
+	txn, err := st.db.Begin()
+	check(err)
+	for _, f := range manifest.Files {
+		var created, modified int64
+		switch f.(type) {
+		case DXFileRegular:
+			created, modified = f.(DXFileRegular).Created, f.(DXFileRegular).Modified
+		case DXFileSymlink:
+			created, modified = f.(DXFileSymlink).Created, f.(DXFileSymlink).Modified
+		}
+		if created == 0 && modified == 0 {
+			continue
+		}
+		_, err := txn.Exec("INSERT INTO file_times VALUES (?, ?, ?)", f.id(), created, modified)
+		check(err)
+	}
+	err = txn.Commit()
+	check(err)
+}
+
+// The local modification time of a file: its modification time on the
+// platform, or its creation time if it was never modified.
+func platformMtime(created int64, modified int64) time.Time {
+	if modified == 0 {
+		modified = created
+	}
+	return time.UnixMilli(modified)
+}
+
+// Applies the platform modification times, and the requested modes, to
+// files as they complete, and to all the completed files and their
+// directories at the end of the download.
+type fileMetadata struct {
+	st       *State
+	times    bool // the database has the file times
+	fileMode os.FileMode
+	dirMode  os.FileMode
+}
+
+// Returns nil if the options do not ask for any metadata
+func newFileMetadata(st *State) *fileMetadata {
+	opts := st.opts
+	if !opts.PreserveTimes && opts.FileMode == 0 && opts.DirMode == 0 {
+		return nil
+	}
+	times := opts.PreserveTimes && st.tableExists("file_times")
+	if opts.PreserveTimes && !times {
+		PrintLogAndOut("The manifest database predates file times, modification times are not preserved. " +
+			"Delete the .stats.db file and re-run the download to preserve them.\n")
+	}
+	return &fileMetadata{
+		st:       st,
+		times:    times,
+		fileMode: opts.FileMode,
+		dirMode:  opts.DirMode,
+	}
+}
+
+// The platform modification time of a file, zero if unknown. Must be
+// called with the database mutex held.
+func (md *fileMetadata) mtimeLocked(fileId string) (time.Time, error) {
+	if md == nil || !md.times {
+		return time.Time{}, nil
+	}
+	var created, modified int64
+	err := md.st.db.QueryRow("SELECT created, modified FROM file_times WHERE file_id = ? LIMIT 1",
+		fileId).Scan(&created, &modified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return platformMtime(created, modified), nil
+}
+
+// Set the mode and modification time of a completed file
+func (md *fileMetadata) apply(f completedFile) {
+	if md == nil {
+		return
+	}
+	if md.fileMode != 0 {
+		if err := os.Chmod(f.path(), md.fileMode); err != nil {
+			slog.Warn("could not set the file mode", "file_id", f.fileId, "path", f.path(), "error", err)
+		}
+	}
+	if !f.mtime.IsZero() {
+		if err := os.Chtimes(f.path(), time.Time{}, f.mtime); err != nil {
+			slog.Warn("could not set the modification time", "file_id", f.fileId, "path", f.path(), "error", err)
+		}
+	}
+}
+
+// Apply the metadata to all the completed files, including those completed
+// by earlier runs, and set the mode of their directories.
+func (md *fileMetadata) applyAll() error {
+	if md == nil {
+		return nil
+	}
+	files, err := md.st.completeFiles()
+	if err != nil {
+		return err
+	}
+
+	mtimes := make(map[string]time.Time)
+	if md.times {
+		md.st.mutex.Lock()
+		rows, err := md.st.db.Query("SELECT file_id, created, modified FROM file_times")
+		if err != nil {
+			md.st.mutex.Unlock()
+			return err
+		}
+		for rows.Next() {
+			var fileId string
+			var created, modified int64
+			if err := rows.Scan(&fileId, &created, &modified); err != nil {
+				rows.Close()
+				md.st.mutex.Unlock()
+				return err
+			}
+			mtimes[fileId] = platformMtime(created, modified)
+		}
+		err = rows.Err()
+		rows.Close()
+		md.st.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, f := range files {
+		f.mtime = mtimes[f.fileId]
+		md.apply(f)
+		for dir := filepath.Dir(filepath.Join(".", f.folder, f.name)); dir != "." && !seen[dir]; dir = filepath.Dir(dir) {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	if md.dirMode == 0 {
+		return nil
+	}
+	// subdirectories first, in case the mode does not allow searching
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		if err := os.Chmod(dir, md.dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package dxda
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreserveMetadata(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(3, 300*KiB, 128*KiB)
+	ts := newTestServer(files, 0, 0)
+	defer ts.Close()
+
+	modified := time.Date(2023, 5, 17, 10, 30, 0, 0, time.UTC)
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	var manifest Manifest
+	for i, f := range files {
+		entry := f.manifestEntry("/exome/bams")
+		switch i {
+		case 0:
+			entry.Created, entry.Modified = created.UnixMilli(), modified.UnixMilli()
+		case 1:
+			entry.Created = created.UnixMilli()
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	opts := Opts{NumThreads: 2, PreserveTimes: true, FileMode: 0600, DirMode: 0750}
+	if err := ts.download(t, opts, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []time.Time{modified, created, {}} {
+		fi, err := os.Stat("exome/bams/" + files[i].name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expected.IsZero() && !fi.ModTime().Equal(expected) {
+			t.Errorf("Expected %s to be modified at %s, got %s", files[i].name, expected, fi.ModTime())
+		}
+		if expected.IsZero() && time.Since(fi.ModTime()) > time.Hour {
+			t.Errorf("Expected %s without platform times to keep its download time, got %s", files[i].name, fi.ModTime())
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("Expected mode 0600 for %s, got %o", files[i].name, fi.Mode().Perm())
+		}
+	}
+	for _, dir := range []string{"exome", "exome/bams"} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0750 {
+			t.Errorf("Expected mode 0750 for %s, got %o", dir, fi.Mode().Perm())
+		}
+	}
+
+	if _, err := ParseFileMode("0644"); err != nil {
+		t.Error(err)
+	}
+	for _, mode := range []string{"", "rw", "0888", "01777"} {
+		if _, err := ParseFileMode(mode); err == nil {
+			t.Errorf("Expected %q to be rejected", mode)
+		}
+	}
+}
+
+// Files made read-only by an earlier run are repaired and downloaded again
+func TestReadOnlyModesResume(t *testing.T) {
+	dir := chdirTemp(t)
+	files := makeTestFiles(2, 300*KiB, 128*KiB)
+	ts := newTestServer(files, 0, 0)
+	defer ts.Close()
+	manifest := testManifest(files, "/exome/bams")
+	// the temporary directory can only be cleaned up when writable again
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(dir, "exome"), 0755)
+		os.Chmod(filepath.Join(dir, "exome/bams"), 0755)
+	})
+
+	opts := Opts{NumThreads: 2, Preallocate: true, FileMode: 0444, DirMode: 0555}
+	if err := ts.download(t, opts, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the first file, which resets it
+	fname := "exome/bams/" + files[0].name
+	corrupted := append([]byte{}, files[0].data...)
+	corrupted[10] ^= 0xff
+	if err := os.Chmod(fname, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fname, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(fname, 0444); err != nil {
+		t.Fatal(err)
+	}
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	if report := st.Inspect(); report.OK() {
+		t.Fatal("Expected the corrupted file to be found")
+	}
+	st.Close()
+
+	st = NewDxDa(ts.dxEnv(t), "test.manifest.json.bz2", opts)
+	defer st.Close()
+	st.PrepareFilesForDownload(manifest)
+	for _, path := range []string{"exome", "exome/bams", fname} {
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm()&0200 == 0 {
+			t.Errorf("Expected the owner to be able to write to %s again, got %v %v", path, fi, err)
+		}
+	}
+	if fi, err := os.Stat("exome/bams/" + files[1].name); err != nil || fi.Mode().Perm() != 0444 {
+		t.Errorf("Expected the complete file to keep its mode, got %v %v", fi, err)
+	}
+	if err := st.DownloadManifestDB("test.manifest.json.bz2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		path := "exome/bams/" + f.name
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, f.data) {
+			t.Errorf("Expected %s to be downloaded again, got %v", f.name, err)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0444 {
+			t.Errorf("Expected mode 0444 for %s, got %v %v", f.name, fi, err)
+		}
+	}
+	for _, d := range []string{"exome", "exome/bams"} {
+		if fi, err := os.Stat(d); err != nil || fi.Mode().Perm() != 0555 {
+			t.Errorf("Expected mode 0555 for %s, got %v %v", d, fi, err)
+		}
+	}
+
+	// a file is reset inside a read-only directory
+	if err := emptyFile(fname); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Size() != 0 || fi.Mode().Perm() != 0644 {
+		t.Errorf("Expected an empty file the owner can write to, got %v %v", fi, err)
+	}
+}
@@ -0,0 +1,98 @@
+package dxda
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Write the download statistics in the Prometheus text exposition format
+func (st *State) writeMetrics(w io.Writer) {
+	ds := st.stats
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+
+	metric("dxda_bytes_downloaded_total", "counter",
+		"Bytes received from the object store.", ds.bytesReceived.Load())
+	metric("dxda_bytes_complete_total", "counter",
+		"Bytes in parts downloaded and recorded in the database.", ds.bytesComplete.Load())
+	metric("dxda_parts_complete_total", "counter",
+		"Parts downloaded and recorded in the database.", ds.partsComplete.Load())
+	metric("dxda_parts_failed_total", "counter",
+		"Parts that could not be downloaded, and are left for the next run.", ds.failedParts.Load())
+	metric("dxda_checksum_mismatches_total", "counter",
+		"Parts downloaded again because their checksum did not match.", ds.checksumMismatches.Load())
+	metric("dxda_url_generations_total", "counter",
+		"Pre-authenticated download URLs created.", ds.urlGenerations.Load())
+	metric("dxda_http_requests_total", "counter",
+		"Data requests issued by the download workers.", ds.requests.Load())
+
+	lastComplete := float64(ds.lastCompleteNs.Load()) / 1e9
+	metric("dxda_last_part_complete_timestamp_seconds", "gauge",
+		"Time the last part was recorded in the database, zero if none was.", lastComplete)
+
+	metric("dxda_workers_active", "gauge",
+		"Download workers currently fetching a part.", st.gate.numActive())
+	metric("dxda_workers_limit", "gauge",
+		"Maximal number of download workers allowed to run.", st.gate.getLimit())
+
+	// retries, by http status
+	retries := ds.retryCounts()
+	statuses := make([]string, 0, len(retries))
+	for status := range retries {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	fmt.Fprintf(w, "# HELP dxda_http_retries_total Failed data requests that are retried, by http status.\n")
+	fmt.Fprintf(w, "# TYPE dxda_http_retries_total counter\n")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "dxda_http_retries_total{status=%q} %d\n", status, retries[status])
+	}
+
+	// request latency. Prometheus buckets are cumulative.
+	h := ds.latency
+	fmt.Fprintf(w, "# HELP dxda_request_duration_seconds Duration of data requests, including reading the response.\n")
+	fmt.Fprintf(w, "# TYPE dxda_request_duration_seconds histogram\n")
+	cumulative := int64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "dxda_request_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += h.counts[len(latencyBuckets)].Load()
+	fmt.Fprintf(w, "dxda_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "dxda_request_duration_seconds_sum %v\n", float64(h.sumNanos.Load())/1e9)
+	fmt.Fprintf(w, "dxda_request_duration_seconds_count %d\n", cumulative)
+}
+
+// Serve the metrics on [addr] until the server is shut down. The listener
+// is opened before returning, so that a bad address is reported right away.
+func (st *State) serveMetrics(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		st.writeMetrics(w)
+	})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server stopped", "error", err)
+		}
+	}()
+	PrintLogAndOut("Serving metrics on http://%s/metrics\n", listener.Addr().String())
+	return srv, nil
+}
@@ -0,0 +1,65 @@
+package dxda
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	numRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		if numRequests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	st := &State{stats: newDownloadStats(), gate: newWorkerGate(4, KiB)}
+	client := &http.Client{Transport: &monitoredTransport{base: http.DefaultTransport, stats: st.stats}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	// an error that is not retried is not counted as a retry
+	if _, err := client.Get("gopher://localhost/"); err == nil {
+		t.Fatal("Expected an error for an unsupported scheme")
+	}
+	st.stats.partsComplete.Add(3)
+	st.stats.checksumMismatches.Add(1)
+	st.stats.latency.observe(90 * time.Second)
+
+	var buf bytes.Buffer
+	st.writeMetrics(&buf)
+	text := buf.String()
+	for _, line := range []string{
+		"dxda_bytes_downloaded_total 5",
+		"dxda_parts_complete_total 3",
+		"dxda_checksum_mismatches_total 1",
+		"dxda_http_requests_total 3",
+		"dxda_workers_limit 4",
+		`dxda_http_retries_total{status="503"} 1`,
+		`dxda_request_duration_seconds_bucket{le="60"} 3`,
+		`dxda_request_duration_seconds_bucket{le="+Inf"} 4`,
+		"dxda_request_duration_seconds_count 4",
+		"# TYPE dxda_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Expected %q in the metrics:\n%s", line, text)
+		}
+	}
+	if strings.Contains(text, `status="connection"`) {
+		t.Errorf("Expected no connection retries in the metrics:\n%s", text)
+	}
+}
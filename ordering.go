@@ -0,0 +1,388 @@
+package dxda
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Order in which the parts of the manifest are downloaded
+const (
+	// The order of the files in the manifest
+	OrderManifest = "manifest"
+
+	// Finish files that are already partially downloaded, then download
+	// the remaining files one after the other.
+	OrderFileFirst = "file"
+
+	// Smallest files first, so that many files become usable early
+	OrderSmallestFirst = "smallest"
+
+	// Files with the highest "priority" field in the manifest first
+	OrderPriority = "priority"
+)
+
+// ValidateOrder checks that an ordering policy is supported
+func ValidateOrder(order string) error {
+	switch order {
+	case "", OrderManifest, OrderFileFirst, OrderSmallestFirst, OrderPriority:
+		return nil
+	}
+	return fmt.Errorf("unsupported download order %q, expected one of %s",
+		order, strings.Join([]string{OrderManifest, OrderFileFirst, OrderSmallestFirst, OrderPriority}, ", "))
+}
+
+// Record the per-file priorities from the manifest. Files without a
+// priority are not listed, and default to zero.
+func (st *State) addFilePriorities(manifest Manifest) {
+	sqlStmt := `
+	CREATE TABLE file_priorities (
+		file_id  text,
+		priority integer
+	);
+	`
+	_, err := st.db.Exec(sqlStmt)
+	check(err)
+
+	txn, err := st.db.Begin()
+	check(err)
+	for _, f := range manifest.Files {
+		priority := 0
+		switch f.(type) {
+		case DXFileRegular:
+			priority = f.(DXFileRegular).Priority
+		case DXFileSymlink:
+			priority = f.(DXFileSymlink).Priority
+		}
+		if priority == 0 {
+			continue
+		}
+		_, err := txn.Exec("INSERT INTO file_priorities VALUES (?, ?)", f.id(), priority)
+		check(err)
+	}
+	err = txn.Commit()
+	check(err)
+}
+
+func (st *State) tableExists(name string) bool {
+	cnt := st.queryDBIntegerResult(fmt.Sprintf(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = '%s'", name))
+	return cnt > 0
+}
+
+// The ordering policy to use, falling back to the manifest order if the
+// database does not support the requested one.
+func (st *State) downloadOrder() string {
+	order := st.opts.Order
+	if order == "" {
+		return OrderManifest
+	}
+	if order == OrderPriority && !st.tableExists("file_priorities") {
+		PrintLogAndOut("The manifest database predates file priorities, using the manifest order. " +
+			"Delete the .stats.db file and re-run the download to use priorities.\n")
+		return OrderManifest
+	}
+	return order
+}
+
+// Number of files read from the download queue table at a time
+const downloadQueuePageSize = 1000
+
+// A file in the download queue
+type queuedFile struct {
+	seq    int64
+	kind   int // 0 for regular files, 1 for symlinks
+	fileId string
+	folder string
+	name   string
+}
+
+// Index the part tables by file, so that the parts of one file can be
+// looked up without scanning the whole table. This also speeds up the
+// per-part updates during the download.
+func (st *State) createPartIndexes() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for _, table := range []string{"manifest_regular_stats", "manifest_symlink_stats"} {
+		_, err := st.db.Exec(fmt.Sprintf(
+			"CREATE INDEX IF NOT EXISTS %s_file_idx ON %s (file_id, folder, name, part_id)",
+			table, table))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prepare the download queue: the files that have incomplete parts, in
+// the order of the ordering policy. In the manifest order, files are read
+// straight from the part tables, in the order they were added, so that the
+// download starts without going over the whole manifest. The other
+// policies need to sort all the files, they fill the download queue table
+// with the files numbered in the order they should be downloaded.
+func (st *State) buildDownloadQueue(order string) error {
+	// Duplicates are created from their copies, instead of being downloaded
+	notDuplicate := [2]string{st.notDuplicate(0, "f", "file_id"), st.notDuplicate(1, "f", "file_id")}
+
+	if order == OrderManifest {
+		// regular files come first, symbolic links are numbered after them
+		symlinkSeq := st.queryDBIntegerResult("SELECT MAX(rowid) FROM manifest_regular_stats")
+
+		st.mutex.Lock()
+		defer st.mutex.Unlock()
+		st.queue = &partTableQueue{symlinkSeq: symlinkSeq, notDuplicate: notDuplicate}
+		_, err := st.db.Exec("DROP TABLE IF EXISTS download_queue")
+		return err
+	}
+
+	// The sort key for each file. The file sequence number, its first row
+	// in the table, keeps files in manifest order when the keys are equal.
+	sortKey := "0"
+	priorityJoin := ""
+	switch order {
+	case OrderFileFirst:
+		sortKey = "1 - f.started"
+	case OrderSmallestFirst:
+		sortKey = "f.total_size"
+	case OrderPriority:
+		sortKey = "-COALESCE(p.priority, 0)"
+		priorityJoin = `
+		LEFT JOIN (SELECT file_id, MAX(priority) AS priority FROM file_priorities GROUP BY file_id) p
+		ON p.file_id = f.file_id`
+	}
+	filesOfTable := func(kind int, table string) string {
+		return fmt.Sprintf(`
+		SELECT %d AS kind, f.file_id, f.folder, f.name, %s AS sort_key, f.seq AS file_seq
+		FROM (SELECT file_id, folder, name,
+				MIN(rowid) AS seq,
+				SUM(size) AS total_size,
+				MAX(bytes_fetched = size) AS started,
+				MIN(bytes_fetched = size) AS done
+			FROM %s GROUP BY file_id, folder, name) f %s
+		WHERE f.done = 0%s`,
+			kind, sortKey, table, priorityJoin, notDuplicate[kind])
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.queue = nil
+
+	sqlStmt := `
+	DROP TABLE IF EXISTS download_queue;
+	CREATE TABLE download_queue (
+		seq     integer PRIMARY KEY,
+		kind    integer,
+		file_id text,
+		folder  text,
+		name    text
+	);
+	`
+	if _, err := st.db.Exec(sqlStmt); err != nil {
+		return err
+	}
+	_, err := st.db.Exec(fmt.Sprintf(`
+	INSERT INTO download_queue (kind, file_id, folder, name)
+	SELECT kind, file_id, folder, name FROM (%s
+		UNION ALL %s
+	)
+	ORDER BY sort_key, kind, file_seq`,
+		filesOfTable(0, "manifest_regular_stats"),
+		filesOfTable(1, "manifest_symlink_stats")))
+	return err
+}
+
+// The download queue in the manifest order, read from the part tables.
+// The parts of a file are consecutive rows, a file is numbered by its last
+// row. Symbolic links are numbered after the last row of the regular
+// files.
+type partTableQueue struct {
+	symlinkSeq   int64
+	notDuplicate [2]string
+}
+
+// Read the next page of files from the download queue, following [afterSeq]
+func (st *State) nextQueuedFiles(afterSeq int64) ([]queuedFile, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.queue != nil {
+		return st.queue.nextFilesLocked(st, afterSeq)
+	}
+	rows, err := st.db.Query(
+		"SELECT seq, kind, file_id, folder, name FROM download_queue WHERE seq > ? ORDER BY seq LIMIT ?",
+		afterSeq, downloadQueuePageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []queuedFile
+	for rows.Next() {
+		var f queuedFile
+		if err := rows.Scan(&f.seq, &f.kind, &f.fileId, &f.folder, &f.name); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func (q *partTableQueue) nextFilesLocked(st *State, afterSeq int64) ([]queuedFile, error) {
+	var files []queuedFile
+	for len(files) < downloadQueuePageSize {
+		f := queuedFile{kind: 0}
+		table, base := "manifest_regular_stats", int64(0)
+		if afterSeq >= q.symlinkSeq {
+			f.kind, table, base = 1, "manifest_symlink_stats", q.symlinkSeq
+		}
+
+		// the next incomplete part, through the rowid index
+		err := st.db.QueryRow(fmt.Sprintf(`
+			SELECT file_id, folder, name FROM %s f
+			WHERE rowid > ? AND bytes_fetched != size%s
+			ORDER BY rowid LIMIT 1`, table, q.notDuplicate[f.kind]),
+			afterSeq-base).Scan(&f.fileId, &f.folder, &f.name)
+		if errors.Is(err, sql.ErrNoRows) {
+			if f.kind == 0 {
+				afterSeq = q.symlinkSeq
+				continue
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// and the last row of its file, through the file index
+		var lastRow int64
+		err = st.db.QueryRow(fmt.Sprintf(
+			"SELECT MAX(rowid) FROM %s WHERE file_id = ? AND folder = ? AND name = ?", table),
+			f.fileId, f.folder, f.name).Scan(&lastRow)
+		if err != nil {
+			return nil, err
+		}
+		f.seq = base + lastRow
+		files = append(files, f)
+		afterSeq = f.seq
+	}
+	return files, nil
+}
+
+// The parts of a queued file that still need to be downloaded, in order
+func (st *State) incompleteParts(f queuedFile) ([]DBPart, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var parts []DBPart
+	if f.kind == 0 {
+		rows, err := st.db.Query(`
+			SELECT * FROM manifest_regular_stats
+			WHERE file_id = ? AND folder = ? AND name = ? AND bytes_fetched != size
+			ORDER BY part_id`,
+			f.fileId, f.folder, f.name)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p DBPartRegular
+			err := rows.Scan(&p.FileId, &p.Project, &p.FileName, &p.Folder, &p.PartId, &p.Offset,
+				&p.Size, &p.MD5, &p.BytesFetched, &p.DownloadDoneTime, &p.ChecksumType, &p.Checksum)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, p)
+		}
+		return parts, rows.Err()
+	}
+
+	rows, err := st.db.Query(`
+		SELECT * FROM manifest_symlink_stats
+		WHERE file_id = ? AND folder = ? AND name = ? AND bytes_fetched != size
+		ORDER BY part_id`,
+		f.fileId, f.folder, f.name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p DBPartSymlink
+		err := rows.Scan(&p.FileId, &p.Project, &p.FileName, &p.Folder, &p.PartId, &p.Offset,
+			&p.Size, &p.BytesFetched, &p.DownloadDoneTime)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+// Stream the incomplete parts into the jobs channel, in download order.
+// Files are read from the database a page at a time, so memory use does
+// not depend on the size of the manifest. The channel is closed when all
+// the parts have been queued.
+func (st *State) jobsProducer(jobs chan<- JobInfo) {
+	defer close(jobs)
+
+	numParts := 0
+	queue := func(parts []DBPart) bool {
+		for _, p := range parts {
+			select {
+			case jobs <- JobInfo{part: p, url: nil}:
+			case <-st.stopCh:
+				slog.Info("download stopped, no more parts queued", "num_parts", numParts)
+				return false
+			}
+			numParts++
+		}
+		return true
+	}
+
+	// files handed out ahead of their turn, for the sink
+	staging, _ := st.sink.(stagingSink)
+	early := make(map[inspectKey]bool)
+	lastSeq := int64(0)
+	for {
+		files, err := st.nextQueuedFiles(lastSeq)
+		check(err)
+		if len(files) == 0 {
+			break
+		}
+		for _, f := range files {
+			lastSeq = f.seq
+			key := inspectKey{f.kind, f.fileId, f.folder, f.name}
+			if early[key] {
+				continue
+			}
+			parts, err := st.incompleteParts(f)
+			check(err)
+			for staging != nil && len(parts) > 0 {
+				var size int64
+				for _, p := range parts {
+					size += int64(p.size())
+				}
+				first, ok := staging.admit(key, size)
+				if !ok {
+					slog.Info("download stopped, no more parts queued", "num_parts", numParts)
+					return
+				}
+				if first == nil {
+					break
+				}
+				early[*first] = true
+				firstParts, err := st.incompleteParts(queuedFile{kind: first.kind, fileId: first.fileId, folder: first.folder, name: first.name})
+				check(err)
+				if !queue(firstParts) {
+					return
+				}
+			}
+			if !queue(parts) {
+				return
+			}
+		}
+	}
+	slog.Debug("queued parts for download", "num_parts", numParts)
+}
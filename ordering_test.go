@@ -0,0 +1,108 @@
+package dxda
+
+import (
+	"testing"
+)
+
+// The sequence of files in which parts are dispatched
+func orderedFileIds(t *testing.T, st *State, order string) []string {
+	if err := st.buildDownloadQueue(order); err != nil {
+		t.Fatal(err)
+	}
+	files, err := st.nextQueuedFiles(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fileIds []string
+	for _, f := range files {
+		parts, err := st.incompleteParts(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) == 0 {
+			t.Errorf("Expected incomplete parts for queued file %s", f.fileId)
+		}
+		fileIds = append(fileIds, f.fileId)
+	}
+	return fileIds
+}
+
+func TestDownloadOrder(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(3, 0, 0)
+	large := files[0].manifestEntry("/data")
+	large.Parts = []DXPart{{Id: 1, Size: 100}, {Id: 2, Size: 100}, {Id: 3, Size: 100}}
+	small := files[1].manifestEntry("/data")
+	small.Parts = []DXPart{{Id: 1, Size: 10}}
+	small.Priority = 5
+	medium := files[2].manifestEntry("/data")
+	medium.Parts = []DXPart{{Id: 1, Size: 50}, {Id: 2, Size: 50}}
+	medium.Priority = 10
+	symlink := DXFileSymlink{Folder: "/links", Id: "file-symlink", ProjId: "project-test", Name: "lnk", Size: 20}
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	defer st.Close()
+	st.CreateManifestDB(Manifest{Files: []DXFile{large, small, medium, symlink}}, "test.manifest.json.bz2")
+	if err := st.createPartIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the large file was partially downloaded
+	_, err := st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size WHERE file_id = '" + large.Id + "' AND part_id = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string][]string{
+		OrderManifest:      {large.Id, small.Id, medium.Id, symlink.Id},
+		OrderFileFirst:     {large.Id, small.Id, medium.Id, symlink.Id},
+		OrderSmallestFirst: {small.Id, symlink.Id, medium.Id, large.Id},
+		OrderPriority:      {medium.Id, small.Id, large.Id, symlink.Id},
+	}
+	for order, expected := range cases {
+		fileIds := orderedFileIds(t, st, order)
+		if len(fileIds) != len(expected) {
+			t.Fatalf("Expected %v for order %s, got %v", expected, order, fileIds)
+		}
+		for i := range expected {
+			if fileIds[i] != expected[i] {
+				t.Errorf("Expected %v for order %s, got %v", expected, order, fileIds)
+				break
+			}
+		}
+	}
+
+	// finish partially downloaded files first
+	_, err = st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size WHERE file_id = '" + medium.Id + "' AND part_id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileIds := orderedFileIds(t, st, OrderFileFirst)
+	expected := []string{large.Id, medium.Id, small.Id, symlink.Id}
+	for i := range expected {
+		if fileIds[i] != expected[i] {
+			t.Fatalf("Expected %v for order file, got %v", expected, fileIds)
+		}
+	}
+
+	// completed files are skipped in the manifest order too
+	_, err = st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size WHERE file_id = '" + small.Id + "'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileIds = orderedFileIds(t, st, OrderManifest)
+	expected = []string{large.Id, medium.Id, symlink.Id}
+	if len(fileIds) != len(expected) {
+		t.Fatalf("Expected %v for order manifest, got %v", expected, fileIds)
+	}
+	for i := range expected {
+		if fileIds[i] != expected[i] {
+			t.Fatalf("Expected %v for order manifest, got %v", expected, fileIds)
+		}
+	}
+
+	if err := ValidateOrder("random"); err == nil {
+		t.Errorf("Expected an error for an unsupported order")
+	}
+}
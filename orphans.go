@@ -0,0 +1,192 @@
+package dxda
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A file under the download directory that is not in the manifest
+type InspectOrphan struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Removed bool   `json:"removed"`
+}
+
+// The paths of all the files in the manifest, relative to the download
+// directory
+func (st *State) manifestPaths() map[string]bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	paths := make(map[string]bool)
+	for _, query := range []string{
+		"SELECT DISTINCT folder, name FROM manifest_regular_stats",
+		"SELECT folder, name FROM symlinks",
+	} {
+		rows, err := st.db.Query(query)
+		check(err)
+		for rows.Next() {
+			var folder, name string
+			check(rows.Scan(&folder, &name))
+			paths[filepath.Join(".", folder, name)] = true
+		}
+		check(rows.Err())
+		rows.Close()
+	}
+	return paths
+}
+
+// The local paths a download writes to outside of the manifest tree: the
+// cache and seed directories, and a tar archive. They are recorded so that
+// a later inspection does not report them as orphans, even when they are
+// not given again.
+func (st *State) localPaths() []string {
+	var paths []string
+	for _, p := range []string{st.opts.CacheDir, st.opts.SeedDir} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if st.opts.Output != "" && st.opts.Output != "-" && !IsS3Output(st.opts.Output) {
+		paths = append(paths, st.opts.Output)
+	}
+	return paths
+}
+
+func (st *State) recordLocalPaths() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS local_paths (
+		path text PRIMARY KEY
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	for _, p := range st.localPaths() {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		if _, err := st.db.Exec("INSERT OR IGNORE INTO local_paths VALUES (?)", abs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The local paths of the current options, and of earlier downloads
+func (st *State) recordedLocalPaths() ([]string, error) {
+	paths := st.localPaths()
+	if !st.tableExists("local_paths") {
+		return paths, nil
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	rows, err := st.db.Query("SELECT path FROM local_paths")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
+
+// FindOrphans lists the files under the download directory that are not
+// in the manifest. The manifest, its database and its logs are not
+// orphans, nor are the extra paths given, such as the inspection report,
+// nor anything under the cache, seed or output paths of a download.
+func (st *State) FindOrphans(exclude ...string) ([]InspectOrphan, error) {
+	paths := st.manifestPaths()
+	local, err := st.recordedLocalPaths()
+	if err != nil {
+		return nil, err
+	}
+	exclude = append(exclude, local...)
+
+	// files named after the manifest belong to the download agent
+	agentPrefix, err := filepath.Abs(st.manifestFname)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[string]bool)
+	for _, p := range exclude {
+		if p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		excluded[abs] = true
+	}
+
+	isBag := st.IsBag()
+	orphans := []InspectOrphan{}
+	err = filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if excluded[abs] && path != "." {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if paths[path] || isChecksumFile(path, paths) || (isBag && isBagTagFile(path)) || path == provenanceFile {
+			return nil
+		}
+		if excluded[abs] || strings.HasPrefix(abs, agentPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		orphans = append(orphans, InspectOrphan{Path: path, Size: info.Size()})
+		return nil
+	})
+	return orphans, err
+}
+
+// InspectOrphans adds the orphan files to the report, see RemoveOrphans
+// to remove them.
+func (st *State) InspectOrphans(report *InspectReport, exclude ...string) error {
+	orphans, err := st.FindOrphans(exclude...)
+	if err != nil {
+		return err
+	}
+	report.Orphans = orphans
+	report.Totals.NumOrphans = int64(len(orphans))
+	return nil
+}
+
+// RemoveOrphans removes the orphan files of the report, unless this is a
+// dry run. The caller is expected to confirm the list first.
+func (st *State) RemoveOrphans(report *InspectReport) error {
+	if st.opts.DryRun {
+		return nil
+	}
+	for i := range report.Orphans {
+		if err := os.Remove(report.Orphans[i].Path); err != nil {
+			return err
+		}
+		report.Orphans[i].Removed = true
+	}
+	return nil
+}
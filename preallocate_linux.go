@@ -0,0 +1,24 @@
+package dxda
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Reserve disk blocks for the entire file up front. This keeps large files
+// contiguous even though parts are written out of order, and surfaces a
+// disk-full condition before any bytes are fetched.
+//
+// Filesystems that do not implement fallocate get a sparse file of the
+// correct length instead.
+func preallocateFile(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package dxda
+
+import "os"
+
+// fallocate is Linux specific. Elsewhere, extend the file to its final
+// length, which at least avoids repeated size changes while writing parts.
+func preallocateFile(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,236 @@
+package dxda
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Output formats for progress reports
+const (
+	ProgressFormatText = "text"
+	ProgressFormatJSON = "json"
+)
+
+// ValidateProgressFormat checks that a progress format is supported
+func ValidateProgressFormat(format string) error {
+	switch format {
+	case "", ProgressFormatText, ProgressFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unsupported progress format %q, expected %s or %s",
+		format, ProgressFormatText, ProgressFormatJSON)
+}
+
+// Where the progress reports are written
+func (st *State) progressStream() io.Writer {
+	if st.opts.ProgressStream != nil {
+		return st.opts.ProgressStream
+	}
+	return os.Stdout
+}
+
+// ProgressReport is a snapshot of the download progress. Its JSON encoding
+// is a stable interface, documented in the README. Fields are only ever
+// added, never renamed or removed.
+type ProgressReport struct {
+	Timestamp     string `json:"timestamp"` // RFC 3339
+	BytesComplete int64  `json:"bytes_complete"`
+	BytesTotal    int64  `json:"bytes_total"`
+	PartsComplete int64  `json:"parts_complete"`
+	PartsTotal    int64  `json:"parts_total"`
+
+	// Bandwidth in MiB per second, estimated over the last window_sec seconds
+	BandwidthMBSec float64 `json:"bandwidth_mb_per_sec"`
+	WindowSec      int64   `json:"window_sec"`
+
+	// Estimated seconds until the download completes. Null when the
+	// bandwidth is zero, and the estimate is meaningless.
+	EtaSec *int64 `json:"eta_sec"`
+
+	// Only known to the process performing the download. Null when
+	// reported by a separate process, such as the progress subcommand.
+	FailedParts   *int64 `json:"failed_parts"`
+	ActiveWorkers *int   `json:"active_workers"`
+}
+
+// Estimated time to download the remaining bytes, at the current bandwidth
+func estimateEta(bytesRemaining int64, bandwidthMBSec float64) *int64 {
+	if bytesRemaining <= 0 {
+		eta := int64(0)
+		return &eta
+	}
+	if bandwidthMBSec <= 0 {
+		return nil
+	}
+	eta := int64(float64(bytesRemaining) / (bandwidthMBSec * MiB))
+	return &eta
+}
+
+// JSON encoding of the report, on a single line
+func (r ProgressReport) JSON() string {
+	data, err := json.Marshal(r)
+	check(err)
+	return string(data)
+}
+
+// Build a report on the progress so far, and record it in the download
+// status. The bandwidth is estimated from parts completed in the time window.
+func (st *State) progressReport(timeWindowNanoSec int64) ProgressReport {
+	report := st.currentProgress(timeWindowNanoSec)
+	st.ds.NumBytesComplete = report.BytesComplete
+	st.ds.NumPartsComplete = report.PartsComplete
+	return report
+}
+
+// Build a report on the progress so far. Unlike progressReport, this does
+// not modify the download status, and can be called from any thread once
+// the status is initialized.
+func (st *State) currentProgress(timeWindowNanoSec int64) ProgressReport {
+	// query the current progress
+	bytesComplete :=
+		st.queryDBIntegerResult("SELECT SUM(bytes_fetched) FROM manifest_regular_stats WHERE bytes_fetched = size") +
+			st.queryDBIntegerResult("SELECT SUM(bytes_fetched) FROM manifest_symlink_stats WHERE bytes_fetched = size")
+	partsComplete :=
+		st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_regular_stats WHERE bytes_fetched = size") +
+			st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_symlink_stats WHERE bytes_fetched = size")
+
+	// calculate bandwitdh
+	bandwidthMBSec := st.calcBandwidth(timeWindowNanoSec)
+
+	report := ProgressReport{
+		Timestamp:      time.Now().Format(time.RFC3339),
+		BytesComplete:  bytesComplete,
+		BytesTotal:     st.ds.NumBytes,
+		PartsComplete:  partsComplete,
+		PartsTotal:     st.ds.NumParts,
+		BandwidthMBSec: bandwidthMBSec,
+		WindowSec:      timeWindowNanoSec / 1e9,
+		EtaSec:         estimateEta(st.ds.NumBytes-bytesComplete, bandwidthMBSec),
+	}
+
+	// a download is running in this process
+	if st.gate != nil {
+		failedParts := st.stats.failedParts.Load()
+		activeWorkers := st.gate.numActive()
+		report.FailedParts = &failedParts
+		report.ActiveWorkers = &activeWorkers
+	}
+	return report
+}
+
+// Human readable form of an ETA, for example 2h13m or 45s
+func etaString(etaSec int64) string {
+	d := time.Duration(etaSec) * time.Second
+	if d >= time.Hour {
+		d = d.Round(time.Minute)
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	return s
+}
+
+// Progress of a single file
+type FileProgress struct {
+	FileId        string `json:"file_id"`
+	Folder        string `json:"folder"`
+	Name          string `json:"name"`
+	BytesComplete int64  `json:"bytes_complete"`
+	BytesTotal    int64  `json:"bytes_total"`
+	PartsComplete int64  `json:"parts_complete"`
+	PartsTotal    int64  `json:"parts_total"`
+}
+
+func (fp FileProgress) percent() float64 {
+	if fp.BytesTotal == 0 {
+		return 100
+	}
+	return 100 * float64(fp.BytesComplete) / float64(fp.BytesTotal)
+}
+
+// FilesReport summarizes the download progress by file. Files in flight
+// have some, but not all, of their parts downloaded.
+type FilesReport struct {
+	FilesComplete  int64          `json:"files_complete"`
+	FilesRemaining int64          `json:"files_remaining"`
+	FilesInFlight  []FileProgress `json:"files_in_flight"`
+}
+
+// Build a report on the progress of each file, from the parts recorded
+// in the database.
+func (st *State) FilesProgressReport() (FilesReport, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	report := FilesReport{FilesInFlight: []FileProgress{}}
+	for _, table := range []string{"manifest_regular_stats", "manifest_symlink_stats"} {
+		rows, err := st.db.Query(fmt.Sprintf(`
+			SELECT file_id, folder, name,
+				SUM(CASE WHEN bytes_fetched = size THEN size ELSE 0 END),
+				SUM(size),
+				SUM(bytes_fetched = size),
+				COUNT(*)
+			FROM %s GROUP BY file_id, folder, name ORDER BY MIN(rowid)`, table))
+		if err != nil {
+			return report, err
+		}
+		for rows.Next() {
+			var fp FileProgress
+			err := rows.Scan(&fp.FileId, &fp.Folder, &fp.Name,
+				&fp.BytesComplete, &fp.BytesTotal, &fp.PartsComplete, &fp.PartsTotal)
+			if err != nil {
+				rows.Close()
+				return report, err
+			}
+			switch {
+			case fp.PartsComplete == fp.PartsTotal:
+				report.FilesComplete++
+			case fp.PartsComplete > 0:
+				report.FilesInFlight = append(report.FilesInFlight, fp)
+				report.FilesRemaining++
+			default:
+				report.FilesRemaining++
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// files closest to completion first
+	sort.SliceStable(report.FilesInFlight, func(i, j int) bool {
+		return report.FilesInFlight[i].percent() > report.FilesInFlight[j].percent()
+	})
+	return report, nil
+}
+
+// Text form of the per-file report, one line per file in flight
+func (r FilesReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Files: %d complete, %d remaining, %d in flight\n",
+		r.FilesComplete, r.FilesRemaining, len(r.FilesInFlight))
+	for _, fp := range r.FilesInFlight {
+		fmt.Fprintf(&sb, "%5.1f%%  %d/%d MB  %d/%d Parts  %s (%s)\n",
+			fp.percent(),
+			bytes2MiB(fp.BytesComplete), bytes2MiB(fp.BytesTotal),
+			fp.PartsComplete, fp.PartsTotal,
+			path.Join(fp.Folder, fp.Name), fp.FileId)
+	}
+	return sb.String()
+}
+
+// JSON encoding of the per-file report, on a single line
+func (r FilesReport) JSON() string {
+	data, err := json.Marshal(r)
+	check(err)
+	return string(data)
+}
@@ -0,0 +1,79 @@
+package dxda
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestProgressReportJSON(t *testing.T) {
+	eta := estimateEta(100*MiB, 10)
+	if eta == nil || *eta != 10 {
+		t.Errorf("Expected an ETA of 10 seconds, got %v", eta)
+	}
+	if eta := estimateEta(100*MiB, 0); eta != nil {
+		t.Errorf("Expected no ETA without bandwidth, got %d", *eta)
+	}
+	if eta := estimateEta(0, 0); eta == nil || *eta != 0 {
+		t.Errorf("Expected a zero ETA for a complete download")
+	}
+
+	report := ProgressReport{BytesComplete: 10, BytesTotal: 20, PartsComplete: 1, PartsTotal: 2, WindowSec: 60}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(report.JSON()), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"timestamp", "bytes_complete", "bytes_total", "parts_complete", "parts_total",
+		"bandwidth_mb_per_sec", "window_sec", "eta_sec", "failed_parts", "active_workers"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("Missing field %s in the JSON report", key)
+		}
+	}
+	if fields["failed_parts"] != nil {
+		t.Errorf("Expected failed_parts to be null outside of a download")
+	}
+
+	if err := ValidateProgressFormat("xml"); err == nil {
+		t.Errorf("Expected an error for an unsupported progress format")
+	}
+}
+
+func TestFilesProgressReport(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(3, 0, 0)
+	var manifest Manifest
+	for _, f := range files {
+		entry := f.manifestEntry("/data")
+		entry.Parts = []DXPart{{Id: 1, Size: 100}, {Id: 2, Size: 100}, {Id: 3, Size: 100}, {Id: 4, Size: 100}}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2})
+	defer st.Close()
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+
+	// the first file is complete, the last one three quarters done
+	_, err := st.db.Exec("UPDATE manifest_regular_stats SET bytes_fetched = size WHERE file_id = ? OR (file_id = ? AND part_id < 4)",
+		files[0].id, files[2].id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := st.FilesProgressReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilesComplete != 1 || report.FilesRemaining != 2 || len(report.FilesInFlight) != 1 {
+		t.Fatalf("Unexpected file counts %+v", report)
+	}
+	fp := report.FilesInFlight[0]
+	if fp.FileId != files[2].id || fp.BytesComplete != 300 || fp.PartsComplete != 3 || fp.PartsTotal != 4 {
+		t.Errorf("Unexpected progress for the file in flight %+v", fp)
+	}
+	if !strings.Contains(report.String(), " 75.0%") {
+		t.Errorf("Expected the percent complete in the report:\n%s", report.String())
+	}
+
+	if s := etaString(2*3600 + 13*60 + 7); s != "2h13m" {
+		t.Errorf("Expected an ETA of 2h13m, got %s", s)
+	}
+}
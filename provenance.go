@@ -0,0 +1,270 @@
+package dxda
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Outputs that record where each downloaded file came from
+const (
+	// Extended attributes on each file, Linux only
+	ProvenanceXattr = "xattr"
+
+	// A provenance.jsonl file in the download directory, one line per file
+	ProvenanceJSONL = "jsonl"
+)
+
+const provenanceFile = "provenance.jsonl"
+
+// Extended attributes written on each file. The part checksums of a large
+// file do not fit in an attribute, so the SHA-256 digest of the list is
+// recorded instead, see checksumsDigest.
+const (
+	xattrFileId          = "user.dnanexus.file_id"
+	xattrProject         = "user.dnanexus.project"
+	xattrChecksumType    = "user.dnanexus.checksum_type"
+	xattrChecksumsDigest = "user.dnanexus.checksums_sha256"
+)
+
+var errXattrUnsupported = errors.New("extended attributes are not supported")
+
+// ParseProvenance checks a comma separated list of provenance outputs
+func ParseProvenance(s string) (map[string]bool, error) {
+	outputs := make(map[string]bool)
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		switch o {
+		case ProvenanceXattr, ProvenanceJSONL:
+			outputs[o] = true
+		default:
+			return nil, fmt.Errorf("unknown provenance output %q, expected %s or %s",
+				o, ProvenanceXattr, ProvenanceJSONL)
+		}
+	}
+	return outputs, nil
+}
+
+// ProvenanceRecord is a line of provenance.jsonl. Its JSON encoding is a
+// stable interface, documented in the README.
+type ProvenanceRecord struct {
+	FileId       string   `json:"file_id"`
+	Project      string   `json:"project"`
+	PlatformPath string   `json:"platform_path"` // folder and name on DNAnexus
+	LocalPath    string   `json:"local_path"`    // relative to the download directory
+	Size         int64    `json:"size"`
+	Kind         string   `json:"kind"` // regular or symlink
+	ChecksumType string   `json:"checksum_type"`
+	Checksums    []string `json:"checksums"`
+
+	// The digest of the checksums, as in the extended attributes
+	ChecksumsDigest string `json:"checksums_sha256"`
+
+	// Times the first and the last part of the file were downloaded, RFC 3339
+	DownloadStarted   string `json:"download_started"`
+	DownloadCompleted string `json:"download_completed"`
+
+	ToolVersion string `json:"tool_version"`
+}
+
+// The checksum type and checksums of a completed file, as listed in the
+// manifest
+func provenanceChecksums(f completedFile) (string, []string) {
+	if f.kind == 1 {
+		return "MD5", []string{f.md5}
+	}
+	checksumType := "MD5"
+	var sums []string
+	for _, p := range f.parts {
+		if p.ChecksumType != "" {
+			checksumType = p.ChecksumType
+			sums = append(sums, p.Checksum)
+		} else {
+			sums = append(sums, p.MD5)
+		}
+	}
+	return checksumType, sums
+}
+
+// The SHA-256 digest, in hex, of the checksums joined by commas. It has
+// the same size for any number of parts.
+func checksumsDigest(sums []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(sums, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Writes the provenance of files as they complete, and of all the
+// completed files at the end of the download.
+type provenanceWriter struct {
+	st          *State
+	xattr       bool
+	jsonl       bool
+	xattrFailed atomic.Bool // warned that extended attributes are unsupported
+}
+
+// Returns nil if no provenance output is requested in the options
+func newProvenanceWriter(st *State) (*provenanceWriter, error) {
+	if st.opts.Provenance == "" {
+		return nil, nil
+	}
+	outputs, err := ParseProvenance(st.opts.Provenance)
+	if err != nil {
+		return nil, err
+	}
+	return &provenanceWriter{
+		st:    st,
+		xattr: outputs[ProvenanceXattr],
+		jsonl: outputs[ProvenanceJSONL],
+	}, nil
+}
+
+// The extended attributes recording the provenance of a file, as name and
+// value pairs
+func provenanceXattrs(f completedFile) [][2]string {
+	checksumType, sums := provenanceChecksums(f)
+	return [][2]string{
+		{xattrFileId, f.fileId},
+		{xattrProject, f.project},
+		{xattrChecksumType, checksumType},
+		{xattrChecksumsDigest, checksumsDigest(sums)},
+	}
+}
+
+// Set the extended attributes of a file. A filesystem without extended
+// attributes is reported once, and not tried again.
+func (pw *provenanceWriter) setXattrs(f completedFile) {
+	if pw == nil || !pw.xattr || pw.xattrFailed.Load() {
+		return
+	}
+	for _, attr := range provenanceXattrs(f) {
+		err := setXattr(f.path(), attr[0], attr[1])
+		if errors.Is(err, errXattrUnsupported) {
+			if !pw.xattrFailed.Swap(true) {
+				slog.Warn("the filesystem does not support extended attributes, provenance is not recorded on the files",
+					"path", f.path())
+			}
+			return
+		}
+		if err != nil {
+			slog.Warn("could not set extended attribute", "file_id", f.fileId, "path", f.path(),
+				"attribute", attr[0], "error", err)
+			return
+		}
+	}
+}
+
+// The first and last part completion times of each file, by kind and ID
+func (st *State) fileDownloadTimes() map[inspectKey][2]int64 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	times := make(map[inspectKey][2]int64)
+	for kind, table := range []string{"manifest_regular_stats", "manifest_symlink_stats"} {
+		rows, err := st.db.Query(fmt.Sprintf(`
+			SELECT file_id, folder, name, MIN(download_done_time), MAX(download_done_time)
+			FROM %s GROUP BY file_id, folder, name`, table))
+		check(err)
+		for rows.Next() {
+			key := inspectKey{kind: kind}
+			var first, last int64
+			check(rows.Scan(&key.fileId, &key.folder, &key.name, &first, &last))
+			times[key] = [2]int64{first, last}
+		}
+		check(rows.Err())
+		rows.Close()
+	}
+	return times
+}
+
+// ProvenanceRecords describes every completely downloaded file, sorted by
+// local path.
+func (st *State) ProvenanceRecords() ([]ProvenanceRecord, error) {
+	files, err := st.completeFiles()
+	if err != nil {
+		return nil, err
+	}
+	times := st.fileDownloadTimes()
+	isBag := st.IsBag()
+
+	records := make([]ProvenanceRecord, 0, len(files))
+	for _, f := range files {
+		folder := f.folder
+		if isBag {
+			folder = "/" + strings.TrimPrefix(strings.TrimPrefix(folder, "/"+bagPayloadDir), "/")
+		}
+		r := ProvenanceRecord{
+			FileId:       f.fileId,
+			Project:      f.project,
+			PlatformPath: path.Join(folder, f.name),
+			LocalPath:    filepath.ToSlash(filepath.Join(".", f.folder, f.name)),
+			Size:         f.size,
+			Kind:         "regular",
+			ToolVersion:  Version,
+		}
+		if f.kind == 1 {
+			r.Kind = "symlink"
+		}
+		r.ChecksumType, r.Checksums = provenanceChecksums(f)
+		r.ChecksumsDigest = checksumsDigest(r.Checksums)
+		t := times[inspectKey{f.kind, f.fileId, f.folder, f.name}]
+		r.DownloadStarted = time.Unix(0, t[0]).Format(time.RFC3339)
+		r.DownloadCompleted = time.Unix(0, t[1]).Format(time.RFC3339)
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].LocalPath < records[j].LocalPath })
+	return records, nil
+}
+
+// WriteProvenance writes the provenance of all the completely downloaded
+// files, in the outputs selected.
+func (st *State) WriteProvenance(xattr bool, jsonl bool) error {
+	if xattr && st.tableExists("file_duplicates") && st.dedupeMode() == DedupeHardlink {
+		return fmt.Errorf("the duplicate files are hard links, and would share their extended attributes")
+	}
+	pw := &provenanceWriter{st: st, xattr: xattr, jsonl: jsonl}
+	return pw.writeAll()
+}
+
+func (pw *provenanceWriter) writeAll() error {
+	if pw == nil {
+		return nil
+	}
+	// files moved out of the download directory have their attributes in
+	// the output
+	if pw.xattr && pw.st.sink.keepsFiles() {
+		files, err := pw.st.completeFiles()
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			pw.setXattrs(f)
+		}
+	}
+	if !pw.jsonl {
+		return nil
+	}
+	records, err := pw.st.ProvenanceRecords()
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		sb.Write(data)
+		sb.WriteString("\n")
+	}
+	return os.WriteFile(provenanceFile, []byte(sb.String()), 0644)
+}
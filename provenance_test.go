@@ -0,0 +1,63 @@
+package dxda
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	files := makeTestFiles(2, 300*KiB, 128*KiB)
+	st := downloadTestFiles(t, Opts{NumThreads: 2, Provenance: "xattr,jsonl"}, files)
+
+	data, err := os.ReadFile(provenanceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(files) {
+		t.Fatalf("Expected %d records, got %q", len(files), data)
+	}
+	for i, f := range files {
+		var r ProvenanceRecord
+		if err := json.Unmarshal([]byte(lines[i]), &r); err != nil {
+			t.Fatal(err)
+		}
+		entry := f.manifestEntry("/exome")
+		if r.FileId != f.id || r.Project != entry.ProjId || r.PlatformPath != "/exome/"+f.name ||
+			r.LocalPath != "exome/"+f.name || r.Size != int64(len(f.data)) || r.Kind != "regular" {
+			t.Errorf("Unexpected record %+v", r)
+		}
+		if r.ChecksumType != "MD5" || len(r.Checksums) != 3 || r.Checksums[0] != entry.Parts[0].MD5 ||
+			r.ChecksumsDigest != checksumsDigest(r.Checksums) {
+			t.Errorf("Expected the part checksums, got %s %v", r.ChecksumType, r.Checksums)
+		}
+		if r.DownloadStarted == "" || r.DownloadCompleted < r.DownloadStarted || r.ToolVersion != Version {
+			t.Errorf("Unexpected times or version in %+v", r)
+		}
+	}
+
+	orphans, err := st.FindOrphans()
+	if err != nil || len(orphans) != 0 {
+		t.Errorf("Expected %s not to be an orphan, got %+v", provenanceFile, orphans)
+	}
+
+	fileId, err := getXattr("exome/"+files[0].name, xattrFileId)
+	if errors.Is(err, errXattrUnsupported) {
+		t.Skip("extended attributes are not supported here")
+	}
+	if err != nil || fileId != files[0].id {
+		t.Errorf("Expected the file ID in the extended attributes, got %q %v", fileId, err)
+	}
+	// the digest of the part checksums, whatever the number of parts
+	var parts []string
+	for _, p := range files[0].manifestEntry("/exome").Parts {
+		parts = append(parts, p.MD5)
+	}
+	digest, err := getXattr("exome/"+files[0].name, xattrChecksumsDigest)
+	if err != nil || digest != checksumsDigest(parts) || len(digest) != 64 {
+		t.Errorf("Expected the digest of the part checksums in the extended attributes, got %q %v", digest, err)
+	}
+}
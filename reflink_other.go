@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dxda
+
+import "errors"
+
+// Reflinks are only created on Linux
+func reflinkPath(src string, dst string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
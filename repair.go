@@ -0,0 +1,175 @@
+package dxda
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ReadInspectReport reads a report written by InspectReport.Write, in JSON
+// or CSV format depending on the file name.
+func ReadInspectReport(fname string) (*InspectReport, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !strings.HasSuffix(strings.ToLower(fname), ".csv") {
+		var report InspectReport
+		if err := json.NewDecoder(f).Decode(&report); err != nil {
+			return nil, fmt.Errorf("could not parse report %s: %w", fname, err)
+		}
+		return &report, nil
+	}
+	return readInspectReportCSV(f)
+}
+
+// Rebuild a report from its CSV form, where a file with several failed
+// parts spans consecutive rows.
+func readInspectReportCSV(r io.Reader) (*InspectReport, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || len(records[0]) != 12 || records[0][0] != "file_id" {
+		return nil, fmt.Errorf("not an inspect report, the CSV header does not match")
+	}
+
+	report := &InspectReport{}
+	for _, rec := range records[1:] {
+		size, err := strconv.ParseInt(rec[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad size %q for %s", rec[4], rec[0])
+		}
+		if rec[3] == "orphan" {
+			report.Orphans = append(report.Orphans, InspectOrphan{Path: rec[2], Size: size, Removed: rec[5] == "removed"})
+			continue
+		}
+		n := len(report.Files)
+		if n == 0 || report.Files[n-1].FileId != rec[0] || report.Files[n-1].Path != rec[2] {
+			report.Files = append(report.Files, InspectFile{
+				FileId:       rec[0],
+				Project:      rec[1],
+				Path:         rec[2],
+				Kind:         rec[3],
+				Size:         size,
+				Status:       rec[5],
+				ChecksumType: rec[6],
+			})
+			n++
+		}
+		file := &report.Files[n-1]
+		if rec[7] == "" {
+			file.Expected, file.Computed, file.Message = rec[9], rec[10], rec[11]
+			continue
+		}
+		partId, err := strconv.Atoi(rec[7])
+		if err != nil {
+			return nil, fmt.Errorf("bad part id %q for %s", rec[7], rec[0])
+		}
+		file.FailedParts = append(file.FailedParts, InspectPart{
+			PartId:   partId,
+			Status:   rec[8],
+			Expected: rec[9],
+			Computed: rec[10],
+			Message:  rec[11],
+		})
+	}
+	return report, nil
+}
+
+// Find the folder and name of a file in the database, from its path in a
+// report. Returns false if the manifest has no such file.
+func (st *State) lookupReportFile(f InspectFile) (string, string, bool) {
+	query := "SELECT DISTINCT folder, name FROM manifest_regular_stats WHERE file_id = ?"
+	if f.Kind == "symlink" {
+		query = "SELECT folder, name FROM symlinks WHERE id = ?"
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	rows, err := st.db.Query(query, f.FileId)
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		var folder, name string
+		check(rows.Scan(&folder, &name))
+		if filepath.Join(".", folder, name) == filepath.Clean(f.Path) {
+			return folder, name, true
+		}
+	}
+	return "", "", false
+}
+
+// Repair resets the files and parts that failed inspection, so that they
+// are downloaded again on the next run. Missing files, and symbolic links
+// that do not match, are reset as a whole; regular files only have their
+// failed parts reset, and are truncated if they are too long. Only the
+// copy of a file at the path in the report is reset. The whole report is
+// checked against the manifest before anything is changed. Returns the
+// number of files reset.
+func (st *State) Repair(report *InspectReport) (int, error) {
+	type repairFile struct {
+		InspectFile
+		folder string
+		name   string
+	}
+	var files []repairFile
+	for _, f := range report.Files {
+		if f.Status != statusMissing && f.Status != statusMismatch {
+			continue
+		}
+		folder, name, ok := st.lookupReportFile(f)
+		if !ok {
+			return 0, fmt.Errorf("file %s (%s) from the report is not in the manifest, nothing was reset", f.Path, f.FileId)
+		}
+		files = append(files, repairFile{f, folder, name})
+	}
+
+	numReset := 0
+	for _, f := range files {
+		folder, name := f.folder, f.name
+		kind := 0
+		if f.Kind == "symlink" {
+			kind = 1
+		}
+		st.forgetVerification(inspectKey{kind, f.FileId, folder, name})
+
+		switch {
+		case f.Kind == "symlink":
+			st.resetSymlinkFile(DXFileSymlink{Id: f.FileId, Folder: folder, Name: name})
+		case f.Status == statusMissing:
+			st.resetRegularFile(DBPartRegular{FileId: f.FileId, Folder: folder, FileName: name})
+		default:
+			// the parts are written again in place, a file linked from
+			// the cache or from a duplicate gets its own copy first
+			if err := unshareFile(filepath.Join(".", folder, name)); err != nil && !os.IsNotExist(err) {
+				return numReset, err
+			}
+			for _, p := range f.FailedParts {
+				if p.Status != statusMismatch {
+					continue
+				}
+				st.resetDBPart(DBPartRegular{FileId: f.FileId, Folder: folder, FileName: name, PartId: p.PartId})
+			}
+			// drop data appended past the end of the file
+			fname := filepath.Join(".", folder, name)
+			if fi, err := os.Stat(fname); err == nil && fi.Size() > f.Size {
+				if err := os.Truncate(fname, f.Size); err != nil {
+					return numReset, err
+				}
+			}
+		}
+		if st.opts.Verbose {
+			fmt.Printf("Reset %s (%s), status %s\n", f.Path, f.FileId, f.Status)
+		}
+		numReset++
+	}
+	return numReset, nil
+}
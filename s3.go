@@ -0,0 +1,329 @@
+package dxda
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A minimal client for the S3 API, enough to upload objects in parts to
+// AWS S3 and compatible stores such as MinIO. Requests use path style
+// addressing, and are signed with AWS signature version 4. The
+// credentials are taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables.
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	httpClient   *http.Client
+}
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3NumRetries    = 3
+)
+
+// An error returned by the S3 API
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Whether an upload is unknown to the store, for example because it
+// expired or was aborted
+func isNoSuchUpload(err error) bool {
+	var s3Err *s3Error
+	return errors.As(err, &s3Err) && s3Err.Code == "NoSuchUpload"
+}
+
+// IsS3Output tells if the output of a download is an S3 location, of the
+// form s3://bucket/prefix
+func IsS3Output(output string) bool {
+	return strings.HasPrefix(output, "s3://")
+}
+
+func parseS3Output(output string) (string, string, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(output, "s3://"), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid S3 output %q, expected s3://bucket/prefix", output)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+func newS3Client(endpoint string, region string) (*s3Client, error) {
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	c := &s3Client{
+		endpoint:     u,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		httpClient:   &http.Client{Timeout: requestOverallTimeout},
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("could not find S3 credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return c, nil
+}
+
+// Encode a string as S3 expects in signed requests: everything but the
+// unreserved characters, and slashes in paths.
+func s3Escape(s string, path bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '.' || b == '_' || b == '~' || (path && b == '/') {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a request with AWS signature version 4. The host, and all the
+// headers set on the request, are signed.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// Issue a request on an object, retrying on network errors and server
+// errors. Returns the response headers and body.
+func (c *s3Client) do(
+	method string,
+	bucket string,
+	key string,
+	query map[string]string,
+	headers map[string]string,
+	body []byte) (http.Header, []byte, error) {
+
+	// the query is encoded in canonical order, as it is signed
+	params := make([]string, 0, len(query))
+	for k, v := range query {
+		params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+	}
+	sort.Strings(params)
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(c.endpoint.EscapedPath(), "/") + "/" + s3Escape(bucket, false) + "/" + s3Escape(key, true)
+	u.RawQuery = strings.Join(params, "&")
+	payloadHash := sha256.Sum256(body)
+
+	var lastErr error
+	for attempt := 0; attempt < s3NumRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		req, err := http.NewRequestWithContext(context.TODO(), method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		c.sign(req, hex.EncodeToString(payloadHash[:]), time.Now())
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			s3Err := &s3Error{StatusCode: resp.StatusCode}
+			xml.Unmarshal(data, s3Err)
+			if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+				lastErr = s3Err
+				continue
+			}
+			return nil, nil, s3Err
+		}
+		return resp.Header, data, nil
+	}
+	return nil, nil, lastErr
+}
+
+// Start a multipart upload, returning its ID
+func (c *s3Client) createMultipartUpload(bucket string, key string, metadata map[string]string) (string, error) {
+	headers := make(map[string]string)
+	for k, v := range metadata {
+		headers["X-Amz-Meta-"+k] = v
+	}
+	_, data, err := c.do("POST", bucket, key, map[string]string{"uploads": ""}, headers, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	if result.UploadId == "" {
+		return "", fmt.Errorf("no upload ID in the response to creating an upload of %s", key)
+	}
+	return result.UploadId, nil
+}
+
+// Upload a part, returning its ETag. The store checks the MD5 checksum of
+// the data.
+func (c *s3Client) uploadPart(bucket string, key string, uploadId string, partNumber int, data []byte) (string, error) {
+	sum := md5.Sum(data)
+	query := map[string]string{"partNumber": fmt.Sprint(partNumber), "uploadId": uploadId}
+	headers := map[string]string{"Content-Md5": base64.StdEncoding.EncodeToString(sum[:])}
+	respHeaders, _, err := c.do("PUT", bucket, key, query, headers, data)
+	if err != nil {
+		return "", err
+	}
+	return respHeaders.Get("ETag"), nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Assemble the uploaded parts into the object
+func (c *s3Client) completeMultipartUpload(bucket string, key string, uploadId string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	_, data, err := c.do("POST", bucket, key, map[string]string{"uploadId": uploadId}, nil, body)
+	if err != nil {
+		return err
+	}
+	// errors may come after a success status, once the parts are assembled
+	if bytes.Contains(data, []byte("<Error>")) {
+		s3Err := &s3Error{StatusCode: http.StatusOK}
+		xml.Unmarshal(data, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+// Abort a multipart upload, discarding its parts. An upload that is
+// already gone is not an error.
+func (c *s3Client) abortMultipartUpload(bucket string, key string, uploadId string) error {
+	_, _, err := c.do("DELETE", bucket, key, map[string]string{"uploadId": uploadId}, nil, nil)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// Upload a whole object in one request
+func (c *s3Client) putObject(bucket string, key string, data []byte, metadata map[string]string) error {
+	headers := make(map[string]string)
+	for k, v := range metadata {
+		headers["X-Amz-Meta-"+k] = v
+	}
+	_, _, err := c.do("PUT", bucket, key, nil, headers, data)
+	return err
+}
+
+// Read a range of an object, from start to end inclusive
+func (c *s3Client) getObjectRange(bucket string, key string, start int64, end int64) ([]byte, error) {
+	headers := map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", start, end)}
+	_, data, err := c.do("GET", bucket, key, nil, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("read %d bytes of %s at offset %d, expected %d", len(data), key, start, end-start+1)
+	}
+	return data, nil
+}
+
+// Delete an object
+func (c *s3Client) deleteObject(bucket string, key string) error {
+	_, _, err := c.do("DELETE", bucket, key, nil, nil, nil)
+	return err
+}
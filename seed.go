@@ -0,0 +1,293 @@
+package dxda
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Seeding starts a download from an existing copy of some of its files,
+// for example left by an older rsync of the same dataset. Each queued file
+// is looked up at the same path in the seed directory. A file whose parts
+// all match the manifest is linked or copied into place as a whole;
+// otherwise the parts that match are copied into the local file, and only
+// the others are downloaded.
+type seeder struct {
+	st       *State
+	dir      string
+	mode     string // how whole files are linked from the seed directory
+	bag      bool   // files are in the payload directory of a bag
+	fellBack atomic.Bool
+
+	numFiles int
+	numParts int
+	numBytes int64
+}
+
+// ValidateSeedMode checks how files are linked from the seed directory
+func ValidateSeedMode(mode string) error {
+	switch mode {
+	case "", DedupeHardlink, DedupeReflink, DedupeCopy:
+		return nil
+	}
+	return fmt.Errorf("unsupported seed mode %q, expected one of %s",
+		mode, strings.Join([]string{DedupeHardlink, DedupeReflink, DedupeCopy}, ", "))
+}
+
+// Whether a part read from a seed file matches the manifest. Parts
+// without a checksum that can be verified do not match.
+func seedPartMatches(p DBPartRegular, data []byte) bool {
+	if len(data) != p.Size {
+		return false
+	}
+	verified := false
+	if p.MD5 != "" {
+		sum := md5.Sum(data)
+		if hex.EncodeToString(sum[:]) != p.MD5 {
+			return false
+		}
+		verified = true
+	}
+	if p.ChecksumType != "" {
+		sum, err := CalculateChecksum(p.ChecksumType, data)
+		if err != nil || sum != p.Checksum {
+			return false
+		}
+		verified = true
+	}
+	return verified
+}
+
+// The path of a file in the seed directory. Bags keep the layout of the
+// manifest under their payload directory, the seed tree does not.
+func (s *seeder) seedPath(f completedFile) string {
+	folder := f.folder
+	if s.bag {
+		folder = strings.TrimPrefix(folder, "/"+bagPayloadDir)
+	}
+	return filepath.Join(s.dir, folder, f.name)
+}
+
+// Seed the queued files from Opts.SeedDir, before they are downloaded
+func (st *State) seedFromDir() error {
+	if st.opts.SeedDir == "" {
+		return nil
+	}
+	s := &seeder{st: st, dir: st.opts.SeedDir, mode: st.opts.SeedMode, bag: st.IsBag()}
+	if s.mode == "" {
+		s.mode = DedupeReflink
+	}
+	if _, err := os.Stat(s.dir); err != nil {
+		return fmt.Errorf("could not read the seed directory: %w", err)
+	}
+
+	var afterSeq int64
+	for {
+		queued, err := st.nextQueuedFiles(afterSeq)
+		if err != nil {
+			return err
+		}
+		if len(queued) == 0 {
+			break
+		}
+		for _, q := range queued {
+			afterSeq = q.seq
+			if err := s.seedFile(inspectKey{q.kind, q.fileId, q.folder, q.name}); err != nil {
+				return err
+			}
+		}
+	}
+	if s.numFiles > 0 || s.numParts > 0 {
+		PrintLogAndOut("Seeded %d files and %d parts of other files (%s) from %s\n",
+			s.numFiles, s.numParts, diskSpaceString(s.numBytes), s.dir)
+	}
+	return nil
+}
+
+func (s *seeder) seedFile(key inspectKey) error {
+	st := s.st
+	st.mutex.Lock()
+	f, err := st.manifestFileLocked(key)
+	st.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	src := s.seedPath(f)
+	fi, err := os.Stat(src)
+	if err != nil || !fi.Mode().IsRegular() {
+		// not in the seed directory, downloaded
+		return nil
+	}
+	if dfi, err := os.Stat(f.path()); err == nil && os.SameFile(fi, dfi) {
+		// seeding from the download directory itself, inspect covers this
+		return nil
+	}
+
+	var matching []DBPartRegular
+	whole := fi.Size() == f.size
+	if key.kind == 0 {
+		matching, err = s.matchingParts(src, f)
+		if err != nil {
+			slog.Warn("could not read seed file", "path", src, "error", err)
+			return nil
+		}
+		whole = whole && len(matching) == len(f.parts)
+	} else {
+		whole = whole && f.md5 != "" && verifyFileMD5(src, f.md5) == nil
+	}
+
+	if whole {
+		tmp := filepath.Join(filepath.Dir(f.path()), "."+f.name+".seed")
+		if err := linkOrCopy(s.mode, src, f.path(), tmp, &s.fellBack); err != nil {
+			slog.Warn("could not seed file", "path", f.path(), "seed", src, "error", err)
+			return nil
+		}
+		// the seed file may have changed since it was checked
+		if err := s.verifyWhole(f); err != nil {
+			slog.Warn("seeded file does not match, it is downloaded instead", "path", f.path(), "seed", src, "error", err)
+			return emptyFile(f.path())
+		}
+		done, err := st.markFileComplete(key)
+		if err != nil {
+			return err
+		}
+		slog.Debug("file seeded", "file_id", f.fileId, "path", f.path(), "seed", src)
+		s.numFiles++
+		s.numBytes += f.size
+		if done != nil {
+			st.fileCompleted(*done)
+		}
+		return nil
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+	return s.copyParts(src, f, matching)
+}
+
+// Verify a file linked or copied from the seed directory, as a whole
+func (s *seeder) verifyWhole(f completedFile) error {
+	if f.kind == 1 {
+		return verifyFileMD5(f.path(), f.md5)
+	}
+	matching, err := s.matchingParts(f.path(), f)
+	if err != nil {
+		return err
+	}
+	if len(matching) != len(f.parts) {
+		return fmt.Errorf("%d of %d parts match the manifest", len(matching), len(f.parts))
+	}
+	return nil
+}
+
+// The parts of a regular file that match the seed file
+func (s *seeder) matchingParts(src string, f completedFile) ([]DBPartRegular, error) {
+	localf, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer localf.Close()
+
+	var matching []DBPartRegular
+	for _, p := range f.parts {
+		data := make([]byte, p.Size)
+		n, err := localf.ReadAt(data, p.Offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if seedPartMatches(p, data[:n]) {
+			matching = append(matching, p)
+		}
+	}
+	return matching, nil
+}
+
+// Copy the matching parts of a seed file into the local file, and mark
+// them as downloaded. Parts already downloaded are left alone.
+func (s *seeder) copyParts(src string, f completedFile, parts []DBPartRegular) error {
+	st := s.st
+	in, err := os.Open(src)
+	if err != nil {
+		slog.Warn("could not read seed file", "path", src, "error", err)
+		return nil
+	}
+	defer in.Close()
+
+	var copied []DBPartRegular
+	for _, p := range parts {
+		if p.BytesFetched == p.Size {
+			continue
+		}
+		if err := s.copyPart(in, p); err != nil {
+			slog.Warn("could not seed part", "path", f.path(), "seed", src, "part_id", p.PartId, "error", err)
+			break
+		}
+		copied = append(copied, p)
+	}
+	if len(copied) == 0 {
+		return nil
+	}
+
+	done, err := s.markPartsComplete(f, copied)
+	if err != nil {
+		return err
+	}
+	slog.Debug("parts seeded", "file_id", f.fileId, "path", f.path(), "seed", src, "num_parts", len(copied))
+	if done != nil {
+		st.fileCompleted(*done)
+	}
+	return nil
+}
+
+// Write a part of a seed file through the sink, as if it was downloaded.
+// The part is verified again, since the seed file may have changed since
+// it was first read.
+func (s *seeder) copyPart(in *os.File, p DBPartRegular) error {
+	data := make([]byte, p.Size)
+	if _, err := in.ReadAt(data, p.Offset); err != nil {
+		return err
+	}
+	if !seedPartMatches(p, data) {
+		return fmt.Errorf("the part no longer matches the manifest")
+	}
+	out, err := s.st.sink.openPart(p)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := out.WriteAt(data, p.Offset); err != nil {
+		return err
+	}
+	if err := out.commit(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// Mark seeded parts as downloaded. The file is returned if it is now
+// complete, because all its other parts were downloaded before.
+func (s *seeder) markPartsComplete(f completedFile, parts []DBPartRegular) (*completedFile, error) {
+	st := s.st
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	now := time.Now().UnixNano()
+	for _, p := range parts {
+		_, err := st.db.Exec(`
+			UPDATE manifest_regular_stats SET bytes_fetched = size, download_done_time = ?
+			WHERE file_id = ? AND folder = ? AND name = ? AND part_id = ?`,
+			now, f.fileId, f.folder, f.name, p.PartId)
+		if err != nil {
+			return nil, err
+		}
+		s.numParts++
+		s.numBytes += int64(p.Size)
+	}
+	return st.completedFileLocked(inspectKey{0, f.fileId, f.folder, f.name})
+}
@@ -0,0 +1,114 @@
+package dxda
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeedDir(t *testing.T) {
+	root := chdirTemp(t)
+	files := makeTestFiles(3, 300*KiB, 128*KiB)
+
+	// an older copy: the first file is intact, the second has a corrupted
+	// part, and the third is missing
+	seedDir := filepath.Join(root, "seed")
+	if err := os.MkdirAll(filepath.Join(seedDir, "exome"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), files[1].data...)
+	corrupted[200*KiB] ^= 0xff
+	for name, data := range map[string][]byte{files[0].name: files[0].data, files[1].name: corrupted} {
+		if err := os.WriteFile(filepath.Join(seedDir, "exome", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the server does not know the first file, which must come from the seed
+	ts := newTestServer(files[1:], 0, 0)
+	defer ts.Close()
+	if err := os.Mkdir(filepath.Join(root, "download"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(root, "download")); err != nil {
+		t.Fatal(err)
+	}
+	st := NewDxDa(ts.dxEnv(t), "test.manifest.json.bz2", Opts{NumThreads: 2, SeedDir: seedDir, SeedMode: DedupeCopy})
+	defer st.Close()
+	manifest := testManifest(files, "/exome")
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+
+	// seed before the download, to see which parts are left
+	if err := st.createPartIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.buildDownloadQueue(st.downloadOrder()); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.seedFromDir(); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int64{0, 1, 3} {
+		numIncomplete := st.queryDBIntegerResult(
+			"SELECT COUNT(*) FROM manifest_regular_stats WHERE file_id = '" + files[i].id + "' AND bytes_fetched != size")
+		if numIncomplete != expected {
+			t.Errorf("Expected %d parts of %s left to download, got %d", expected, files[i].name, numIncomplete)
+		}
+	}
+
+	if err := st.DownloadManifestDB("test.manifest.json.bz2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join("exome", f.name))
+		if err != nil || string(data) != string(f.data) {
+			t.Errorf("Expected %s to be downloaded", f.name)
+		}
+	}
+	if report := st.Inspect(); !report.OK() {
+		t.Errorf("Expected the seeded files to pass inspection: %s", report.Summary())
+	}
+}
+
+// Seed files that change after they were checked are not used
+func TestSeedChanged(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(1, 300*KiB, 128*KiB)
+	if err := os.WriteFile("seed.bam", files[0].data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := completedFile{fileId: files[0].id, folder: "/exome", name: files[0].name, size: int64(len(files[0].data))}
+	for i, p := range files[0].manifestEntry("/exome").Parts {
+		f.parts = append(f.parts, DBPartRegular{PartId: p.Id, Offset: int64(i * 128 * KiB), Size: p.Size, MD5: p.MD5})
+	}
+	s := &seeder{}
+	if err := os.MkdirAll("exome", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.path(), files[0].data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifyWhole(f); err != nil {
+		t.Errorf("Expected the copy to match, got %v", err)
+	}
+
+	// rewritten after it was read
+	corrupted := append([]byte(nil), files[0].data...)
+	corrupted[200*KiB] ^= 0xff
+	for _, path := range []string{"seed.bam", f.path()} {
+		if err := os.WriteFile(path, corrupted, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.verifyWhole(f); err == nil {
+		t.Error("Expected the changed copy not to match")
+	}
+	in, err := os.Open("seed.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if err := s.copyPart(in, f.parts[1]); err == nil {
+		t.Error("Expected the changed part not to be copied")
+	}
+}
@@ -0,0 +1,136 @@
+package dxda
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Where the downloaded files go. The download workers write each part
+// through the sink, at its offset in the file, and commit it once it is
+// verified. The file is handed back to the sink once all its parts are
+// committed and recorded. The default sink is the directory tree of the
+// manifest, under the current directory. Other sinks stage the files in
+// that tree and move them to their destination as they complete, or
+// upload the parts directly.
+type outputSink interface {
+	// Open a part of a file of the manifest, to write it
+	openPart(p DBPart) (sinkPart, error)
+
+	// Called by the database update thread, once for each completed file,
+	// after the other completion actions
+	fileCompleted(f completedFile)
+
+	// Whether the files stay in the download directory once complete
+	keepsFiles() bool
+
+	// Memory each download thread holds for the part it is writing, on
+	// top of its buffers
+	memoryPerPart() int64
+
+	// Called when the download ends, whether all the files were
+	// downloaded or not. Returns an error if the output is incomplete.
+	close() error
+}
+
+// A sink that limits the files staged in the download directory, waiting
+// to be written out. The jobs producer asks before handing out the parts
+// of each file.
+type stagingSink interface {
+	// Block until the parts of a file, of size bytes, may be downloaded.
+	// When the sink waits for a file that was not handed out yet, that
+	// file is returned instead, to be handed out first. Returns false if
+	// the download was stopped.
+	admit(key inspectKey, size int64) (first *inspectKey, ok bool)
+
+	// Called by the workers for a part that could not be downloaded
+	partFailed(p DBPart)
+}
+
+// A part being written. Offsets are in the file, not in the part. A part
+// that is closed without being committed is downloaded again.
+type sinkPart interface {
+	io.WriterAt
+	commit() error
+	io.Closer
+}
+
+// Compression of the output, see Opts.OutputCompression
+const (
+	OutputCompressionGzip = "gzip"
+	OutputCompressionNone = "none"
+)
+
+// ValidateOutput checks the output of a download, and its compression
+func ValidateOutput(output string, compression string) error {
+	switch compression {
+	case "", OutputCompressionGzip, OutputCompressionNone:
+	default:
+		return fmt.Errorf("unsupported output compression %q, expected one of %s",
+			compression, strings.Join([]string{OutputCompressionGzip, OutputCompressionNone}, ", "))
+	}
+	if output == "" && compression != "" {
+		return fmt.Errorf("output compression requires an output")
+	}
+	if IsS3Output(output) {
+		if compression != "" {
+			return fmt.Errorf("output compression is not supported with an S3 output")
+		}
+		_, _, err := parseS3Output(output)
+		return err
+	}
+	return nil
+}
+
+// Check the options that need the files to stay in the download
+// directory, which no output supports
+func checkOutputOptions(st *State, output string) error {
+	switch {
+	case st.opts.FileChecksums != "":
+		return fmt.Errorf("whole file checksums are not supported with %s", output)
+	case st.opts.Dedupe != "":
+		return fmt.Errorf("deduplication is not supported with %s", output)
+	case st.IsBag():
+		return fmt.Errorf("BagIt bags are not supported with %s", output)
+	case st.hooks != nil:
+		return fmt.Errorf("hooks are not supported with %s, they report on local files", output)
+	}
+	return nil
+}
+
+func newOutputSink(st *State) (outputSink, error) {
+	switch {
+	case st.opts.Output == "":
+		return directorySink{}, nil
+	case IsS3Output(st.opts.Output):
+		return newS3Sink(st)
+	}
+	return newTarSink(st)
+}
+
+// Files are written in place, in the directory tree of the manifest
+type directorySink struct{}
+
+func (directorySink) openPart(p DBPart) (sinkPart, error) {
+	f, err := os.OpenFile(fmt.Sprintf(".%s/%s", p.folder(), p.fileName()), os.O_WRONLY, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return localPart{f}, nil
+}
+
+// A part written in place, there is nothing left to do once it is verified
+type localPart struct {
+	*os.File
+}
+
+func (localPart) commit() error { return nil }
+
+func (directorySink) fileCompleted(completedFile) {}
+
+func (directorySink) keepsFiles() bool { return true }
+
+func (directorySink) memoryPerPart() int64 { return 0 }
+
+func (directorySink) close() error { return nil }
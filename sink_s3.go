@@ -0,0 +1,523 @@
+package dxda
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Uploads the files to an S3 compatible object store, under a bucket and
+// prefix that mirror the folders of the manifest. Nothing is written to
+// the local disk: each part is kept in memory until it is verified, and
+// then uploaded as a part of a multipart upload of its file. Once all the
+// parts of a file are uploaded, the upload is completed into the object,
+// by threads of the sink rather than the database update thread. Symbolic
+// links have no part checksums, so their objects are read back and
+// checked against the MD5 checksum of the whole file.
+//
+// The uploads in progress, and the ETags of their parts, are recorded in
+// the s3_uploads and s3_parts tables, so that an interrupted download
+// resumes its uploads, and completes those that have all their parts.
+type s3Sink struct {
+	st     *State
+	client *s3Client
+	bucket string
+	prefix string
+	mutex  sync.Mutex // one upload is created for each file
+
+	// the largest part, each worker keeps one in memory
+	maxPartSize int64
+
+	completions chan completedFile // files whose upload is to be completed
+	completers  sync.WaitGroup
+
+	numFiles int
+	numBytes int64
+	closed   bool
+}
+
+func newS3Sink(st *State) (*s3Sink, error) {
+	if err := checkOutputOptions(st, "an S3 output"); err != nil {
+		return nil, err
+	}
+	// nothing is written locally, and the objects have no times, modes or
+	// extended attributes
+	switch {
+	case st.opts.CacheDir != "":
+		return nil, fmt.Errorf("a cache directory is not supported with an S3 output")
+	case st.opts.SeedDir != "":
+		return nil, fmt.Errorf("a seed directory is not supported with an S3 output")
+	case st.opts.PreserveTimes || st.opts.FileMode != 0 || st.opts.DirMode != 0:
+		return nil, fmt.Errorf("file times and modes are not supported with an S3 output")
+	case st.provenance != nil && st.provenance.xattr:
+		return nil, fmt.Errorf("provenance in extended attributes is not supported with an S3 output, " +
+			"the objects carry their file ID and project in their metadata")
+	}
+
+	bucket, prefix, err := parseS3Output(st.opts.Output)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newS3Client(st.opts.S3Endpoint, st.opts.S3Region)
+	if err != nil {
+		return nil, err
+	}
+	maxPartSize, err := st.checkS3Parts()
+	if err != nil {
+		return nil, err
+	}
+	if err := st.createS3Tables(); err != nil {
+		return nil, err
+	}
+	s := &s3Sink{
+		st:          st,
+		client:      client,
+		bucket:      bucket,
+		prefix:      prefix,
+		maxPartSize: maxPartSize,
+		completions: make(chan completedFile, jobQueueSize),
+	}
+	for i := 0; i < s3NumCompleters; i++ {
+		s.completers.Add(1)
+		go func() {
+			defer s.completers.Done()
+			for f := range s.completions {
+				st.stats.failedParts.Add(s.complete(f))
+			}
+		}()
+	}
+	if err := s.resumeCompletions(); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Threads completing uploads, each request assembles a whole object
+const s3NumCompleters = 4
+
+// A multipart upload has at most 10,000 parts, numbered from 1
+const s3MaxParts = 10000
+
+// The parts of a multipart upload, other than the last one, are at least
+// 5 MiB
+const s3MinPartSize = 5 * MiB
+
+// Check that the parts of every file can be uploaded as the parts of a
+// multipart upload, and return the size of the largest one. Symbolic links
+// are split into chunks of the maximal chunk size, so the largest ones may
+// have too many. Files uploaded to the platform with small parts cannot
+// be assembled by the store, they are refused before anything is
+// downloaded.
+func (st *State) checkS3Parts() (int64, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var maxPartSize int64
+	for _, table := range []string{"manifest_regular_stats", "manifest_symlink_stats"} {
+		var folder, name string
+		var numParts, size int64
+		err := st.db.QueryRow(fmt.Sprintf(
+			"SELECT folder, name, MAX(part_id) FROM %s GROUP BY file_id, folder, name ORDER BY 3 DESC LIMIT 1", table)).
+			Scan(&folder, &name, &numParts)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if numParts > s3MaxParts {
+			return 0, fmt.Errorf("%s has %d parts, an S3 upload has at most %d",
+				path.Join(folder, name), numParts, s3MaxParts)
+		}
+		var partId int64
+		err = st.db.QueryRow(fmt.Sprintf(`
+			SELECT folder, name, part_id, size FROM %s AS p
+			WHERE size < ? AND EXISTS (
+				SELECT 1 FROM %s WHERE file_id = p.file_id AND folder = p.folder AND name = p.name
+				AND part_id > p.part_id)
+			LIMIT 1`, table, table), s3MinPartSize).Scan(&folder, &name, &partId, &size)
+		if err == nil {
+			return 0, fmt.Errorf("part %d of %s has %d bytes, the parts of an S3 upload other than the last one have at least %d MiB",
+				partId, path.Join(folder, name), size, s3MinPartSize/MiB)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+		err = st.db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(size), 0) FROM %s", table)).Scan(&size)
+		if err != nil {
+			return 0, err
+		}
+		if size > maxPartSize {
+			maxPartSize = size
+		}
+	}
+	return maxPartSize, nil
+}
+
+func (st *State) createS3Tables() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS s3_uploads (
+		kind      integer,
+		file_id   text,
+		folder    text,
+		name      text,
+		upload_id text,
+		PRIMARY KEY (kind, file_id, folder, name)
+	);
+	CREATE TABLE IF NOT EXISTS s3_parts (
+		upload_id   text,
+		part_number integer,
+		etag        text,
+		PRIMARY KEY (upload_id, part_number)
+	);
+	`)
+	return err
+}
+
+// The key of the object of a file
+func (s *s3Sink) objectKey(folder string, name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, folder, name), "/")
+}
+
+// Metadata of the objects, so that they can be traced back to the platform
+func s3Metadata(fileId string, project string) map[string]string {
+	return map[string]string{"Dnanexus-File-Id": fileId, "Dnanexus-Project": project}
+}
+
+func partKey(p DBPart) inspectKey {
+	key := inspectKey{0, p.fileId(), p.folder(), p.fileName()}
+	if _, ok := p.(DBPartSymlink); ok {
+		key.kind = 1
+	}
+	return key
+}
+
+// The upload of a file, empty if it has not started
+func (s *s3Sink) uploadIdLocked(key inspectKey) (string, error) {
+	var uploadId string
+	err := s.st.db.QueryRow(
+		"SELECT upload_id FROM s3_uploads WHERE kind = ? AND file_id = ? AND folder = ? AND name = ?",
+		key.kind, key.fileId, key.folder, key.name).Scan(&uploadId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return uploadId, err
+}
+
+// The upload of the file of a part, started by the first part uploaded
+func (s *s3Sink) startUpload(p DBPart) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := partKey(p)
+	s.st.mutex.Lock()
+	uploadId, err := s.uploadIdLocked(key)
+	s.st.mutex.Unlock()
+	if err != nil || uploadId != "" {
+		return uploadId, err
+	}
+
+	uploadId, err = s.client.createMultipartUpload(s.bucket, s.objectKey(key.folder, key.name),
+		s3Metadata(key.fileId, p.project()))
+	if err != nil {
+		return "", err
+	}
+	s.st.mutex.Lock()
+	defer s.st.mutex.Unlock()
+	_, err = s.st.db.Exec("INSERT INTO s3_uploads VALUES (?, ?, ?, ?, ?)",
+		key.kind, key.fileId, key.folder, key.name, uploadId)
+	return uploadId, err
+}
+
+func (s *s3Sink) openPart(p DBPart) (sinkPart, error) {
+	return &s3Part{sink: s, part: p, data: make([]byte, p.size())}, nil
+}
+
+// A part kept in memory, and uploaded once it is verified
+type s3Part struct {
+	sink *s3Sink
+	part DBPart
+	data []byte
+}
+
+func (sp *s3Part) WriteAt(b []byte, off int64) (int, error) {
+	start := off - sp.part.offset()
+	if start < 0 || start+int64(len(b)) > int64(len(sp.data)) {
+		return 0, fmt.Errorf("write at offset %d is outside of part %d", off, partId(sp.part))
+	}
+	return copy(sp.data[start:], b), nil
+}
+
+func (sp *s3Part) commit() error {
+	s := sp.sink
+	uploadId, err := s.startUpload(sp.part)
+	if err != nil {
+		return err
+	}
+	key := partKey(sp.part)
+	etag, err := s.client.uploadPart(s.bucket, s.objectKey(key.folder, key.name), uploadId, partId(sp.part), sp.data)
+	if isNoSuchUpload(err) {
+		// expired, or aborted out of band: the file starts over with a new
+		// upload on the next run
+		slog.Warn("upload no longer exists, the file is downloaded again", "file_id", key.fileId,
+			"bucket", s.bucket, "key", s.objectKey(key.folder, key.name), "upload_id", uploadId)
+		s.st.mutex.Lock()
+		_, resetErr := s.resetUploadLocked(key)
+		s.st.mutex.Unlock()
+		if resetErr != nil {
+			return resetErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.st.mutex.Lock()
+	defer s.st.mutex.Unlock()
+	_, err = s.st.db.Exec("INSERT OR REPLACE INTO s3_parts VALUES (?, ?, ?)", uploadId, partId(sp.part), etag)
+	return err
+}
+
+func (sp *s3Part) Close() error {
+	sp.data = nil
+	return nil
+}
+
+func (s *s3Sink) fileCompleted(f completedFile) {
+	s.completions <- f
+}
+
+// Complete the uploads that an earlier run left with all their parts
+// uploaded, since it stopped before assembling them. This is done before
+// the download queue is built, so that the files that cannot be
+// assembled are downloaded again by this run.
+func (s *s3Sink) resumeCompletions() error {
+	st := s.st
+	st.mutex.Lock()
+	var files []completedFile
+	rows, err := st.db.Query("SELECT kind, file_id, folder, name FROM s3_uploads")
+	if err != nil {
+		st.mutex.Unlock()
+		return err
+	}
+	var keys []inspectKey
+	for rows.Next() {
+		var key inspectKey
+		if err := rows.Scan(&key.kind, &key.fileId, &key.folder, &key.name); err != nil {
+			rows.Close()
+			st.mutex.Unlock()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	for _, key := range keys {
+		f, err := st.completedFileLocked(key)
+		if err != nil {
+			st.mutex.Unlock()
+			return err
+		}
+		if f != nil {
+			files = append(files, *f)
+		}
+	}
+	st.mutex.Unlock()
+
+	for _, f := range files {
+		slog.Info("completing upload left by an earlier run", "file_id", f.fileId, "path", f.path())
+		s.complete(f)
+	}
+	return nil
+}
+
+// Assemble the object of a completed file. A file that cannot be
+// assembled is downloaded again, and its upload is aborted, so that the
+// store does not keep its parts. Returns the number of parts to download
+// again.
+func (s *s3Sink) complete(f completedFile) int64 {
+	err := s.completeUpload(f)
+	if err == nil {
+		slog.Debug("file uploaded", "file_id", f.fileId, "path", f.path(), "bucket", s.bucket,
+			"key", s.objectKey(f.folder, f.name))
+		s.mutex.Lock()
+		s.numFiles++
+		s.numBytes += f.size
+		s.mutex.Unlock()
+		return 0
+	}
+
+	slog.Error("could not upload file", "file_id", f.fileId, "path", f.path(), "bucket", s.bucket,
+		"key", s.objectKey(f.folder, f.name), "error", err)
+	st := s.st
+	key := inspectKey{f.kind, f.fileId, f.folder, f.name}
+	st.mutex.Lock()
+	uploadId, err := s.uploadIdLocked(key)
+	st.mutex.Unlock()
+	check(err)
+	if uploadId != "" {
+		if err := s.client.abortMultipartUpload(s.bucket, s.objectKey(f.folder, f.name), uploadId); err != nil {
+			slog.Warn("could not abort upload, its parts are kept by the store", "file_id", f.fileId,
+				"bucket", s.bucket, "key", s.objectKey(f.folder, f.name), "upload_id", uploadId, "error", err)
+		}
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	numParts, err := s.resetUploadLocked(key)
+	check(err)
+	return numParts
+}
+
+// Download a file again, into a new upload: its parts are marked as not
+// downloaded, and its upload is forgotten. Returns the number of parts.
+func (s *s3Sink) resetUploadLocked(key inspectKey) (int64, error) {
+	st := s.st
+	table := "manifest_regular_stats"
+	if key.kind == 1 {
+		table = "manifest_symlink_stats"
+	}
+	res, err := st.db.Exec(fmt.Sprintf(
+		"UPDATE %s SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = ? AND folder = ? AND name = ?", table),
+		key.fileId, key.folder, key.name)
+	if err != nil {
+		return 0, err
+	}
+	numParts, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = st.db.Exec(`
+		DELETE FROM s3_parts WHERE upload_id IN (
+			SELECT upload_id FROM s3_uploads WHERE kind = ? AND file_id = ? AND folder = ? AND name = ?)`,
+		key.kind, key.fileId, key.folder, key.name)
+	if err != nil {
+		return 0, err
+	}
+	_, err = st.db.Exec("DELETE FROM s3_uploads WHERE kind = ? AND file_id = ? AND folder = ? AND name = ?",
+		key.kind, key.fileId, key.folder, key.name)
+	return numParts, err
+}
+
+func (s *s3Sink) completeUpload(f completedFile) error {
+	st := s.st
+	key := inspectKey{f.kind, f.fileId, f.folder, f.name}
+	objectKey := s.objectKey(f.folder, f.name)
+
+	st.mutex.Lock()
+	uploadId, err := s.uploadIdLocked(key)
+	var parts []s3CompletedPart
+	if err == nil && uploadId != "" {
+		parts, err = s.uploadedPartsLocked(uploadId)
+	}
+	st.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if uploadId == "" {
+		// files without parts
+		if f.size != 0 {
+			return fmt.Errorf("no upload was started for the file")
+		}
+		return s.client.putObject(s.bucket, objectKey, nil, s3Metadata(f.fileId, f.project))
+	}
+	if f.kind == 0 && len(parts) != len(f.parts) {
+		return fmt.Errorf("%d parts were uploaded, expected %d", len(parts), len(f.parts))
+	}
+	if err := s.client.completeMultipartUpload(s.bucket, objectKey, uploadId, parts); err != nil {
+		return err
+	}
+	if f.kind == 1 && f.md5 != "" {
+		if err := s.verifyObject(objectKey, f); err != nil {
+			if delErr := s.client.deleteObject(s.bucket, objectKey); delErr != nil {
+				slog.Warn("could not delete object that failed verification", "file_id", f.fileId,
+					"bucket", s.bucket, "key", objectKey, "error", delErr)
+			}
+			return err
+		}
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, err := st.db.Exec("DELETE FROM s3_parts WHERE upload_id = ?", uploadId); err != nil {
+		return err
+	}
+	_, err = st.db.Exec("DELETE FROM s3_uploads WHERE upload_id = ?", uploadId)
+	return err
+}
+
+// Verify the object of a symbolic link against the MD5 checksum of the
+// whole file. Symbolic links have no part checksums, and their parts
+// arrive in any order, so the object is read back once assembled.
+func (s *s3Sink) verifyObject(objectKey string, f completedFile) error {
+	chunkSize := s.maxPartSize
+	hasher := md5.New()
+	for ofs := int64(0); ofs < f.size; ofs += chunkSize {
+		end := ofs + chunkSize - 1
+		if end >= f.size {
+			end = f.size - 1
+		}
+		data, err := s.client.getObjectRange(s.bucket, objectKey, ofs, end)
+		if err != nil {
+			return err
+		}
+		hasher.Write(data)
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != f.md5 {
+		return fmt.Errorf("md5 checksum %s of the object does not match the expected %s", sum, f.md5)
+	}
+	return nil
+}
+
+func (s *s3Sink) uploadedPartsLocked(uploadId string) ([]s3CompletedPart, error) {
+	rows, err := s.st.db.Query(
+		"SELECT part_number, etag FROM s3_parts WHERE upload_id = ? ORDER BY part_number", uploadId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var parts []s3CompletedPart
+	for rows.Next() {
+		var p s3CompletedPart
+		if err := rows.Scan(&p.PartNumber, &p.ETag); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+func (s *s3Sink) keepsFiles() bool { return false }
+
+// Each worker keeps a whole part in memory until it is uploaded
+func (s *s3Sink) memoryPerPart() int64 { return s.maxPartSize }
+
+// Wait for the uploads being completed
+func (s *s3Sink) close() error {
+	s.mutex.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mutex.Unlock()
+	if closed {
+		return nil
+	}
+	close(s.completions)
+	s.completers.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.numFiles > 0 {
+		PrintLogAndOut("Uploaded %d files (%s) to s3://%s/%s\n", s.numFiles, diskSpaceString(s.numBytes), s.bucket, s.prefix)
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package dxda
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Writes the files to a tar archive, or a tar stream, in manifest order.
+// The parts are downloaded into the directory tree of the manifest, as
+// usual, and each file is appended to the archive and removed once it is
+// verified and all the files before it are in the archive. Files that
+// complete out of order wait on disk for their turn, up to
+// maxStagedBytes: beyond that, no new files are handed out, except the
+// one the archive is waiting for.
+//
+// The files written to the archive are recorded in the output_emitted
+// table. An archive cannot be resumed, so the next run downloads them
+// again, and writes a complete archive.
+type tarSink struct {
+	st     *State
+	output string         // path of the archive, "-" for a stream
+	file   io.WriteCloser // nil for a stream
+	gz     *gzip.Writer   // nil if not compressed
+	tw     *tar.Writer
+	xattrs bool // add the provenance of the files to the archive
+
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	ready      map[inspectKey]completedFile // completed, waiting for their turn
+	finished   bool                         // no more files will complete
+	awaiting   *inspectKey                  // the file the writer thread waits for
+	dispatched map[inspectKey]int64         // handed out and not written yet, with their size
+	staged     int64                        // bytes of the dispatched files
+	failed     map[inspectKey]bool          // with a part that could not be downloaded
+	stopped    bool                         // the writer thread exited
+
+	emitted  chan struct{} // closed when the writer thread exits
+	err      error         // why the writer thread stopped early
+	dirs     map[string]bool
+	numFiles int
+	numBytes int64
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Bytes of the files handed out for download, and not written to the
+// archive yet. A file larger than this is handed out once nothing else is
+// staged.
+var maxStagedBytes int64 = 4 * GiB
+
+func newTarSink(st *State) (*tarSink, error) {
+	// Files from the cache or the seed directory are staged like the
+	// downloaded ones, and their times, modes and provenance go into the
+	// headers of the archive.
+	if err := checkOutputOptions(st, "a tar output"); err != nil {
+		return nil, err
+	}
+	if err := st.resetEmittedFiles(); err != nil {
+		return nil, err
+	}
+	if err := st.buildOutputQueue(); err != nil {
+		return nil, err
+	}
+
+	ts := &tarSink{
+		st:         st,
+		output:     st.opts.Output,
+		ready:      make(map[inspectKey]completedFile),
+		dispatched: make(map[inspectKey]int64),
+		failed:     make(map[inspectKey]bool),
+		emitted:    make(chan struct{}),
+		dirs:       make(map[string]bool),
+	}
+	ts.cond = sync.NewCond(&ts.mutex)
+	if st.provenance != nil {
+		ts.xattrs = st.provenance.xattr
+	}
+
+	var w io.Writer
+	if ts.output == "-" {
+		w = st.opts.OutputStream
+		if w == nil {
+			w = os.Stdout
+		}
+	} else {
+		f, err := os.Create(ts.output)
+		if err != nil {
+			return nil, err
+		}
+		ts.file = f
+		w = f
+	}
+	compression := st.opts.OutputCompression
+	if compression == "" && (strings.HasSuffix(ts.output, ".gz") || strings.HasSuffix(ts.output, ".tgz")) {
+		compression = OutputCompressionGzip
+	}
+	if compression == OutputCompressionGzip {
+		ts.gz = gzip.NewWriter(w)
+		w = ts.gz
+	}
+	ts.tw = tar.NewWriter(w)
+
+	go ts.run()
+	return ts, nil
+}
+
+// Download the files written to the archive of an earlier run again
+func (st *State) resetEmittedFiles() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS output_emitted (
+		kind    integer,
+		file_id text,
+		folder  text,
+		name    text
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	rows, err := st.db.Query("SELECT kind, file_id, folder, name FROM output_emitted")
+	if err != nil {
+		return err
+	}
+	var keys []inspectKey
+	for rows.Next() {
+		var key inspectKey
+		if err := rows.Scan(&key.kind, &key.fileId, &key.folder, &key.name); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		table := "manifest_regular_stats"
+		if key.kind == 1 {
+			table = "manifest_symlink_stats"
+		}
+		_, err := st.db.Exec(fmt.Sprintf(
+			"UPDATE %s SET bytes_fetched = 0, download_done_time = 0 WHERE file_id = ? AND folder = ? AND name = ?", table),
+			key.fileId, key.folder, key.name)
+		if err != nil {
+			return err
+		}
+		// the file, and maybe its directory, were removed
+		fname := filepath.Join(".", key.folder, key.name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+			return err
+		}
+		localf, err := os.Create(fname)
+		if err != nil {
+			return err
+		}
+		localf.Close()
+	}
+	if len(keys) > 0 {
+		slog.Info("downloading again the files written to an earlier output", "num_files", len(keys))
+	}
+	_, err = st.db.Exec("DELETE FROM output_emitted")
+	return err
+}
+
+// The files of the manifest, in the order they are written to the
+// archive. Regular files come first, then symbolic links, each in
+// manifest order. Files completed by earlier runs are marked as done.
+func (st *State) buildOutputQueue() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err := st.db.Exec(`
+	DROP TABLE IF EXISTS output_queue;
+	CREATE TABLE output_queue (
+		seq     integer PRIMARY KEY,
+		kind    integer,
+		file_id text,
+		folder  text,
+		name    text,
+		done    integer
+	);
+	INSERT INTO output_queue (kind, file_id, folder, name, done)
+	SELECT kind, file_id, folder, name, done FROM (
+		SELECT 0 AS kind, file_id, folder, name, MIN(rowid) AS file_seq, MIN(bytes_fetched = size) AS done
+		FROM manifest_regular_stats GROUP BY file_id, folder, name
+		UNION ALL
+		SELECT 1 AS kind, file_id, folder, name, MIN(rowid) AS file_seq, MIN(bytes_fetched = size) AS done
+		FROM manifest_symlink_stats GROUP BY file_id, folder, name
+	)
+	ORDER BY kind, file_seq;
+	`)
+	return err
+}
+
+func (ts *tarSink) openPart(p DBPart) (sinkPart, error) {
+	return directorySink{}.openPart(p)
+}
+
+func (ts *tarSink) fileCompleted(f completedFile) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.ready[inspectKey{f.kind, f.fileId, f.folder, f.name}] = f
+	ts.cond.Broadcast()
+}
+
+func (ts *tarSink) keepsFiles() bool { return false }
+
+func (ts *tarSink) memoryPerPart() int64 { return 0 }
+
+func (ts *tarSink) admit(key inspectKey, size int64) (*inspectKey, bool) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	var wakeOnStop chan struct{}
+	for {
+		if ts.st.stopRequested() {
+			return nil, false
+		}
+		switch {
+		case ts.stopped || ts.staged == 0 || ts.staged+size <= maxStagedBytes ||
+			(ts.awaiting != nil && *ts.awaiting == key):
+			ts.dispatched[key] = size
+			ts.staged += size
+			return nil, true
+		case ts.awaiting != nil:
+			if _, ok := ts.dispatched[*ts.awaiting]; !ok {
+				first := *ts.awaiting
+				ts.dispatched[first] = 0
+				return &first, true
+			}
+		}
+
+		if wakeOnStop == nil {
+			wakeOnStop = make(chan struct{})
+			defer close(wakeOnStop)
+			go func() {
+				select {
+				case <-ts.st.stopCh:
+					ts.mutex.Lock()
+					ts.cond.Broadcast()
+					ts.mutex.Unlock()
+				case <-wakeOnStop:
+				}
+			}()
+		}
+		ts.cond.Wait()
+	}
+}
+
+func (ts *tarSink) partFailed(p DBPart) {
+	kind := 0
+	if _, ok := p.(DBPartSymlink); ok {
+		kind = 1
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.failed[inspectKey{kind, p.fileId(), p.folder(), p.fileName()}] = true
+	ts.cond.Broadcast()
+}
+
+// A file was written to the archive, making room for others
+func (ts *tarSink) unstage(key inspectKey) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.staged -= ts.dispatched[key]
+	delete(ts.dispatched, key)
+	ts.cond.Broadcast()
+}
+
+// The writer thread, appending the files to the archive in order
+func (ts *tarSink) run() {
+	defer close(ts.emitted)
+	defer func() {
+		ts.mutex.Lock()
+		ts.stopped = true
+		ts.cond.Broadcast()
+		ts.mutex.Unlock()
+	}()
+
+	var afterSeq int64
+	for {
+		queued, err := ts.nextOutputFiles(afterSeq)
+		if err != nil {
+			ts.err = err
+			return
+		}
+		if len(queued) == 0 {
+			return
+		}
+		for _, q := range queued {
+			afterSeq = q.seq
+			key := inspectKey{q.kind, q.fileId, q.folder, q.name}
+			f, err := ts.wait(key, q.done)
+			if err != nil {
+				ts.err = err
+				return
+			}
+			if f == nil {
+				ts.err = fmt.Errorf("%s was not downloaded, the output is incomplete",
+					filepath.Join(".", key.folder, key.name))
+				return
+			}
+			if err := ts.verify(*f); err != nil {
+				ts.err = err
+				return
+			}
+			if err := ts.emit(*f); err != nil {
+				ts.err = fmt.Errorf("could not write %s to the output: %w", f.path(), err)
+				return
+			}
+			ts.unstage(key)
+		}
+	}
+}
+
+// A file of the output queue
+type outputFile struct {
+	queuedFile
+	done bool // completed by an earlier run
+}
+
+// Read the next page of files from the output queue, following [afterSeq]
+func (ts *tarSink) nextOutputFiles(afterSeq int64) ([]outputFile, error) {
+	st := ts.st
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	rows, err := st.db.Query(
+		"SELECT seq, kind, file_id, folder, name, done FROM output_queue WHERE seq > ? ORDER BY seq LIMIT ?",
+		afterSeq, downloadQueuePageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []outputFile
+	for rows.Next() {
+		var f outputFile
+		if err := rows.Scan(&f.seq, &f.kind, &f.fileId, &f.folder, &f.name, &f.done); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// Wait for a file to complete, unless it was completed by an earlier run.
+// Returns nil if the download ended without it, or it failed.
+func (ts *tarSink) wait(key inspectKey, done bool) (*completedFile, error) {
+	if done {
+		ts.st.mutex.Lock()
+		defer ts.st.mutex.Unlock()
+		return ts.st.completedFileLocked(key)
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	defer func() { ts.awaiting = nil }()
+	var f *completedFile
+	for f == nil {
+		if ready, ok := ts.ready[key]; ok {
+			f = &ready
+		} else if ts.finished || ts.failed[key] {
+			return nil, nil
+		} else {
+			// the jobs producer may have to hand this file out first
+			ts.awaiting = &key
+			ts.cond.Broadcast()
+			ts.cond.Wait()
+		}
+	}
+	delete(ts.ready, key)
+	return f, nil
+}
+
+// Verify a symbolic link before it is written out, since it has no part
+// checksums and cannot be verified once removed. A file that does not
+// match is reset, to be downloaded again.
+func (ts *tarSink) verify(f completedFile) error {
+	if f.kind != 1 || f.md5 == "" {
+		return nil
+	}
+	err := verifyFileMD5(f.path(), f.md5)
+	if err == nil {
+		return nil
+	}
+	slog.Error("symbolic link failed verification", "file_id", f.fileId, "path", f.path(), "error", err)
+	ts.st.resetSymlinkFile(DXFileSymlink{Id: f.fileId, Folder: f.folder, Name: f.name})
+	return fmt.Errorf("%s does not match its checksum, the output is incomplete: %w", f.path(), err)
+}
+
+// Append a file to the archive, and remove it from the download directory
+func (ts *tarSink) emit(f completedFile) error {
+	localf, err := os.Open(f.path())
+	if err != nil {
+		return err
+	}
+	defer localf.Close()
+	fi, err := localf.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != f.size {
+		return fmt.Errorf("file has %d bytes, expected %d", fi.Size(), f.size)
+	}
+
+	// the times and modes set by the metadata options are in place
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(path.Join(f.folder, f.name), "/"),
+		Size:     f.size,
+		Mode:     int64(fi.Mode().Perm()),
+		ModTime:  fi.ModTime(),
+	}
+	if ts.xattrs {
+		hdr.PAXRecords = make(map[string]string)
+		for _, attr := range provenanceXattrs(f) {
+			hdr.PAXRecords["SCHILY.xattr."+attr[0]] = attr[1]
+		}
+	}
+	if err := ts.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ts.tw, localf); err != nil {
+		return err
+	}
+	// make sure the file is out before removing it
+	if err := ts.tw.Flush(); err != nil {
+		return err
+	}
+	localf.Close()
+
+	st := ts.st
+	st.mutex.Lock()
+	_, err = st.db.Exec("INSERT INTO output_emitted VALUES (?, ?, ?, ?)", f.kind, f.fileId, f.folder, f.name)
+	st.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(f.path()); err != nil {
+		slog.Warn("could not remove file written to the output", "path", f.path(), "error", err)
+	}
+	slog.Debug("file written to the output", "file_id", f.fileId, "path", f.path(), "output", ts.output)
+	for dir := filepath.Dir(filepath.Join(".", f.folder, f.name)); dir != "."; dir = filepath.Dir(dir) {
+		ts.dirs[dir] = true
+	}
+	ts.numFiles++
+	ts.numBytes += f.size
+	return nil
+}
+
+// Wait for the files to be written to the archive, and finish it. The
+// archive is finished even if some files are missing, so that the files
+// before them can be extracted.
+func (ts *tarSink) close() error {
+	ts.closeOnce.Do(func() {
+		ts.mutex.Lock()
+		ts.finished = true
+		ts.cond.Broadcast()
+		ts.mutex.Unlock()
+		<-ts.emitted
+
+		err := ts.tw.Close()
+		if ts.gz != nil {
+			if gzErr := ts.gz.Close(); err == nil {
+				err = gzErr
+			}
+		}
+		if ts.file != nil {
+			if fileErr := ts.file.Close(); err == nil {
+				err = fileErr
+			}
+		}
+
+		// the directories emptied by writing the files out, deepest first
+		var dirs []string
+		for dir := range ts.dirs {
+			dirs = append(dirs, dir)
+		}
+		sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+		for _, dir := range dirs {
+			os.Remove(dir)
+		}
+
+		output := ts.output
+		if output == "-" {
+			output = "the standard output"
+		}
+		PrintLogAndOut("Wrote %d files (%s) to %s\n", ts.numFiles, diskSpaceString(ts.numBytes), output)
+		if ts.err != nil {
+			ts.closeErr = ts.err
+		} else {
+			ts.closeErr = err
+		}
+	})
+	return ts.closeErr
+}
@@ -0,0 +1,144 @@
+package dxda
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTarOutput(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(3, 300*KiB, 128*KiB)
+	// the smallest file is downloaded first, and written last
+	files[1].data = files[1].data[:200*KiB]
+	files[2].data = files[2].data[:100*KiB]
+	ts := newTestServer(files, 0, 0)
+	defer ts.Close()
+
+	var manifest Manifest
+	manifest.Files = append(manifest.Files, files[0].manifestEntry("/exome/a"))
+	manifest.Files = append(manifest.Files, files[1].manifestEntry("/exome/b"))
+	manifest.Files = append(manifest.Files, files[2].manifestEntry("/exome/a"))
+	expected := []string{"exome/a/" + files[0].name, "exome/b/" + files[1].name, "exome/a/" + files[2].name}
+
+	download := func(opts Opts) {
+		t.Helper()
+		opts.NumThreads = 2
+		opts.Order = OrderSmallestFirst
+		if err := ts.download(t, opts, manifest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readTar := func(r io.Reader) []*tar.Header {
+		t.Helper()
+		var headers []*tar.Header
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return headers
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := len(headers)
+			if i >= len(files) || hdr.Name != expected[i] || string(data) != string(files[i].data) {
+				t.Fatalf("Expected %v in manifest order, got %s at %d", expected, hdr.Name, i)
+			}
+			headers = append(headers, hdr)
+		}
+	}
+
+	// compressed by the extension, with the provenance of the files
+	download(Opts{Output: "exome.tar.gz", Provenance: ProvenanceXattr})
+	archive, err := os.Open("exome.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := readTar(gz)
+	if len(headers) != len(files) {
+		t.Fatalf("Expected %d files in the archive, got %d", len(files), len(headers))
+	}
+	if id := headers[1].PAXRecords["SCHILY.xattr."+xattrFileId]; id != files[1].id {
+		t.Errorf("Expected the file ID in the archive, got %q", id)
+	}
+	if _, err := os.Stat("exome"); !os.IsNotExist(err) {
+		t.Error("Expected the files written to the archive to be removed")
+	}
+
+	// the files are downloaded again for the next archive, here a stream
+	var stream bytes.Buffer
+	download(Opts{Output: "-", OutputStream: &stream})
+	if headers := readTar(&stream); len(headers) != len(files) {
+		t.Fatalf("Expected %d files in the stream, got %d", len(files), len(headers))
+	}
+
+	// with no room to stage files, the file the archive waits for is
+	// handed out ahead of the smaller ones
+	saved := maxStagedBytes
+	maxStagedBytes = 1
+	defer func() { maxStagedBytes = saved }()
+	stream.Reset()
+	download(Opts{Output: "-", OutputStream: &stream})
+	if headers := readTar(&stream); len(headers) != len(files) {
+		t.Fatalf("Expected %d files in the stream, got %d", len(files), len(headers))
+	}
+}
+
+// Symbolic links are verified before they are written to the archive, and
+// downloaded again if they do not match
+func TestTarVerifySymlink(t *testing.T) {
+	chdirTemp(t)
+	files := makeTestFiles(1, 1000, 400)
+	sum := md5.Sum(files[0].data)
+	manifest := Manifest{Files: []DXFile{DXFileSymlink{Folder: "/links", Id: files[0].id, ProjId: "project-test",
+		Name: files[0].name, Size: int64(len(files[0].data)), MD5: hex.EncodeToString(sum[:])}}}
+
+	st := NewDxDa(DXEnvironment{}, "test.manifest.json.bz2", Opts{NumThreads: 2, Output: "links.tar"})
+	defer st.Close()
+	st.CreateManifestDB(manifest, "test.manifest.json.bz2")
+	corrupted := append([]byte(nil), files[0].data...)
+	corrupted[500] ^= 0xff
+	if err := os.WriteFile("links/"+files[0].name, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec("UPDATE manifest_symlink_stats SET bytes_fetched = size"); err != nil {
+		t.Fatal(err)
+	}
+
+	// hooks would read the files written out
+	st.hooks = &hookRunner{}
+	if _, err := newTarSink(st); err == nil || !strings.Contains(err.Error(), "hooks") {
+		t.Errorf("Expected hooks to be rejected, got %v", err)
+	}
+	st.hooks = nil
+
+	sink, err := newTarSink(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.close(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected the symbolic link to fail verification, got %v", err)
+	}
+	if sink.numFiles != 0 {
+		t.Errorf("Expected nothing to be written to the archive, got %d files", sink.numFiles)
+	}
+	if n := st.queryDBIntegerResult("SELECT COUNT(*) FROM manifest_symlink_stats WHERE bytes_fetched = size"); n != 0 {
+		t.Errorf("Expected the symbolic link to be downloaded again, got %d parts done", n)
+	}
+}
@@ -0,0 +1,145 @@
+package dxda
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters for the data transfers. These are updated by the download
+// workers, the preauth thread and the database update thread. They are
+// read by the adaptive concurrency controller, the progress reports and
+// the metrics endpoint.
+type downloadStats struct {
+	bytesReceived atomic.Int64 // data read from response bodies
+	requests      atomic.Int64 // http requests issued
+	errors        atomic.Int64 // failed requests, including throttling
+	throttled     atomic.Int64 // requests rejected with 429 or 503
+	failedParts   atomic.Int64 // parts that could not be downloaded
+
+	partsComplete      atomic.Int64 // parts recorded in the database
+	bytesComplete      atomic.Int64 // size of the parts recorded in the database
+	lastCompleteNs     atomic.Int64 // time the last part was recorded
+	checksumMismatches atomic.Int64 // parts downloaded again due to a bad checksum
+	urlGenerations     atomic.Int64 // pre-authenticated URLs created
+
+	// Retryable failures, by http status. Connection errors that are
+	// retried are recorded under "connection".
+	retriesMutex sync.Mutex
+	retries      map[string]int64
+
+	latency *latencyHistogram
+	recent  *recentErrors
+}
+
+func newDownloadStats() *downloadStats {
+	return &downloadStats{
+		retries: make(map[string]int64),
+		latency: newLatencyHistogram(),
+		recent:  &recentErrors{},
+	}
+}
+
+func (ds *downloadStats) addRetry(status string) {
+	ds.retriesMutex.Lock()
+	defer ds.retriesMutex.Unlock()
+	ds.retries[status]++
+}
+
+// A copy of the retry counts, safe to use without locking
+func (ds *downloadStats) retryCounts() map[string]int64 {
+	ds.retriesMutex.Lock()
+	defer ds.retriesMutex.Unlock()
+	counts := make(map[string]int64, len(ds.retries))
+	for status, cnt := range ds.retries {
+		counts[status] = cnt
+	}
+	return counts
+}
+
+// Upper bounds of the request latency buckets, in seconds
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// A histogram of request durations, in the layout used by Prometheus
+type latencyHistogram struct {
+	counts   []atomic.Int64 // one per bucket, plus one for +Inf
+	sumNanos atomic.Int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{
+		counts: make([]atomic.Int64, len(latencyBuckets)+1),
+	}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d.Seconds() > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sumNanos.Add(int64(d))
+}
+
+func isThrottleStatus(status int) bool {
+	return status == 429 || status == 503
+}
+
+// A response body that counts the bytes read through it. The request
+// latency is recorded when the body is closed.
+type countingBody struct {
+	body  io.ReadCloser
+	stats *downloadStats
+	start time.Time
+	once  sync.Once
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.body.Read(p)
+	cb.stats.bytesReceived.Add(int64(n))
+	return n, err
+}
+
+func (cb *countingBody) Close() error {
+	cb.once.Do(func() {
+		cb.stats.latency.observe(time.Since(cb.start))
+	})
+	return cb.body.Close()
+}
+
+// An http transport that records every request in the download statistics.
+type monitoredTransport struct {
+	base  http.RoundTripper
+	stats *downloadStats
+}
+
+func (mt *monitoredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	mt.stats.requests.Add(1)
+	resp, err := mt.base.RoundTrip(req)
+	if err != nil {
+		mt.stats.errors.Add(1)
+		mt.stats.latency.observe(time.Since(start))
+		if isRetryableConnError(req.Context(), err) {
+			mt.stats.addRetry("connection")
+		}
+		mt.stats.recent.add(fmt.Sprintf("%s %s: %s", req.Method, req.URL.Host, err.Error()))
+		return nil, err
+	}
+	if !isGood(resp.StatusCode) {
+		mt.stats.errors.Add(1)
+		if isThrottleStatus(resp.StatusCode) {
+			mt.stats.throttled.Add(1)
+		}
+		if isRetryable(req.Context(), req.Method, resp.StatusCode) {
+			mt.stats.addRetry(strconv.Itoa(resp.StatusCode))
+		}
+		mt.stats.recent.add(fmt.Sprintf("%s %s: %s", req.Method, req.URL.Host, resp.Status))
+	}
+	resp.Body = &countingBody{body: resp.Body, stats: mt.stats, start: start}
+	return resp, nil
+}
@@ -0,0 +1,21 @@
+package dxda
+
+import (
+	"os"
+)
+
+// Default terminal dimensions, when the size cannot be queried
+const (
+	defaultTermWidth  = 80
+	defaultTermHeight = 24
+)
+
+// Check if a file is an interactive terminal, as opposed to a pipe,
+// a regular file or /dev/null.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
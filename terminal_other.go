@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package dxda
+
+import (
+	"os"
+)
+
+// The width and height of the terminal, in characters
+func terminalSize(f *os.File) (int, int) {
+	return defaultTermWidth, defaultTermHeight
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package dxda
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The width and height of the terminal, in characters
+func terminalSize(f *os.File) (int, int) {
+	var ws struct {
+		Row, Col, Xpixel, Ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.Col == 0 || ws.Row == 0 {
+		return defaultTermWidth, defaultTermHeight
+	}
+	return int(ws.Col), int(ws.Row)
+}
@@ -0,0 +1,311 @@
+package dxda
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest read performed in one go on a throttled connection. Keeping
+	// this small smooths out the traffic when the limit is low.
+	maxThrottledRead = 64 * KiB
+
+	// How often the bandwidth schedule is re-evaluated, and the schedule
+	// file checked for modifications.
+	bandwidthScheduleInterval = 30 * time.Second
+)
+
+// A token bucket shared by all the download workers. The rate is in bytes
+// per second, zero means unlimited. The bucket holds at most one second
+// worth of tokens.
+type bandwidthLimiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		rate: rate,
+		last: time.Now(),
+	}
+}
+
+func (bl *bandwidthLimiter) getRate() int64 {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	return bl.rate
+}
+
+func (bl *bandwidthLimiter) setRate(rate int64) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bl.rate = rate
+	bl.tokens = 0
+	bl.last = time.Now()
+}
+
+// Account for [n] bytes that were received, sleeping if we are going faster
+// than the current rate allows.
+func (bl *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	bl.mutex.Lock()
+	if bl.rate <= 0 {
+		bl.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	bl.tokens += now.Sub(bl.last).Seconds() * float64(bl.rate)
+	if bl.tokens > float64(bl.rate) {
+		bl.tokens = float64(bl.rate)
+	}
+	bl.last = now
+	bl.tokens -= float64(n)
+
+	var delay time.Duration
+	if bl.tokens < 0 {
+		delay = time.Duration(-bl.tokens / float64(bl.rate) * float64(time.Second))
+	}
+	bl.mutex.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	// time spent waiting for the limit does not count against the request
+	if d, ok := ctx.Value(requestDeadlineKey{}).(*requestDeadline); ok {
+		d.extend(delay)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// The deadline of a data request, past which it is canceled and retried.
+// It is pushed back by the time the request spends throttled, so that a
+// low bandwidth limit does not make every request time out.
+type requestDeadline struct {
+	mutex    sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+}
+
+type requestDeadlineKey struct{}
+
+// Cancel the request, through [cancel], once [timeout] has passed
+func newRequestDeadline(timeout time.Duration, cancel func()) *requestDeadline {
+	return &requestDeadline{
+		deadline: time.Now().Add(timeout),
+		timer:    time.AfterFunc(timeout, cancel),
+	}
+}
+
+func (d *requestDeadline) extend(delay time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deadline = d.deadline.Add(delay)
+	if d.timer.Stop() {
+		d.timer.Reset(time.Until(d.deadline))
+	}
+}
+
+func (d *requestDeadline) stop() {
+	d.timer.Stop()
+}
+
+// A response body whose reads are charged against a bandwidth limiter
+type throttledBody struct {
+	body    io.ReadCloser
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (tb *throttledBody) Read(p []byte) (int, error) {
+	if tb.limiter.getRate() > 0 && len(p) > maxThrottledRead {
+		p = p[:maxThrottledRead]
+	}
+	n, err := tb.body.Read(p)
+	if n > 0 {
+		if werr := tb.limiter.wait(tb.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (tb *throttledBody) Close() error {
+	return tb.body.Close()
+}
+
+// An http transport that throttles the data read from response bodies.
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *bandwidthLimiter
+}
+
+func (tt *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := tt.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &throttledBody{
+		body:    resp.Body,
+		ctx:     req.Context(),
+		limiter: tt.limiter,
+	}
+	return resp, nil
+}
+
+// A time-of-day window with its own bandwidth limit. Offsets are measured
+// from midnight, local time. A window whose end is before its start wraps
+// around midnight.
+type bandwidthWindow struct {
+	start time.Duration
+	end   time.Duration
+	rate  int64
+}
+
+func (w bandwidthWindow) contains(ofs time.Duration) bool {
+	if w.start <= w.end {
+		return w.start <= ofs && ofs < w.end
+	}
+	return ofs >= w.start || ofs < w.end
+}
+
+// BandwidthSchedule is a list of time-of-day windows, each with a bandwidth
+// limit. The first window that contains the current time wins.
+type BandwidthSchedule []bandwidthWindow
+
+// Parse a time of day in the format HH:MM
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseBandwidthSchedule parses a schedule with one window per line (or
+// separated by commas), in the format:
+//
+//	08:00-18:00 50MB
+//	18:00-20:00 unlimited
+//
+// Empty lines and lines starting with '#' are ignored.
+func ParseBandwidthSchedule(text string) (BandwidthSchedule, error) {
+	var schedule BandwidthSchedule
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(text, ",", "\n")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid schedule entry %q, expected 'HH:MM-HH:MM RATE'", line)
+		}
+		times := strings.Split(fields[0], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", fields[0])
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := ParseBandwidth(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, bandwidthWindow{start: start, end: end, rate: rate})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// ReadBandwidthSchedule reads a schedule from a file
+func ReadBandwidthSchedule(fname string) (BandwidthSchedule, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBandwidthSchedule(string(data))
+}
+
+// The rate at time [t]. If no window matches, the default rate is returned.
+func (bs BandwidthSchedule) rateAt(t time.Time, defaultRate int64) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	ofs := t.Sub(midnight)
+	for _, w := range bs {
+		if w.contains(ofs) {
+			return w.rate
+		}
+	}
+	return defaultRate
+}
+
+func bandwidthString(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return diskSpaceString(rate) + "/s"
+}
+
+// Apply the bandwidth schedule periodically, until the stop channel is
+// closed. The schedule file is re-read when it changes, so the limits can
+// be adjusted while the download is running.
+func (st *State) bandwidthScheduler(stop <-chan struct{}) {
+	var schedule BandwidthSchedule
+	var modTime time.Time
+
+	for {
+		if st.opts.BandwidthSchedule != "" {
+			fi, err := os.Stat(st.opts.BandwidthSchedule)
+			if err != nil {
+				slog.Warn("could not stat bandwidth schedule", "schedule", st.opts.BandwidthSchedule, "error", err)
+			} else if !fi.ModTime().Equal(modTime) {
+				newSchedule, err := ReadBandwidthSchedule(st.opts.BandwidthSchedule)
+				if err != nil {
+					slog.Warn("ignoring invalid bandwidth schedule", "schedule", st.opts.BandwidthSchedule, "error", err)
+				} else {
+					schedule = newSchedule
+					slog.Info("loaded bandwidth schedule", "schedule", st.opts.BandwidthSchedule, "windows", len(schedule))
+				}
+				modTime = fi.ModTime()
+			}
+		}
+
+		rate := schedule.rateAt(time.Now(), st.opts.MaxBandwidth)
+		if override := st.bandwidthOverride.Load(); override >= 0 {
+			// set through the control API
+			rate = override
+		}
+		if rate != st.limiter.getRate() {
+			st.limiter.setRate(rate)
+			slog.Info("bandwidth limit changed", "bandwidth", bandwidthString(rate))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(bandwidthScheduleInterval):
+		}
+	}
+}
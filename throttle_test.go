@@ -0,0 +1,116 @@
+package dxda
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	cases := map[string]int64{
+		"":          0,
+		"unlimited": 0,
+		"1024":      1024,
+		"500K":      500 * KiB,
+		"50MB":      50 * MiB,
+		"50MiB":     50 * MiB,
+		"1.5G/s":    GiB + GiB/2,
+	}
+	for s, expected := range cases {
+		rate, err := ParseBandwidth(s)
+		if err != nil {
+			t.Fatalf("Expected no error for %q, got %v", s, err)
+		}
+		if rate != expected {
+			t.Errorf("Expected %d for %q, got %d", expected, s, rate)
+		}
+	}
+
+	for _, s := range []string{"fast", "B", "iB", "M", "-1M", "inf", "NaN", "1e30T", "0.5", "0.1B"} {
+		if _, err := ParseBandwidth(s); err == nil {
+			t.Errorf("Expected error for invalid bandwidth %q", s)
+		}
+	}
+}
+
+func TestThrottledDeadline(t *testing.T) {
+	bl := newBandwidthLimiter(100 * KiB)
+	ctx, cancel := context.WithCancel(context.Background())
+	deadline := newRequestDeadline(100*time.Millisecond, cancel)
+	defer deadline.stop()
+	ctx = context.WithValue(ctx, requestDeadlineKey{}, deadline)
+
+	// throttled for 300ms, past the deadline
+	if err := bl.wait(ctx, 30*KiB); err != nil {
+		t.Fatalf("Expected the deadline to be extended, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Expected the request to be alive after waiting for the limit")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if ctx.Err() == nil {
+		t.Errorf("Expected the request to time out once it is no longer throttled")
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule(`
+# working hours
+08:00-18:00 50MB
+22:00-02:00 1MB
+`)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(schedule) != 2 {
+		t.Fatalf("Expected 2 windows, got %d", len(schedule))
+	}
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local)
+	}
+	cases := []struct {
+		t        time.Time
+		expected int64
+	}{
+		{at(7, 59), 7},
+		{at(8, 0), 50 * MiB},
+		{at(17, 59), 50 * MiB},
+		{at(18, 0), 7},
+		{at(23, 30), MiB},
+		{at(1, 0), MiB},
+		{at(2, 0), 7},
+	}
+	for _, c := range cases {
+		if rate := schedule.rateAt(c.t, 7); rate != c.expected {
+			t.Errorf("Expected rate %d at %s, got %d", c.expected, c.t.Format("15:04"), rate)
+		}
+	}
+
+	if _, err := ParseBandwidthSchedule("08:00 50MB"); err == nil {
+		t.Errorf("Expected error for a window without an end time")
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := newBandwidthLimiter(100 * KiB)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.wait(context.Background(), 10*KiB); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("Expected 50KiB at 100KiB/s to take about 500ms, took %s", elapsed)
+	}
+
+	// unlimited
+	limiter.setRate(0)
+	start = time.Now()
+	limiter.wait(context.Background(), 100*MiB)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected no delay without a limit, took %s", elapsed)
+	}
+}
@@ -0,0 +1,261 @@
+package dxda
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The part each download worker is currently working on
+type workerActivity struct {
+	mutex   sync.Mutex
+	current map[int]string
+}
+
+func newWorkerActivity() *workerActivity {
+	return &workerActivity{current: make(map[int]string)}
+}
+
+func (wa *workerActivity) set(id int, p DBPart) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	wa.current[id] = fmt.Sprintf("%s part %d (%d MB)", p.fileName(), partId(p), bytes2MiB(int64(p.size())))
+}
+
+func (wa *workerActivity) clear(id int) {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	delete(wa.current, id)
+}
+
+// The busy workers, sorted by worker id
+func (wa *workerActivity) snapshot() []string {
+	wa.mutex.Lock()
+	defer wa.mutex.Unlock()
+	ids := make([]int, 0, len(wa.current))
+	for id := range wa.current {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		lines = append(lines, fmt.Sprintf("worker %3d  %s", id, wa.current[id]))
+	}
+	return lines
+}
+
+// The last few errors seen during the download, oldest first
+type recentErrors struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+const numRecentErrors = 5
+
+func (re *recentErrors) add(msg string) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	re.messages = append(re.messages, time.Now().Format("15:04:05")+"  "+msg)
+	if len(re.messages) > numRecentErrors {
+		re.messages = re.messages[len(re.messages)-numRecentErrors:]
+	}
+}
+
+func (re *recentErrors) snapshot() []string {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	return append([]string{}, re.messages...)
+}
+
+// Use the full screen terminal UI only when a person is watching. Job
+// logs, pipes and files get the line-by-line progress reports.
+func (st *State) useTUI() bool {
+	return st.opts.TUI && st.opts.ProgressFormat != ProgressFormatJSON && st.dxEnv.DxJobId == "" && isTerminal(os.Stdout)
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// Draw a sequence of values as a line of block characters, scaled to the
+// largest value.
+func sparkline(values []float64) string {
+	maxValue := 0.0
+	for _, v := range values {
+		if v > maxValue {
+			maxValue = v
+		}
+	}
+	var sb strings.Builder
+	for _, v := range values {
+		i := 0
+		if maxValue > 0 {
+			i = int(v / maxValue * float64(len(sparkBlocks)-1))
+		}
+		sb.WriteRune(sparkBlocks[i])
+	}
+	return sb.String()
+}
+
+func progressBar(fraction float64, width int) string {
+	if width < 1 {
+		return ""
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * float64(width))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+// Cut a line to the width of the terminal
+func truncateLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:width])
+}
+
+// Everything needed to draw one screen
+type tuiFrame struct {
+	report    ProgressReport
+	rates     []float64 // recent throughput samples, in bytes per second
+	workers   []string
+	limit     int
+	retries   map[string]int64
+	errors    []string
+	startTime time.Time
+}
+
+func (fr tuiFrame) render(width, height int) string {
+	var lines []string
+	r := fr.report
+
+	lines = append(lines, fmt.Sprintf("dx-download-agent %s   running for %s",
+		Version, time.Since(fr.startTime).Round(time.Second)))
+	lines = append(lines, "")
+
+	fraction := 0.0
+	if r.BytesTotal > 0 {
+		fraction = float64(r.BytesComplete) / float64(r.BytesTotal)
+	}
+	lines = append(lines, fmt.Sprintf("%s %5.1f%%", progressBar(fraction, width-10), 100*fraction))
+	eta := "unknown"
+	if r.EtaSec != nil {
+		eta = etaString(*r.EtaSec)
+	}
+	lines = append(lines, fmt.Sprintf("%d/%d MB   %d/%d Parts   ETA %s",
+		bytes2MiB(r.BytesComplete), bytes2MiB(r.BytesTotal), r.PartsComplete, r.PartsTotal, eta))
+	lines = append(lines, "")
+
+	crntRate := 0.0
+	if len(fr.rates) > 0 {
+		crntRate = fr.rates[len(fr.rates)-1]
+	}
+	lines = append(lines, fmt.Sprintf("Throughput %.1f MB/s", crntRate/MiB))
+	lines = append(lines, sparkline(fr.rates))
+	lines = append(lines, "")
+
+	var retries []string
+	for status, cnt := range fr.retries {
+		retries = append(retries, fmt.Sprintf("%s=%d", status, cnt))
+	}
+	sort.Strings(retries)
+	if len(retries) == 0 {
+		retries = append(retries, "none")
+	}
+	lines = append(lines, "Retries: "+strings.Join(retries, " "))
+	lines = append(lines, "Recent errors:")
+	if len(fr.errors) == 0 {
+		lines = append(lines, "  none")
+	}
+	for _, msg := range fr.errors {
+		lines = append(lines, "  "+msg)
+	}
+	lines = append(lines, "")
+
+	// the workers get whatever room is left
+	lines = append(lines, fmt.Sprintf("Workers (%d/%d active):", len(fr.workers), fr.limit))
+	room := height - len(lines) - 1
+	for i, w := range fr.workers {
+		if i >= room-1 && len(fr.workers) > room {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(fr.workers)-i))
+			break
+		}
+		lines = append(lines, "  "+w)
+	}
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	var sb strings.Builder
+	for _, line := range lines {
+		// clear the remainder of each line, so no stale text is left behind
+		sb.WriteString(truncateLine(line, width))
+		sb.WriteString("\x1b[K\r\n")
+	}
+	// clear the rest of the screen
+	sb.WriteString("\x1b[J")
+	return sb.String()
+}
+
+// A full screen view of the download, redrawn every second until the done
+// channel is closed. The alternate screen buffer is used, so the terminal
+// contents are restored when the download finishes.
+func (st *State) downloadProgressTUI(wg *sync.WaitGroup, done <-chan struct{}) {
+	defer wg.Done()
+
+	// enter the alternate screen, and hide the cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	startTime := time.Now()
+	lastReportTs := time.Time{}
+	var report ProgressReport
+	var rates []float64
+	lastBytes := st.stats.bytesReceived.Load()
+	lastSampleTs := startTime
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(1 * time.Second):
+		}
+		now := time.Now()
+		width, height := terminalSize(os.Stdout)
+
+		// throughput sampled every second
+		bytes := st.stats.bytesReceived.Load()
+		rates = append(rates, float64(bytes-lastBytes)/now.Sub(lastSampleTs).Seconds())
+		if len(rates) > width {
+			rates = rates[len(rates)-width:]
+		}
+		lastBytes = bytes
+		lastSampleTs = now
+
+		// the database is queried less often
+		if now.After(lastReportTs.Add(st.ds.ProgressInterval)) {
+			lastReportTs = now
+			window := now.UnixNano() - startTime.UnixNano()
+			if window > st.ds.MaxWindowSize {
+				window = st.ds.MaxWindowSize
+			}
+			report = st.progressReport(window)
+		}
+
+		frame := tuiFrame{
+			report:    report,
+			rates:     rates,
+			workers:   st.activity.snapshot(),
+			limit:     st.gate.getLimit(),
+			retries:   st.stats.retryCounts(),
+			errors:    st.stats.recent.snapshot(),
+			startTime: startTime,
+		}
+		// move the cursor to the top left corner, and redraw
+		fmt.Print("\x1b[H" + frame.render(width, height))
+	}
+}
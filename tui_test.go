@@ -0,0 +1,42 @@
+package dxda
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTUIRender(t *testing.T) {
+	if s := sparkline([]float64{0, 1, 2, 4, 8}); s != "▁▁▂▄█" {
+		t.Errorf("Unexpected sparkline %s", s)
+	}
+
+	eta := int64(90)
+	frame := tuiFrame{
+		report:    ProgressReport{BytesComplete: 50 * MiB, BytesTotal: 100 * MiB, PartsComplete: 5, PartsTotal: 10, EtaSec: &eta},
+		rates:     []float64{MiB, 2 * MiB},
+		limit:     4,
+		retries:   map[string]int64{"503": 2},
+		errors:    []string{"12:00:00  GET example.com: 503 Service Unavailable"},
+		startTime: time.Now(),
+	}
+	for i := 0; i < 20; i++ {
+		frame.workers = append(frame.workers, "worker busy")
+	}
+	screen := frame.render(60, 24)
+	lines := strings.Split(strings.TrimSuffix(screen, "\x1b[J"), "\r\n")
+	if len(lines)-1 > 24 {
+		t.Errorf("Expected at most 24 lines, got %d", len(lines)-1)
+	}
+	for _, expected := range []string{" 50.0%", "ETA 1m30s", "Throughput 2.0 MB/s", "503=2", "(20/4 active)", "more"} {
+		if !strings.Contains(screen, expected) {
+			t.Errorf("Expected %q on the screen:\n%s", expected, screen)
+		}
+	}
+	for _, line := range lines {
+		line = strings.TrimSuffix(line, "\x1b[K")
+		if len([]rune(line)) > 60 {
+			t.Errorf("Line is wider than the terminal: %q", line)
+		}
+	}
+}
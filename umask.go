@@ -0,0 +1,15 @@
+//go:build !windows
+
+package dxda
+
+import (
+	"os"
+	"syscall"
+)
+
+// SetUmask sets the file mode creation mask of the process, used for the
+// files and directories created before their modes are applied.
+func SetUmask(mask os.FileMode) error {
+	syscall.Umask(int(mask))
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package dxda
+
+import (
+	"errors"
+	"os"
+)
+
+// Windows has no umask
+func SetUmask(mask os.FileMode) error {
+	return errors.New("setting the umask is not supported on Windows")
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pbnjay/memory"
@@ -31,9 +34,121 @@ const (
 
 // Configuration options for the download agent
 type Opts struct {
-	NumThreads int  // number of workers to process downloads
-	Verbose    bool // verbose logging
-	GcInfo     bool // Garbage collection statistics
+	NumThreads  int  // number of workers to process downloads
+	Verbose     bool // verbose logging
+	GcInfo      bool // Garbage collection statistics
+	Preallocate bool // reserve disk space for each file before downloading
+
+	// Bandwidth limit in bytes per second, zero is unlimited
+	MaxBandwidth int64
+	// File with time-of-day bandwidth windows, overriding MaxBandwidth
+	// while they are active
+	BandwidthSchedule string
+
+	// Adjust the number of active workers during the download, based on
+	// throughput, errors and memory use. NumThreads is the starting point.
+	AdaptiveThreads bool
+
+	// Order in which parts are downloaded, one of the Order* constants
+	Order string
+
+	// Format of the progress reports, text or json. JSON reports are
+	// written to ProgressStream, the standard output if nil, so that the
+	// other messages can be sent elsewhere.
+	ProgressFormat string
+	ProgressStream io.Writer
+
+	// Address for serving Prometheus metrics during the download, for
+	// example localhost:9100. Empty if metrics are disabled.
+	MetricsAddr string
+
+	// Show a full screen terminal UI while downloading. Ignored when the
+	// output is not a terminal, or when running inside a job.
+	TUI bool
+
+	// Address of the local control API, for example localhost:9101 or
+	// unix:/tmp/dxda.sock. Empty if the API is disabled.
+	ControlAddr string
+
+	// Hooks run when files complete or fail, see hooks.go. A shell command
+	// receiving the event on its standard input, and a URL the event is
+	// posted to. HookEvents is a comma separated list of events, all of
+	// them if empty.
+	HookCommand string
+	HookURL     string
+	HookEvents  string
+
+	// Only report on the state of the download, without changing the
+	// database or the local files. The database is opened read-only.
+	DryRun bool
+
+	// Skip the checksums of files that have not changed since they last
+	// passed inspection, judging by their size, modification time and inode.
+	Incremental bool
+
+	// Compute whole file checksums during the download. FileChecksums is a
+	// comma separated list of algorithms, md5 or sha256, and ChecksumFormat
+	// is sidecar (the default) or manifest.
+	FileChecksums  string
+	ChecksumFormat string
+
+	// Lay out a new download as a BagIt bag, with the files in the data
+	// directory. Only used when the manifest database is created.
+	BagIt bool
+
+	// Record where each downloaded file came from: a comma separated list
+	// of outputs, xattr for extended attributes, jsonl for provenance.jsonl.
+	Provenance string
+
+	// Set the modification time of each file to its modification time on
+	// the platform, so that mirrors of the download see unchanged files.
+	PreserveTimes bool
+
+	// Permissions of the downloaded files and their directories, applied
+	// as files complete and at the end of the download regardless of the
+	// umask. Zero keeps the defaults.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// Download files listed more than once, by file ID or by part
+	// checksums, only once, and create the other copies as hardlink,
+	// reflink or copy. Duplicates are found when the manifest database
+	// is created.
+	Dedupe string
+
+	// A content cache directory shared by downloads on the same storage.
+	// Files found in the cache are not downloaded, and downloaded files
+	// are added to it. CacheMode is how files are linked to and from the
+	// cache, hardlink, reflink (the default) or copy, and CacheMaxSize
+	// evicts the least recently used files beyond a size in bytes when the
+	// download ends, zero for no limit.
+	CacheDir     string
+	CacheMode    string
+	CacheMaxSize int64
+
+	// A directory holding an existing copy of some of the files, at the
+	// same paths, for example from an older rsync. The parts that match
+	// the manifest are copied into place instead of being downloaded, and
+	// files that match as a whole are linked as SeedMode says, hardlink,
+	// reflink (the default) or copy.
+	SeedDir  string
+	SeedMode string
+
+	// Write the files to a tar archive at this path instead of a directory
+	// tree, or to OutputStream (the standard output if nil) when the path
+	// is "-". Files are staged in the download directory, and written in
+	// manifest order once verified. OutputCompression is gzip or none, by
+	// default gzip when the path ends in .gz or .tgz.
+	Output            string
+	OutputCompression string
+	OutputStream      io.Writer
+
+	// With an Output of the form s3://bucket/prefix, the files are
+	// uploaded to an S3 compatible object store instead, without being
+	// written to the local disk. S3Endpoint is the URL of the store, AWS
+	// S3 in S3Region (us-east-1 by default) if empty.
+	S3Endpoint string
+	S3Region   string
 }
 
 // A subset of the configuration parameters that the dx-toolkit uses.
@@ -163,6 +278,65 @@ func MinInt64(x, y int64) int64 {
 	return x
 }
 
+// ParseBandwidth converts a human readable rate such as "50MB", "1.5G/s" or
+// "200K" into bytes per second. Units are powers of 1024. The strings
+// "unlimited" and "0" mean no limit, and are returned as zero.
+func ParseBandwidth(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	value, ok := parseBytes(str)
+	if !ok {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	return value, nil
+}
+
+// ParseSize converts a human readable size such as "500GB" or "1.5T" into
+// bytes. Units are powers of 1024. The strings "unlimited" and "0" mean no
+// limit, and are returned as zero.
+func ParseSize(s string) (int64, error) {
+	value, ok := parseBytes(strings.ToUpper(strings.TrimSpace(s)))
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return value, nil
+}
+
+func parseBytes(str string) (int64, bool) {
+	if str == "" || str == "0" || str == "UNLIMITED" {
+		return 0, true
+	}
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	if str == "" {
+		return 0, false
+	}
+
+	multiplier := int64(1)
+	switch str[len(str)-1] {
+	case 'K':
+		multiplier = KiB
+	case 'M':
+		multiplier = MiB
+	case 'G':
+		multiplier = GiB
+	case 'T':
+		multiplier = 1024 * GiB
+	}
+	if multiplier > 1 {
+		str = str[:len(str)-1]
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || !(value >= 0) || value*float64(multiplier) >= math.MaxInt64 {
+		// negative, "inf", "nan", or too large to count
+		return 0, false
+	}
+	bytes := int64(value * float64(multiplier))
+	if bytes == 0 && value > 0 {
+		// a limit below one byte would read as no limit
+		return 0, false
+	}
+	return bytes, true
+}
+
 func safeString2Int(s string) int {
 	i, err := strconv.Atoi(s)
 	check(err)
@@ -174,7 +348,7 @@ func PrintLogAndOut(a string, args ...interface{}) {
 	msg := fmt.Sprintf(a, args...)
 
 	fmt.Print(msg)
-	log.Print(msg)
+	slog.Info(strings.TrimSpace(msg))
 }
 
 func memorySizeBytes() int64 {
@@ -0,0 +1,155 @@
+package dxda
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The state of a file on disk when it last passed inspection. A file
+// whose size, modification time and inode are unchanged is assumed to
+// still have the same contents.
+type fileVerification struct {
+	size       int64
+	mtimeNs    int64
+	inode      uint64
+	verifiedAt int64 // nanoseconds since the epoch
+}
+
+func (v fileVerification) sameFile(other fileVerification) bool {
+	return v.size == other.size && v.mtimeNs == other.mtimeNs && v.inode == other.inode
+}
+
+func (st *State) createVerificationTable() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	_, err := st.db.Exec(`
+	CREATE TABLE IF NOT EXISTS file_verifications (
+		kind        integer,
+		file_id     text,
+		folder      text,
+		name        text,
+		size        integer,
+		mtime       integer,
+		inode       integer,
+		verified_at integer,
+		PRIMARY KEY (kind, file_id, folder, name)
+	);
+	`)
+	return err
+}
+
+// The files that passed a previous inspection. Databases created before
+// verifications were recorded have none.
+func (st *State) previousVerifications() map[inspectKey]fileVerification {
+	verified := make(map[inspectKey]fileVerification)
+	if !st.tableExists("file_verifications") {
+		return verified
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	rows, err := st.db.Query("SELECT kind, file_id, folder, name, size, mtime, inode, verified_at FROM file_verifications")
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		var key inspectKey
+		var v fileVerification
+		var inode int64
+		check(rows.Scan(&key.kind, &key.fileId, &key.folder, &key.name, &v.size, &v.mtimeNs, &inode, &v.verifiedAt))
+		v.inode = uint64(inode)
+		verified[key] = v
+	}
+	check(rows.Err())
+	return verified
+}
+
+// Stat the files that are completely downloaded. This is done before the
+// files are checked, so that a file modified while it is read does not
+// match its recorded state on the next inspection.
+func statCompleteFiles(files []InspectFile, keys []inspectKey) map[inspectKey]fileVerification {
+	stats := make(map[inspectKey]fileVerification)
+	for i, key := range keys {
+		if files[i].PartsIncomplete > 0 {
+			continue
+		}
+		if s, err := statFile(filepath.Join(".", key.folder, key.name)); err == nil {
+			stats[key] = s
+		}
+	}
+	return stats
+}
+
+// The current state of a file on disk
+func statFile(path string) (fileVerification, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileVerification{}, err
+	}
+	return fileVerification{
+		size:    fi.Size(),
+		mtimeNs: fi.ModTime().UnixNano(),
+		inode:   fileInode(fi),
+	}, nil
+}
+
+// The files that can be skipped in an incremental inspection, because
+// they passed a previous inspection and have not changed since.
+func unchangedFiles(stats, previous map[inspectKey]fileVerification) map[inspectKey]fileVerification {
+	unchanged := make(map[inspectKey]fileVerification)
+	for key, s := range stats {
+		if v, ok := previous[key]; ok && v.sameFile(s) {
+			unchanged[key] = v
+		}
+	}
+	return unchanged
+}
+
+// Record the files that passed inspection, with their state before they
+// were checked. Files that failed, or are not completely downloaded, lose
+// their previous verification.
+func (st *State) recordVerifications(report *InspectReport, keys []inspectKey,
+	stats, skipped map[inspectKey]fileVerification, verifiedAt time.Time) error {
+	if err := st.createVerificationTable(); err != nil {
+		return err
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	txn, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, f := range report.Files {
+		key := keys[i]
+		if _, ok := skipped[key]; ok {
+			continue
+		}
+		s, ok := stats[key]
+		if f.Status == statusOK && ok {
+			_, err = txn.Exec("INSERT OR REPLACE INTO file_verifications VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				key.kind, key.fileId, key.folder, key.name, s.size, s.mtimeNs, int64(s.inode), verifiedAt.UnixNano())
+		} else {
+			_, err = txn.Exec("DELETE FROM file_verifications WHERE kind = ? AND file_id = ? AND folder = ? AND name = ?",
+				key.kind, key.fileId, key.folder, key.name)
+		}
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// Forget that a file passed inspection, so that it is checked again
+func (st *State) forgetVerification(key inspectKey) {
+	if !st.tableExists("file_verifications") {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	_, err := st.db.Exec("DELETE FROM file_verifications WHERE kind = ? AND file_id = ? AND folder = ? AND name = ?",
+		key.kind, key.fileId, key.folder, key.name)
+	check(err)
+}
@@ -0,0 +1,34 @@
+package dxda
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Set an extended attribute on a file. Filesystems without extended
+// attributes return errXattrUnsupported.
+func setXattr(path string, name string, value string) error {
+	err := syscall.Setxattr(path, name, []byte(value), 0)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return errXattrUnsupported
+	}
+	return err
+}
+
+func getXattr(path string, name string) (string, error) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(path, name, buf)
+	if errors.Is(err, syscall.ERANGE) {
+		if n, err = syscall.Getxattr(path, name, nil); err == nil {
+			buf = make([]byte, n)
+			n, err = syscall.Getxattr(path, name, buf)
+		}
+	}
+	if errors.Is(err, syscall.ENOTSUP) {
+		return "", errXattrUnsupported
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package dxda
+
+// Extended attributes are only written on Linux
+func setXattr(path string, name string, value string) error {
+	return errXattrUnsupported
+}
+
+func getXattr(path string, name string) (string, error) {
+	return "", errXattrUnsupported
+}